@@ -0,0 +1,289 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Types of alert
+const (
+	alertTypeLevel      = "level"
+	alertTypeRegion     = "region"
+	alertTypeLowBattery = "low_battery"
+	alertTypeSpike      = "spike"
+)
+
+// How long a region alert lasts, unless configured
+const radnoteAlertDefaultMins = 60
+
+// The window within which a rise is a spike, unless configured
+const spikeDefaultWindowSecs = 3600
+
+// An alert that is currently active for a device.  Region alerts expire, and
+// may have been raised by a reading from another nearby device, the source.  Low
+// battery alerts carry the voltage rather than the uSv reading, and spike alerts
+// also carry the rise over the previous reading.
+type radAlert struct {
+	tenant    string
+	DeviceUID string  `json:"device"`
+	Type      string  `json:"type"`
+	Usv       float64 `json:"usv,omitempty"`
+	DeltaUsv  float64 `json:"delta_usv,omitempty"`
+	Voltage   float64 `json:"voltage,omitempty"`
+	Since     int64   `json:"since"`
+	Expires   int64   `json:"expires,omitempty"`
+	Source    string  `json:"source,omitempty"`
+}
+
+// Active alerts, keyed by alertKey
+var alertLock sync.Mutex
+var alertActive = map[string]radAlert{}
+
+// Return the key identifying an alert of a given type for a tenant's device
+func alertKey(tenant string, deviceUID string, alertType string) string {
+	return tenantDevice(tenant, deviceUID) + "/" + alertType
+}
+
+// Whether level alerts are configured
+func alertLevelEnabled() bool {
+	return config().AlertOnUsv > 0
+}
+
+// Whether region alerts are configured
+func alertRegionEnabled() bool {
+	return config().RadnoteAlertLevelUsv > 0
+}
+
+// Whether spike alerts are configured
+func alertSpikeEnabled() bool {
+	return config().SpikeDeltaUsv > 0
+}
+
+// Return the window within which a rise is a spike, in seconds
+func spikeWindowSecs() int64 {
+	if config().SpikeWindowSecs > 0 {
+		return int64(config().SpikeWindowSecs)
+	}
+	return spikeDefaultWindowSecs
+}
+
+// Whether low battery alerts are configured
+func alertLowBatteryEnabled() bool {
+	return config().LowVoltageThreshold > 0
+}
+
+// Return how long a region alert lasts, in seconds
+func radnoteAlertSecs() int64 {
+	if config().RadnoteAlertMins > 0 {
+		return int64(config().RadnoteAlertMins) * 60
+	}
+	return radnoteAlertDefaultMins * 60
+}
+
+// Evaluate a reading that has just been stored for a tenant's device.  The
+// caller must hold radLock.
+func alertEvaluate(tenant string, e RadnoteEvent) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+	now := time.Now().UTC().Unix()
+	alertExpire(now)
+	voltage, present := e.Metrics[voltageMetric]
+	if present && alertLowBatteryEnabled() {
+		alertEvaluateLowBattery(tenant, e, voltage)
+	}
+	usv, present := e.Metrics[defaultMetric]
+	if !present {
+		return
+	}
+	if alertLevelEnabled() {
+		alertEvaluateLevel(tenant, e, usv)
+	}
+	if alertRegionEnabled() && usv >= config().RadnoteAlertLevelUsv {
+		alertRaiseRegion(tenant, e, usv, now)
+	}
+	if alertSpikeEnabled() {
+		alertEvaluateSpike(tenant, e, usv, now)
+	}
+}
+
+// Evaluate a spike alert, comparing the reading with the device's previous one
+// in its history, which the reading has already been added to.  A device's first
+// reading has no baseline, so can't be a spike.  The caller must hold radLock and
+// alertLock.
+func alertEvaluateSpike(tenant string, e RadnoteEvent, usv float64, now int64) {
+	readings := radHistory[tenant][e.Event.DeviceUID]
+	if len(readings) < 2 {
+		return
+	}
+	previous := readings[len(readings)-2]
+	previousUsv, present := previous.metricValue(defaultMetric)
+	if !present || e.Event.When-previous.Event.When > spikeWindowSecs() {
+		return
+	}
+	delta := usv - previousUsv
+	if delta < config().SpikeDeltaUsv {
+		return
+	}
+	key := alertKey(tenant, e.Event.DeviceUID, alertTypeSpike)
+	_, active := alertActive[key]
+	alertActive[key] = radAlert{tenant: tenant, DeviceUID: e.Event.DeviceUID, Type: alertTypeSpike, Usv: usv, DeltaUsv: delta, Since: e.Event.When, Expires: now + spikeWindowSecs()}
+	if !active {
+		slog.Warn("alert raised", "device_uid", e.Event.DeviceUID, "type", alertTypeSpike, "usv", usv, "delta_usv", delta)
+	}
+}
+
+// Forget region alerts that have expired.  The caller must hold alertLock.
+func alertExpire(now int64) {
+	for key, alert := range alertActive {
+		if alert.Expires != 0 && alert.Expires <= now {
+			delete(alertActive, key)
+			slog.Info("alert expired", "device_uid", alert.DeviceUID, "type", alert.Type)
+		}
+	}
+}
+
+// Raise region alerts for a device whose reading reached radnote_alert_level_usv,
+// and for every located device within radnote_alert_region_meters of it, lasting
+// radnote_alert_mins.  Where alerts overlap, a device's alert is extended to the
+// later expiry and retains the higher level.  The caller must hold radLock and
+// alertLock.
+func alertRaiseRegion(tenant string, e RadnoteEvent, usv float64, now int64) {
+	expires := now + radnoteAlertSecs()
+	alertRaiseRegionDevice(tenant, e.Event.DeviceUID, e.Event.DeviceUID, usv, now, expires)
+	if config().RadnoteAlertRegionMeters <= 0 || (e.Event.BestLat == 0 && e.Event.BestLon == 0) {
+		return
+	}
+	region := newQueryRegion(e.Event.BestLat, e.Event.BestLon, config().RadnoteAlertRegionMeters)
+	for deviceUID, other := range tenantEvents(tenant) {
+		if deviceUID == e.Event.DeviceUID || (other.Event.BestLat == 0 && other.Event.BestLon == 0) {
+			continue
+		}
+		if region.contains(other.Event.BestLat, other.Event.BestLon) {
+			alertRaiseRegionDevice(tenant, deviceUID, e.Event.DeviceUID, usv, now, expires)
+		}
+	}
+}
+
+// Raise or extend a device's region alert.  The caller must hold alertLock.
+func alertRaiseRegionDevice(tenant string, deviceUID string, sourceUID string, usv float64, now int64, expires int64) {
+	key := alertKey(tenant, deviceUID, alertTypeRegion)
+	alert, active := alertActive[key]
+	if !active {
+		alertActive[key] = radAlert{tenant: tenant, DeviceUID: deviceUID, Type: alertTypeRegion, Usv: usv, Since: now, Expires: expires, Source: sourceUID}
+		slog.Warn("alert raised", "device_uid", deviceUID, "type", alertTypeRegion, "source", sourceUID, "usv", usv)
+		return
+	}
+	if expires > alert.Expires {
+		alert.Expires = expires
+	}
+	if usv >= alert.Usv {
+		alert.Usv = usv
+		alert.Source = sourceUID
+	}
+	alertActive[key] = alert
+}
+
+// Evaluate a level alert.  A level alert is raised when the reading reaches
+// alert_on_usv and, to avoid flapping while readings hover around that threshold,
+// is only cleared once a reading drops below the lower alert_off_usv.  The caller
+// must hold alertLock.
+func alertEvaluateLevel(tenant string, e RadnoteEvent, usv float64) {
+	key := alertKey(tenant, e.Event.DeviceUID, alertTypeLevel)
+	alert, active := alertActive[key]
+	switch {
+	case !active && usv >= config().AlertOnUsv:
+		alertActive[key] = radAlert{tenant: tenant, DeviceUID: e.Event.DeviceUID, Type: alertTypeLevel, Usv: usv, Since: e.Event.When}
+		slog.Warn("alert raised", "device_uid", e.Event.DeviceUID, "type", alertTypeLevel, "usv", usv)
+	case active && usv < config().AlertOffUsv:
+		delete(alertActive, key)
+		slog.Info("alert cleared", "device_uid", e.Event.DeviceUID, "type", alertTypeLevel, "usv", usv)
+	case active:
+		alert.Usv = usv
+		alertActive[key] = alert
+	}
+
+}
+
+// Evaluate a low battery alert, which is raised only when the voltage first drops
+// below low_voltage_threshold, and cleared once it recovers.  The caller must hold
+// alertLock.
+func alertEvaluateLowBattery(tenant string, e RadnoteEvent, voltage float64) {
+	key := alertKey(tenant, e.Event.DeviceUID, alertTypeLowBattery)
+	alert, active := alertActive[key]
+	switch {
+	case !active && voltage < config().LowVoltageThreshold:
+		alertActive[key] = radAlert{tenant: tenant, DeviceUID: e.Event.DeviceUID, Type: alertTypeLowBattery, Voltage: voltage, Since: e.Event.When}
+		slog.Warn("alert raised", "device_uid", e.Event.DeviceUID, "type", alertTypeLowBattery, "voltage", voltage)
+	case active && voltage >= config().LowVoltageThreshold:
+		delete(alertActive, key)
+		slog.Info("alert cleared", "device_uid", e.Event.DeviceUID, "type", alertTypeLowBattery, "voltage", voltage)
+	case active:
+		alert.Voltage = voltage
+		alertActive[key] = alert
+	}
+}
+
+// Alerts handler, listing the alerts currently active for the request's tenant
+func httpAlertsHandler(w http.ResponseWriter, r *http.Request) {
+
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+
+	alerts := []radAlert{}
+	alertLock.Lock()
+	alertExpire(time.Now().UTC().Unix())
+	for _, alert := range alertActive {
+		if alert.tenant == tenant {
+			alerts = append(alerts, alert)
+		}
+	}
+	alertLock.Unlock()
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].DeviceUID != alerts[j].DeviceUID {
+			return alerts[i].DeviceUID < alerts[j].DeviceUID
+		}
+		return alerts[i].Type < alerts[j].Type
+	})
+
+	o := map[string]interface{}{}
+	if alertLevelEnabled() {
+		o["alert_on_usv"] = config().AlertOnUsv
+		o["alert_off_usv"] = config().AlertOffUsv
+	}
+	if alertLowBatteryEnabled() {
+		o["low_voltage_threshold"] = config().LowVoltageThreshold
+	}
+	if alertSpikeEnabled() {
+		o["spike_delta_usv"] = config().SpikeDeltaUsv
+		o["spike_window_secs"] = spikeWindowSecs()
+	}
+	if alertRegionEnabled() {
+		region := map[string]interface{}{}
+		region["level_usv"] = config().RadnoteAlertLevelUsv
+		region["region_meters"] = config().RadnoteAlertRegionMeters
+		region["mins"] = radnoteAlertSecs() / 60
+		region["sample_mins"] = config().RadnoteAlertSampleMins
+		region["sync_mins"] = config().RadnoteAlertSyncMins
+		o["region_alert"] = region
+	}
+	o["alerts"] = alerts
+	o["captured"] = time.Now().UTC().Unix()
+
+	alertsJSON, err := json.MarshalIndent(o, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(alertsJSON)
+
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Return the active alerts listed by the alerts endpoint, keyed by device and
+// type
+func testAlerts(t *testing.T) map[string]radAlert {
+	t.Helper()
+	w := testGet("/alerts")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /alerts: got %d", w.Code)
+	}
+	listing := struct {
+		Alerts []radAlert `json:"alerts"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &listing)
+	if err != nil {
+		t.Fatalf("alerts aren't JSON: %s", w.Body.String())
+	}
+	alerts := map[string]radAlert{}
+	for _, alert := range listing.Alerts {
+		alerts[alert.DeviceUID+"/"+alert.Type] = alert
+	}
+	return alerts
+}
+
+// A reading reaching the region alert level raises alerts for its device and
+// those nearby, a higher nearby reading takes over an overlapping alert, and the
+// alerts expire
+func TestRegionAlerts(t *testing.T) {
+	testService(t, Config{RadnoteAlertLevelUsv: 1, RadnoteAlertRegionMeters: 1000, RadnoteAlertMins: 10})
+
+	testPostReading(t, "dev:near", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:far", 1700000000, 43.1, -71.1, map[string]interface{}{"usv": 0.1})
+	if alerts := testAlerts(t); len(alerts) != 0 {
+		t.Fatalf("alerts raised by readings below the level: %v", alerts)
+	}
+
+	// Entry, for the device and one nearby
+	start := time.Now().UTC().Unix()
+	testPostReading(t, "dev:hot", 1700000060, 42.101, -71.1, map[string]interface{}{"usv": 2.0})
+	alerts := testAlerts(t)
+	if len(alerts) != 2 {
+		t.Fatalf("got %d alerts, want 2: %v", len(alerts), alerts)
+	}
+	for _, deviceUID := range []string{"dev:hot", "dev:near"} {
+		alert, active := alerts[deviceUID+"/"+alertTypeRegion]
+		if !active {
+			t.Fatalf("%s has no region alert", deviceUID)
+		}
+		if alert.Usv != 2.0 || alert.Source != "dev:hot" {
+			t.Errorf("%s: got %v usv from %s, want 2 from dev:hot", deviceUID, alert.Usv, alert.Source)
+		}
+		if alert.Expires < start+600 || alert.Expires > time.Now().UTC().Unix()+600 {
+			t.Errorf("%s: expires %d, want 10 minutes after %d", deviceUID, alert.Expires, start)
+		}
+	}
+
+	// Overlap, with a higher reading nearby taking over the nearby device's alert
+	testPostReading(t, "dev:hotter", 1700000120, 42.099, -71.1, map[string]interface{}{"usv": 3.0})
+	alerts = testAlerts(t)
+	near := alerts["dev:near/"+alertTypeRegion]
+	if near.Usv != 3.0 || near.Source != "dev:hotter" {
+		t.Errorf("overlapping alert: got %v usv from %s, want 3 from dev:hotter", near.Usv, near.Source)
+	}
+	if _, active := alerts["dev:far/"+alertTypeRegion]; active {
+		t.Errorf("device outside the region has an alert")
+	}
+	if len(alerts) != 3 {
+		t.Errorf("got %d alerts, want 3: %v", len(alerts), alerts)
+	}
+
+	// Expiry
+	alertLock.Lock()
+	alertExpire(time.Now().UTC().Unix() + 601)
+	alertLock.Unlock()
+	if alerts := testAlerts(t); len(alerts) != 0 {
+		t.Errorf("alerts remain after expiring: %v", alerts)
+	}
+}
+
+// Return how many times an alert of a type was logged as raised
+func testAlertsRaised(records []slog.Record, alertType string) (raised int) {
+	for _, r := range records {
+		logged, _ := testLogAttr(r, "type")
+		if r.Message == "alert raised" && logged.String() == alertType {
+			raised++
+		}
+	}
+	return
+}
+
+// A low battery alert is raised when a device's voltage first drops below the
+// threshold, is kept without being raised again while it stays below, and is
+// cleared once the voltage recovers
+func TestLowBatteryAlert(t *testing.T) {
+	testService(t, Config{LowVoltageThreshold: 3.5})
+	records := testCaptureLog(t)
+	key := "dev:1/" + alertTypeLowBattery
+
+	steps := []struct {
+		name    string
+		voltage float64
+		active  bool
+		raised  int
+	}{
+		{"above", 3.9, false, 0},
+		{"crossing below", 3.4, true, 1},
+		{"staying below", 3.3, true, 1},
+		{"still below", 3.2, true, 1},
+		{"recovering", 3.6, false, 1},
+		{"crossing below again", 3.1, true, 2},
+	}
+	since := int64(0)
+	for i, step := range steps {
+		when := int64(1700000000 + 60*i)
+		testPostReading(t, "dev:1", when, 42.1, -71.1, map[string]interface{}{"usv": 0.1, "voltage": step.voltage})
+		alert, active := testAlerts(t)[key]
+		if active != step.active {
+			t.Fatalf("%s: got active %t, want %t", step.name, active, step.active)
+		}
+		if active {
+			if since == 0 {
+				since = when
+			}
+			if alert.Voltage != step.voltage || alert.Since != since {
+				t.Errorf("%s: got voltage %g since %d, want %g since %d", step.name, alert.Voltage, alert.Since, step.voltage, since)
+			}
+		} else {
+			since = 0
+		}
+		if raised := testAlertsRaised(records(), alertTypeLowBattery); raised != step.raised {
+			t.Errorf("%s: raised %d times, want %d", step.name, raised, step.raised)
+		}
+	}
+
+	// A reading without a voltage leaves the alert as it was
+	testPostReading(t, "dev:1", 1700001000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	if _, active := testAlerts(t)[key]; !active {
+		t.Errorf("reading without a voltage cleared the alert")
+	}
+}
+
+// A spike alert is raised by a rise of spike_delta_usv between a device's
+// consecutive readings within the window, but not by a gradual rise, a rise over
+// a longer time, or a device's first reading
+func TestSpikeAlert(t *testing.T) {
+	testService(t, Config{SpikeDeltaUsv: 0.5, SpikeWindowSecs: 600})
+	tests := []struct {
+		deviceUID string
+		readings  []float64
+		interval  int64
+		spike     bool
+		delta     float64
+	}{
+		{"dev:spike", []float64{0.1, 0.1, 0.8}, 60, true, 0.7},
+		{"dev:exact", []float64{0.1, 0.6}, 60, true, 0.5},
+		{"dev:gradual", []float64{0.1, 0.3, 0.5, 0.7, 0.9}, 60, false, 0},
+		{"dev:first", []float64{5.0}, 60, false, 0},
+		{"dev:slow", []float64{0.1, 0.8}, 3600, false, 0},
+		{"dev:falling", []float64{0.8, 0.1}, 60, false, 0},
+	}
+	for i, test := range tests {
+		for j, usv := range test.readings {
+			when := 1700000000 + test.interval*int64(j)
+			testPostReading(t, test.deviceUID, when, 42.1+float64(i), -71.1, map[string]interface{}{"usv": usv})
+		}
+	}
+	alerts := testAlerts(t)
+	for _, test := range tests {
+		alert, active := alerts[test.deviceUID+"/"+alertTypeSpike]
+		if active != test.spike {
+			t.Errorf("%s: got spike %t, want %t", test.deviceUID, active, test.spike)
+			continue
+		}
+		if active && (!testNear(alert.DeltaUsv, test.delta) || alert.Usv != test.readings[len(test.readings)-1]) {
+			t.Errorf("%s: got delta %g usv %g, want %g, %g", test.deviceUID, alert.DeltaUsv, alert.Usv, test.delta, test.readings[len(test.readings)-1])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The Atom and GeoRSS namespaces
+const (
+	atomNamespace   = "http://www.w3.org/2005/Atom"
+	georssNamespace = "http://www.georss.org/georss"
+)
+
+// An Atom feed
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Georss  string      `xml:"xmlns:georss,attr"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    AtomLink    `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+// An Atom link
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+// An Atom entry, located with a GeoRSS point in "lat lon" order
+type AtomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    AtomLink    `xml:"link"`
+	Content AtomContent `xml:"content"`
+	Point   string      `xml:"georss:point"`
+}
+
+// The content of an Atom entry
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// Return a GeoRSS point
+func georssPoint(lat float64, lon float64) string {
+	return strconv.FormatFloat(lat, 'f', -1, 64) + " " + strconv.FormatFloat(lon, 'f', -1, 64)
+}
+
+// Write a region as an Atom feed, whose first entry carries the region's
+// aggregate, located at the query point, followed by an entry per reading in the
+// region, located where it was taken
+func writeRegionAtom(w http.ResponseWriter, lat float64, lon float64, o map[string]interface{}, samples []regionSample, timing *serverTiming) {
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	feedURL := fmt.Sprintf("https://geofeeds.net/radnote/?lat=%f&lon=%f", lat, lon)
+	feed := AtomFeed{Xmlns: atomNamespace, Georss: georssNamespace}
+	feed.Title = fmt.Sprintf("radnote geofeed for %f,%f", lat, lon)
+	feed.ID = feedURL
+	feed.Updated = now
+	feed.Link = AtomLink{Href: feedURL, Rel: "self"}
+
+	aggregate := map[string]interface{}{}
+	for k, v := range o {
+		if k != "events" && k != "devices" {
+			aggregate[k] = v
+		}
+	}
+	aggregateJSON, err := json.Marshal(aggregate)
+	if err != nil {
+		slog.Error("can't marshal atom feed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	regionURL := fmt.Sprintf("https://geofeeds.net/radnote/region?lat=%f&lon=%f", lat, lon)
+	feed.Entries = append(feed.Entries, AtomEntry{
+		Title:   feed.Title,
+		ID:      regionURL,
+		Updated: now,
+		Link:    AtomLink{Href: regionURL},
+		Content: AtomContent{Type: "text", Text: string(aggregateJSON)},
+		Point:   georssPoint(lat, lon),
+	})
+
+	for _, sample := range samples {
+		item := deviceFeedItem(sample.Event, map[string]interface{}{"distance_meters": sample.DistanceMeters})
+		feed.Entries = append(feed.Entries, AtomEntry{
+			Title:   sample.Event.Event.DeviceUID,
+			ID:      fmt.Sprintf("%s&when=%d", item.URL, sample.Event.Event.When),
+			Updated: item.DatePublished.Format(time.RFC3339),
+			Link:    AtomLink{Href: item.URL},
+			Content: AtomContent{Type: "text", Text: item.ContentText},
+			Point:   georssPoint(sample.Event.Event.BestLat, sample.Event.Event.BestLon),
+		})
+	}
+
+	atomXML, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		slog.Error("can't marshal atom feed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	timing.mark("serialize")
+	timing.writeHeader(w)
+
+	w.Header().Set("Content-Type", "application/atom+xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(atomXML)
+
+}
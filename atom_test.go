@@ -0,0 +1,78 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// An Atom feed as a consumer resolves it, by namespace
+type testAtomFeed struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string   `xml:"http://www.w3.org/2005/Atom title"`
+	ID      string   `xml:"http://www.w3.org/2005/Atom id"`
+	Updated string   `xml:"http://www.w3.org/2005/Atom updated"`
+	Entries []struct {
+		Title   string `xml:"http://www.w3.org/2005/Atom title"`
+		ID      string `xml:"http://www.w3.org/2005/Atom id"`
+		Updated string `xml:"http://www.w3.org/2005/Atom updated"`
+		Content string `xml:"http://www.w3.org/2005/Atom content"`
+		Point   string `xml:"http://www.georss.org/georss point"`
+	} `xml:"http://www.w3.org/2005/Atom entry"`
+}
+
+// A region's Atom feed has the elements Atom requires of a feed and its entries,
+// with the aggregate entry at the query point followed by an entry per reading,
+// each with a GeoRSS point where it was taken
+func TestRegionAtom(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:2", 1700000060, 42.101, -71.102, map[string]interface{}{"usv": 0.2})
+	testPostReading(t, "dev:far", 1700000000, 48.8, 2.3, map[string]interface{}{"usv": 0.3})
+
+	w := testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&format=atom")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("Content-Type") != "application/atom+xml" {
+		t.Errorf("Content-Type: got %q", w.Header().Get("Content-Type"))
+	}
+	feed := testAtomFeed{}
+	err := xml.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil {
+		t.Fatalf("response isn't an Atom feed: %s", err)
+	}
+	if feed.Title == "" || feed.ID == "" {
+		t.Errorf("feed lacks a title or id: %+v", feed)
+	}
+	if _, err := time.Parse(time.RFC3339, feed.Updated); err != nil {
+		t.Errorf("feed updated %q isn't RFC3339", feed.Updated)
+	}
+	if len(feed.Entries) != 3 {
+		t.Fatalf("got %d entries, want the aggregate and 2 readings", len(feed.Entries))
+	}
+
+	ids := map[string]bool{}
+	points := map[string]string{}
+	for _, entry := range feed.Entries {
+		if entry.Title == "" || entry.ID == "" || ids[entry.ID] {
+			t.Errorf("entry lacks a title or unique id: %+v", entry)
+		}
+		ids[entry.ID] = true
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry updated %q isn't RFC3339", entry.Updated)
+		}
+		points[entry.Title] = entry.Point
+	}
+	if feed.Entries[0].Point != "42.1 -71.1" {
+		t.Errorf("aggregate entry: got point %q, want the query point", feed.Entries[0].Point)
+	}
+	if points["dev:1"] != "42.1 -71.1" || points["dev:2"] != "42.101 -71.102" {
+		t.Errorf("reading entries: got points %v", points)
+	}
+}
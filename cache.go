@@ -0,0 +1,191 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default number of decimal places to which query coordinates are rounded
+// when forming cache keys, which is roughly a meter at the equator
+const queryCacheDefaultPrecision = 5
+
+// The maximum number of cached responses, beyond which the cache is emptied
+const queryCacheMaxEntries = 1000
+
+// A cached region query response
+type cachedResponse struct {
+	body        []byte
+	contentType string
+	generation  int64
+	expires     time.Time
+}
+
+// Cached region query responses, keyed by queryCacheKey
+var queryCacheLock sync.Mutex
+var queryCache = map[string]cachedResponse{}
+
+// Incremented whenever stored data changes, invalidating all cached responses
+var radGeneration atomic.Int64
+
+// Whether region query results are cached
+func queryCacheEnabled() bool {
+	return config().QueryCacheSecs > 0
+}
+
+// The number of decimal places to which query coordinates are rounded
+func queryCachePrecision() int {
+	if config().QueryCacheKeyPrecision == nil {
+		return queryCacheDefaultPrecision
+	}
+	return *config().QueryCacheKeyPrecision
+}
+
+// Round a coordinate to the cache key precision, so that queries differing only
+// in insignificant decimal places share the same cache entry
+func roundCoordinate(v float64) float64 {
+	scale := math.Pow(10, float64(queryCachePrecision()))
+	return math.Round(v*scale) / scale
+}
+
+// Return the cache key for a tenant's region query, in which its coordinates are
+// rounded.  Other query parameters are included verbatim, in sorted order,
+// along with the status with which the request is to be answered if the region
+// is empty, since that may be chosen by a request header.
+func queryCacheKey(tenant string, path string, query url.Values, lat float64, lon float64, emptyStatus int) string {
+	key := url.Values{}
+	for k, v := range query {
+		key[k] = v
+	}
+	precision := queryCachePrecision()
+	key.Set("lat", strconv.FormatFloat(roundCoordinate(lat), 'f', precision, 64))
+	key.Set("lon", strconv.FormatFloat(roundCoordinate(lon), 'f', precision, 64))
+	return tenant + path + "?" + key.Encode() + "|" + strconv.Itoa(emptyStatus)
+}
+
+// Write a cached response if there is a current one for the key
+func queryCacheServe(w http.ResponseWriter, key string) bool {
+	queryCacheLock.Lock()
+	entry, exists := queryCache[key]
+	queryCacheLock.Unlock()
+	if !exists || entry.generation != radGeneration.Load() || time.Now().After(entry.expires) {
+		return false
+	}
+	if entry.contentType != "" {
+		w.Header().Set("Content-Type", entry.contentType)
+	}
+	_, _ = w.Write(entry.body)
+	return true
+}
+
+// A response writer that retains a copy of a successful response for the cache
+type queryCacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// Record the status of the response
+func (rec *queryCacheRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Record the body of the response
+func (rec *queryCacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Generate a response through the cache, storing it if it was successful
+func queryCacheGenerate(w http.ResponseWriter, key string, generate func(w http.ResponseWriter)) {
+	generation := radGeneration.Load()
+	rec := &queryCacheRecorder{ResponseWriter: w}
+	generate(rec)
+	if rec.status != http.StatusOK {
+		return
+	}
+	entry := cachedResponse{
+		body:        rec.body.Bytes(),
+		contentType: w.Header().Get("Content-Type"),
+		generation:  generation,
+		expires:     time.Now().Add(time.Duration(config().QueryCacheSecs) * time.Second),
+	}
+	queryCacheLock.Lock()
+	if len(queryCache) >= queryCacheMaxEntries {
+		queryCache = map[string]cachedResponse{}
+	}
+	queryCache[key] = entry
+	queryCacheLock.Unlock()
+}
+
+// The entity tag of a full event list response, and the data generation for
+// which it was computed
+type listingETag struct {
+	etag       string
+	generation int64
+}
+
+// Entity tags of full event list responses, keyed by tenant and query, which are
+// valid only while the data generation is unchanged
+var listingETagLock sync.Mutex
+var listingETags = map[string]listingETag{}
+
+// Return the key identifying a full event list response
+func listingETagKey(tenant string, query string) string {
+	return tenant + "?" + query
+}
+
+// Return the entity tag of a full event list response if it is known for the
+// current data generation
+func listingETagCurrent(key string) (etag string, known bool) {
+	listingETagLock.Lock()
+	defer listingETagLock.Unlock()
+	entry, exists := listingETags[key]
+	if !exists || entry.generation != radGeneration.Load() {
+		return "", false
+	}
+	return entry.etag, true
+}
+
+// Compute and remember the entity tag of a full event list response serialized at
+// the specified data generation.  The tag is weak, because the response may be
+// served with different content encodings.
+func listingETagStore(key string, generation int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+	listingETagLock.Lock()
+	if len(listingETags) >= queryCacheMaxEntries {
+		listingETags = map[string]listingETag{}
+	}
+	listingETags[key] = listingETag{etag: etag, generation: generation}
+	listingETagLock.Unlock()
+	return etag
+}
+
+// Determine whether a request's If-None-Match header matches an entity tag, using
+// the weak comparison that applies to conditional GETs
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
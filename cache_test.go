@@ -0,0 +1,141 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// A client asking for empty regions to be reported without content must get a
+// 204 even when another client's 200 for the same query has been cached
+func TestQueryCacheEmptyRegionStatus(t *testing.T) {
+	testService(t, Config{QueryCacheSecs: 60})
+
+	target := "/radiation?lat=42.1&lon=-71.1&radius_meters=1000"
+	w := testGet(target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("empty region: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set(emptyRegionStatusHeader, "204")
+	w = testServe(r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("empty region with %s: 204: got %d, want %d", emptyRegionStatusHeader, w.Code, http.StatusNoContent)
+	}
+
+	w = testGet(target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("empty region again: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// A key precision of 0 rounds query coordinates to whole degrees, rather than
+// being taken as unset
+func TestQueryCacheWholeDegreePrecision(t *testing.T) {
+	c := Config{}
+	err := json.Unmarshal([]byte(`{"query_cache_secs":60,"query_cache_key_precision":0}`), &c)
+	if err == nil {
+		err = configValidate(c)
+	}
+	if err != nil {
+		t.Fatalf("can't configure whole-degree precision: %s", err)
+	}
+	testService(t, c)
+
+	query := url.Values{"radius_meters": {"1000"}}
+	a := queryCacheKey("", "/radiation", query, 42.1, -71.4, http.StatusOK)
+	b := queryCacheKey("", "/radiation", query, 41.9, -70.6, http.StatusOK)
+	if a != b {
+		t.Errorf("keys of coordinates rounding to the same whole degrees differ: %s and %s", a, b)
+	}
+	other := queryCacheKey("", "/radiation", query, 42.6, -71.4, http.StatusOK)
+	if a == other {
+		t.Errorf("keys of coordinates rounding to different whole degrees are the same: %s", a)
+	}
+}
+
+// When caching, a query is answered for its coordinates rounded to the key
+// precision, on a miss and on a hit alike, so that a cached response is correct
+// for every query sharing it
+func TestQueryCacheAnswersRoundedQuery(t *testing.T) {
+	precision := 2
+	testService(t, Config{QueryCacheSecs: 60, QueryCacheKeyPrecision: &precision})
+
+	// A device 50m from the rounded point, and 500m or so from the queries
+	testPostReading(t, "dev:1", 1700000000, 42.00045, -71.0, map[string]interface{}{"usv": 0.1})
+
+	miss := testGet("/radiation?lat=42.001&lon=-71.001&radius_meters=100")
+	hit := testGet("/radiation?lat=42.004&lon=-71.004&radius_meters=100")
+	for name, w := range map[string]*httptest.ResponseRecorder{"miss": miss, "hit": hit} {
+		content := testFeedContent(t, w)
+		if content["lat"] != 42.0 || content["lon"] != -71.0 || content["count"] != float64(1) {
+			t.Errorf("%s: got lat %v lon %v count %v, want 42, -71, 1", name, content["lat"], content["lon"], content["count"])
+		}
+	}
+	if !bytes.Equal(miss.Body.Bytes(), hit.Body.Bytes()) {
+		t.Errorf("hit wasn't answered from the cache")
+	}
+
+	// Without caching, a query is answered for its own coordinates
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.00045, -71.0, map[string]interface{}{"usv": 0.1})
+	content := testFeedContent(t, testGet("/radiation?lat=42.001&lon=-71.001&radius_meters=100"))
+	if content["lat"] != 42.001 || content["count"] != float64(0) {
+		t.Errorf("uncached: got lat %v count %v, want 42.001 and 0", content["lat"], content["count"])
+	}
+}
+
+// GET the full list, conditionally on its entity tag if one is specified
+func testGetListing(etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/radiation", nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	return testServe(r)
+}
+
+// The full list is served with an entity tag, answered with a 304 while it is
+// unchanged, and served afresh with a new tag once a reading changes it
+func TestListingETag(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+
+	w := testGetListing("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q, want 200 with a tag", w.Code, etag)
+	}
+	for i := 0; i < 2; i++ {
+		w = testGetListing(etag)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("unchanged: got %d with %d bytes and ETag %q, want 304", w.Code, w.Body.Len(), w.Header().Get("ETag"))
+		}
+	}
+	w = testGetListing(`"something-else"`)
+	if w.Code != http.StatusOK {
+		t.Errorf("other tag: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	testPostReading(t, "dev:2", 1700000000, 42.2, -71.2, map[string]interface{}{"usv": 0.2})
+	w = testGetListing(etag)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "dev:2") {
+		t.Fatalf("changed: got %d, want 200 with the new reading", w.Code)
+	}
+	changed := w.Header().Get("ETag")
+	if changed == "" || changed == etag {
+		t.Errorf("changed: got ETag %q, want a new tag", changed)
+	}
+	w = testGetListing(changed)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("unchanged again: got %d, want %d", w.Code, http.StatusNotModified)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Responses shorter than this aren't compressed, since the gzip framing would
+// outweigh any saving
+const gzipMinBytes = 1024
+
+// A response writer that buffers the start of a response until it knows whether
+// the response is long enough to be worth compressing, and then either compresses
+// it or passes it through unchanged
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	buffered    []byte
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+// Record the status, which is written once it is known whether to compress
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+// Buffer the response until it is long enough to compress
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	if g.passthrough {
+		return g.ResponseWriter.Write(b)
+	}
+	g.buffered = append(g.buffered, b...)
+	if len(g.buffered) >= gzipMinBytes {
+		err := g.start(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Write the status and whatever has been buffered, compressing the rest of the
+// response if requested and if it isn't already encoded or a stream of events
+func (g *gzipResponseWriter) start(compress bool) error {
+	header := g.ResponseWriter.Header()
+	if header.Get("Content-Encoding") != "" || strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		compress = false
+	}
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	buffered := g.buffered
+	g.buffered = nil
+	if !compress {
+		g.passthrough = true
+		g.ResponseWriter.WriteHeader(g.status)
+		if len(buffered) == 0 {
+			return nil
+		}
+		_, err := g.ResponseWriter.Write(buffered)
+		return err
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(buffered)
+	return err
+}
+
+// Flush whatever has been written so far, which, if the response is still being
+// buffered, means writing it uncompressed
+func (g *gzipResponseWriter) Flush() {
+	if g.gz == nil && !g.passthrough {
+		_ = g.start(false)
+	}
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	flusher, ok := g.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// Complete the response
+func (g *gzipResponseWriter) finish() {
+	if g.gz != nil {
+		_ = g.gz.Close()
+		return
+	}
+	if !g.passthrough {
+		_ = g.start(false)
+	}
+}
+
+// Return the underlying response writer, for http.ResponseController
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Wrap a handler so that responses are gzip-compressed for clients that accept it,
+// unless they are too short to benefit
+func gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g := &gzipResponseWriter{ResponseWriter: w}
+		defer g.finish()
+		next.ServeHTTP(g, r)
+	})
+}
+
+// Determine whether a request accepts a gzip-encoded response
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Serve a GET through the compression middleware with the specified
+// Accept-Encoding
+func testGetEncoded(target string, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	gzipHandler(newRouter()).ServeHTTP(w, r)
+	return w
+}
+
+// A long response is compressed for a client that accepts gzip, and decompresses
+// to the JSON served uncompressed, while a short one, or one for a client that
+// refuses gzip, isn't compressed
+func TestGzipResponses(t *testing.T) {
+	testService(t, Config{})
+	for i := 0; i < 50; i++ {
+		testPostReading(t, fmt.Sprintf("dev:%d", i), 1700000000+int64(i), 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	}
+
+	plain := testGetEncoded("/radnote/devices", "")
+	if plain.Header().Get("Content-Encoding") != "" || len(plain.Body.Bytes()) < gzipMinBytes {
+		t.Fatalf("uncompressed listing: got encoding %q and %d bytes", plain.Header().Get("Content-Encoding"), len(plain.Body.Bytes()))
+	}
+
+	w := testGetEncoded("/radnote/devices", "deflate, gzip;q=0.8")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d with encoding %q, want gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.Len() >= plain.Body.Len() {
+		t.Errorf("compressed to %d bytes from %d", w.Body.Len(), plain.Body.Len())
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("response isn't gzip: %s", err)
+	}
+	decompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("response doesn't decompress: %s", err)
+	}
+	inventory := deviceInventory{}
+	err = json.Unmarshal(decompressed, &inventory)
+	if err != nil || len(inventory.Devices) != 50 {
+		t.Fatalf("decompressed response isn't the listing of 50 devices: %s", err)
+	}
+	if !bytes.Equal(decompressed, plain.Body.Bytes()) {
+		t.Errorf("decompressed response differs from the uncompressed one")
+	}
+
+	for _, test := range []struct{ target, acceptEncoding string }{{"/ping", "gzip"}, {"/radnote/devices", "gzip;q=0"}} {
+		w := testGetEncoded(test.target, test.acceptEncoding)
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s with %s: compressed", test.target, test.acceptEncoding)
+		}
+	}
+}
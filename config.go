@@ -3,32 +3,647 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Config file
 type Config struct {
+	// The directory holding the data files, and the address on which to listen.
+	// These default to the original /home/ubuntu/data/ and :80, and may be
+	// overridden by the GEOFEEDS_DATA_DIR and GEOFEEDS_LISTEN environment
+	// variables.  The config file itself is read from GEOFEEDS_DATA_DIR if set, or
+	// else from the default data directory.
+	DataDir    string `json:"data_dir,omitempty"`
+	ListenAddr string `json:"listen_addr,omitempty"`
+
+	// Periodically write and remove a sentinel file in the data directory so that
+	// /ready detects a read-only filesystem before a real write fails
+	DiskProbeEnabled      bool `json:"disk_probe_enabled,omitempty"`
+	DiskProbeIntervalSecs int  `json:"disk_probe_interval_secs,omitempty"`
+
+	// The health check reports that ingestion is stale if no reading has been
+	// stored within this many seconds, which defaults to an hour
+	HealthStaleSecs int `json:"health_stale_secs,omitempty"`
+
+	// By default, while data can't be persisted, queries continue to serve the
+	// in-memory data with a staleness warning.  When set they fail with a 503.
+	StaleReadsDisabled bool `json:"stale_reads_disabled,omitempty"`
+
+	// The maximum random delay before the initial data load, which spreads out
+	// the I/O when many instances sharing storage restart together
+	StartupJitterMs int `json:"startup_jitter_ms,omitempty"`
+
+	// When set, readings only mark the data as needing to be written, and it is
+	// written at most once per this many milliseconds by a background flusher.
+	// This takes precedence over write_coalesce_ms.
+	PersistIntervalMs int `json:"persist_interval_ms,omitempty"`
+
+	// Readings from a device arriving within this many milliseconds of a write
+	// for that device are buffered and written together.  0 writes every reading.
+	WriteCoalesceMs int `json:"write_coalesce_ms,omitempty"`
+
+	// The maximum number of stored readings that may be awaiting a durable write,
+	// per tenant, beyond which ingestion is refused with a 503 and a Retry-After
+	// of write_queue_retry_after_secs (default 5) so that upstream backs off.  0 is
+	// unbounded.
+	WriteQueueMax            int `json:"write_queue_max,omitempty"`
+	WriteQueueRetryAfterSecs int `json:"write_queue_retry_after_secs,omitempty"`
+
+	// The number of past readings retained per device, which are served by
+	// /radnote/history and used for sparklines and peaks (default 100)
+	HistoryMaxPerDevice int `json:"history_max_per_device,omitempty"`
+
+	// Devices whose latest reading is older than this many days are forgotten,
+	// along with their history, by a sweep made every retention_sweep_mins
+	// (default 60).  When unset (0) devices are retained forever.
+	RetentionDays      int `json:"retention_days,omitempty"`
+	RetentionSweepMins int `json:"retention_sweep_mins,omitempty"`
+
+	// A public directory into which static JSON and GeoJSON snapshots of the
+	// dataset are written by the "snapshot" console command and, if an interval
+	// is configured, periodically
+	SnapshotDirectory    string `json:"snapshot_directory,omitempty"`
+	SnapshotIntervalSecs int    `json:"snapshot_interval_secs,omitempty"`
+
+	// HTTP server timeouts, in seconds.  When unset (0) the defaults below are
+	// used rather than Go's defaults, which impose no timeouts at all.
+	ReadTimeoutSecs       int `json:"read_timeout,omitempty"`
+	ReadHeaderTimeoutSecs int `json:"read_header_timeout,omitempty"`
+	WriteTimeoutSecs      int `json:"write_timeout,omitempty"`
+	IdleTimeoutSecs       int `json:"idle_timeout,omitempty"`
+
+	// The largest request body accepted when readings are POSTed, in bytes, or
+	// defaultMaxBodyBytes when unset
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+
+	// Serve HTTP/2, including h2c over plaintext, in addition to HTTP/1.1
+	HTTP2Enabled bool `json:"http2_enabled,omitempty"`
+
+	// Region queries whose radius is at or above this many meters use a cheaper
+	// bounding-box inclusion test rather than precise distances.  0 disables.
+	LargeRadiusMeters float64 `json:"large_radius_meters,omitempty"`
+
+	// Ascending uSv bucket edges for histogram=true region queries.  When unset,
+	// or when another metric is queried, edges are computed to span the values.
+	HistogramEdgesUsv []float64 `json:"histogram_edges_usv,omitempty"`
+
+	// The maximum number of items in a JSON feed, including the region's aggregate
+	// item, beyond which the feed is paginated using next_url.  0 is unlimited.
+	FeedMaxItems int `json:"feed_max_items,omitempty"`
+
+	// The status of region query responses when the region has no sensors: 200
+	// (the default) returns a feed with a count of 0, while 204 returns no content.
+	// Clients may override this per request with an X-Empty-Region-Status header.
+	EmptyRegionStatus int `json:"empty_region_status,omitempty"`
+
+	// Region query results are cached for this many seconds, or until new data
+	// arrives.  0 disables caching.  When caching, query coordinates are rounded
+	// to the key precision, in decimal places (default 5, or 0 for whole
+	// degrees), so that queries that differ only in insignificant decimals share
+	// the same entry.  Each query is answered for its rounded coordinates, so
+	// that a cached response is correct for every query sharing it.
+	QueryCacheSecs         int  `json:"query_cache_secs,omitempty"`
+	QueryCacheKeyPrecision *int `json:"query_cache_key_precision,omitempty"`
+
+	// The unit in which events' When is sent, which is detected from its
+	// magnitude unless set to seconds or milliseconds
+	WhenUnit string `json:"when_unit,omitempty"`
+
+	// Events whose When is more than this many seconds before receipt are either
+	// rejected or clamped to the receipt time, per the policy.  0 disables.
+	MaxPastAgeSecs int    `json:"max_past_age_seconds,omitempty"`
+	PastAgePolicy  string `json:"past_age_policy,omitempty"`
+
+	// How long, in seconds, a reading is remembered so that a second POST of the
+	// same reading (same event UID or, lacking one, same device, When, and body)
+	// is acknowledged but ignored.  0 uses the default of 10 minutes, and a
+	// negative value disables this.
+	DedupTTLSecs int `json:"dedup_ttl_secs,omitempty"`
+
+	// Old device UIDs mapped to the canonical UID of the same device, so that a
+	// device with entries under both is only counted once in region queries
+	DeviceAliases map[string]string `json:"device_aliases,omitempty"`
+
+	// The metric aggregated by region queries, and summarized, when none is
+	// specified.  This is "usv" by default, but may be "cpm" for regulatory
+	// contexts in which measured CPM must be reported rather than a derived dose,
+	// in which case uSv remains available with metric=usv.
+	PrimaryMetric string `json:"primary_metric,omitempty"`
+
+	// The inverse-distance weighting exponent used by estimate=idw queries that
+	// don't specify one, between 0.1 and 10, which defaults to 2
+	IdwPower float64 `json:"idw_power,omitempty"`
+
+	// Factors converting CPM to uSv/h, keyed by the sensor reported in the body,
+	// which are used to derive the uSv reading of a body reporting only CPM.
+	// Sensors without a factor use sensor_default_factor, which defaults to that
+	// of the LND 7317 tube.
+	SensorFactors       map[string]float64 `json:"sensor_factors,omitempty"`
+	SensorDefaultFactor float64            `json:"sensor_default_factor,omitempty"`
+
+	// Readings whose body is missing, or has no numeric fields, are acknowledged but
+	// not stored unless the policy is "store", which stores them as a reading of
+	// zero as was always done before.  Readings whose body has other numeric fields
+	// but no uSv or CPM measurement are always stored, without a uSv reading, so
+	// that their other metrics are kept.
+	EmptyBodyPolicy string `json:"empty_body_policy,omitempty"`
+
+	// Devices' registered locations, keyed by device UID.  When location_check_meters
+	// is set, a reading located farther than that from its device's registered
+	// location, such as from a bad GPS fix, is rejected or, under the "flag" policy,
+	// stored but marked as suspect.  Devices without a registered location, and
+	// readings without a location, aren't checked.
+	RegisteredLocations map[string]RegisteredLocation `json:"registered_locations,omitempty"`
+	LocationCheckMeters float64                       `json:"location_check_meters,omitempty"`
+	LocationCheckPolicy string                        `json:"location_check_policy,omitempty"`
+
+	// How region queries treat readings whose location is less certain than the
+	// query's radius: "include" them (the default), "exclude" them, or "weight"
+	// them in the average by the radius as a fraction of their uncertainty.  The
+	// uncertainty, in meters, is estimated from each reading's best_location_type,
+	// with location_accuracy_meters overriding the defaults for gps, triangulated,
+	// and tower locations.  Queries may override the policy with accuracy=.
+	LocationAccuracyPolicy string             `json:"location_accuracy_policy,omitempty"`
+	LocationAccuracyMeters map[string]float64 `json:"location_accuracy_meters,omitempty"`
+
+	// The radius of the sphere on which distances are computed, which is mean,
+	// equatorial, or authalic, and mean by default
+	EarthRadius string `json:"earth_radius,omitempty"`
+
+	// A device's level alert is raised when it reports at least alert_on_usv, and
+	// cleared only once it reports less than alert_off_usv, which must be lower so
+	// that readings hovering at the threshold don't cause the alert to flap.  0
+	// disables level alerts.
+	AlertOnUsv  float64 `json:"alert_on_usv,omitempty"`
+	AlertOffUsv float64 `json:"alert_off_usv,omitempty"`
+
+	// A device's low battery alert is raised when it reports a voltage below this,
+	// and cleared once it reports a voltage at or above it.  0 disables low
+	// battery alerts.
+	LowVoltageThreshold float64 `json:"low_voltage_threshold,omitempty"`
+
+	// A device's spike alert is raised when its uSv reading rises by at least
+	// spike_delta_usv over its previous reading, taken no more than
+	// spike_window_secs (default 3600) earlier, and expires after that window.  0
+	// disables spike alerts.
+	SpikeDeltaUsv   float64 `json:"spike_delta_usv,omitempty"`
+	SpikeWindowSecs int     `json:"spike_window_secs,omitempty"`
+
+	// The number of requests per minute allowed from each client IP, separately
+	// for POSTs to /radnote and for queries, beyond which requests are refused
+	// with a 429.  Clients may burst up to a minute's allowance at once.  0
+	// disables limiting.
+	RateLimitPerMinute       int `json:"rate_limit_per_minute,omitempty"`
+	IngestRateLimitPerMinute int `json:"ingest_rate_limit_per_minute,omitempty"`
+
+	// Origins from which browsers may fetch feeds, such as
+	// "https://map.example.com", or "*" for any origin.  CORS is disabled if none
+	// are configured.
+	CORSOrigins []string `json:"cors_origins,omitempty"`
+
+	// A reading of at least radnote_alert_level_usv raises a region alert for its
+	// device and every device within radnote_alert_region_meters of it, which
+	// lasts radnote_alert_mins (default 60).  The sample and sync intervals that
+	// devices should use while alerting are published with the alerts.  A level
+	// of 0 disables region alerts.
+	RadnoteAlertLevelUsv     float64 `json:"radnote_alert_level_usv,omitempty"`
+	RadnoteAlertRegionMeters float64 `json:"radnote_alert_region_meters,omitempty"`
+	RadnoteAlertMins         int     `json:"radnote_alert_mins,omitempty"`
+	RadnoteAlertSampleMins   int     `json:"radnote_alert_sample_mins,omitempty"`
+	RadnoteAlertSyncMins     int     `json:"radnote_alert_sync_mins,omitempty"`
+
+	// The level of messages logged, which is debug, info, warn, or error, and
+	// info by default
+	LogLevel string `json:"log_level,omitempty"`
+
+	// Account keys mapped to the name of the tenant they belong to.  When any are
+	// configured, every request must carry a key, and each tenant's devices are
+	// stored, persisted, and queried separately.  When none are, all requests
+	// share a single default tenant.
+	AccountKeys map[string]string `json:"account_keys,omitempty"`
+
+	// The key that must accompany readings POSTed to /radnote, in an X-API-Key
+	// header or as a bearer token, while queries remain public.  Ingestion is open
+	// if it isn't set.  When account keys are also configured, ingesting clients
+	// must identify their tenant with the X-Account-Key header.
+	IngestAPIKey string `json:"ingest_api_key,omitempty"`
+
+	// Features that may be enabled or disabled per deployment, keyed by the names
+	// below.  Features are enabled unless explicitly set to false, except for the
+	// few that are disabled by default and must be explicitly set to true.
+	Features map[string]bool `json:"features,omitempty"`
 }
 
-var config Config
+// A device's registered location
+type RegisteredLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Feature names, each of which controls whether an endpoint or query mode is exposed
+const (
+	featureIngest    = "ingest"
+	featureRadiation = "radiation"
+	featureSummary   = "summary"
+	featureReady     = "ready"
+	featurePeak      = "peak"
+	featureSparkline = "sparkline"
+	featureDistance  = "distance"
+	featureAlerts    = "alerts"
+	featureHistory   = "history"
+	featureDevices   = "devices"
+	featureStream    = "stream"
+)
+
+// All known feature names
+var featureNames = []string{featureIngest, featureRadiation, featureSummary, featureReady, featurePeak, featureSparkline, featureDistance, featureAlerts, featureHistory, featureDevices, featureStream}
+
+// Features that are disabled unless explicitly enabled
+var featuresDisabledByDefault = map[string]bool{featureDistance: true}
+
+// Units in which events' When may be sent
+const (
+	whenUnitAuto         = "auto"
+	whenUnitSeconds      = "seconds"
+	whenUnitMilliseconds = "milliseconds"
+)
+
+// Policies for events whose timestamps are older than max_past_age_seconds
+const (
+	pastAgePolicyReject = "reject"
+	pastAgePolicyClamp  = "clamp"
+)
+
+// Policies for readings whose body is missing or empty
+const (
+	emptyBodyPolicySkip  = "skip"
+	emptyBodyPolicyStore = "store"
+)
+
+// Policies for readings located too far from their device's registered location
+const (
+	locationCheckPolicyReject = "reject"
+	locationCheckPolicyFlag   = "flag"
+)
+
+// Default HTTP server timeouts, in seconds
+const (
+	defaultReadTimeoutSecs       = 30
+	defaultReadHeaderTimeoutSecs = 10
+	defaultWriteTimeoutSecs      = 60
+	defaultIdleTimeoutSecs       = 120
+)
+
+// Default largest POSTed request body, which leaves ample room for batches
+const defaultMaxBodyBytes = 10 * 1024 * 1024
+
+// The current config, which is replaced as a whole when reloaded so that it is
+// never seen partially updated
+var configCurrent atomic.Pointer[Config]
+
+// Return the current config
+func config() *Config {
+	c := configCurrent.Load()
+	if c == nil {
+		return &Config{}
+	}
+	return c
+}
 
 // Fully-resolved data directory
 var configDataDirectory = "/home/ubuntu" + "/data/"
 
+// Fully-resolved listen address
+var configListenAddr = ":80"
+
+// Environment variables overriding the data directory and listen address
+const (
+	envDataDir    = "GEOFEEDS_DATA_DIR"
+	envListenAddr = "GEOFEEDS_LISTEN"
+)
+
+// Return a directory path with a trailing separator, as configDataDirectory is
+// used as a prefix of file paths
+func withTrailingSlash(dir string) string {
+	if strings.HasSuffix(dir, "/") {
+		return dir
+	}
+	return dir + "/"
+}
+
 // Load the config
 func configLoad() {
 
-	configPath := configDataDirectory + "config.json"
-	contents, err := os.ReadFile(configPath)
+	envDir := os.Getenv(envDataDir)
+	if envDir != "" {
+		configDataDirectory = withTrailingSlash(envDir)
+	}
+
+	c, err := configRead()
 	if err != nil {
-		fmt.Printf("config: can't load from %s: %s\n", configPath, err)
+		slog.Error("can't load config", "path", configPath(), "error", err)
 		os.Exit(-1)
 	}
+	configCurrent.Store(c)
+
+	// Resolve the data directory and listen address, with the environment taking
+	// precedence over the config
+	if envDir == "" && config().DataDir != "" {
+		configDataDirectory = withTrailingSlash(config().DataDir)
+	}
+	if config().ListenAddr != "" {
+		configListenAddr = config().ListenAddr
+	}
+	envListen := os.Getenv(envListenAddr)
+	if envListen != "" {
+		configListenAddr = envListen
+	}
 
-	err = json.Unmarshal(contents, &config)
+}
+
+// Return the path of the config file
+func configPath() string {
+	return configDataDirectory + "config.json"
+}
+
+// Read and validate the config file
+func configRead() (c *Config, err error) {
+	contents, err := os.ReadFile(configPath())
 	if err != nil {
-		fmt.Printf("config: can't parse JSON: %s\n%s\n", err, contents)
-		os.Exit(-1)
+		return nil, err
+	}
+	c = &Config{}
+	err = json.Unmarshal(contents, c)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse JSON: %s", err)
+	}
+	err = configValidate(*c)
+	if err != nil {
+		return nil, err
 	}
+	return c, nil
+}
+
+// Re-read the config file, replacing the current config only if the new one is
+// valid.  The data directory, listen address, server settings, and which
+// background tasks run and how often are only resolved at startup, so changes to
+// those take effect after a restart.
+func configReload() (changed []string, err error) {
+	c, err := configRead()
+	if err != nil {
+		return nil, err
+	}
+	previous := configCurrent.Swap(c)
+	if previous != nil {
+		changed = configChanges(*previous, *c)
+	}
+	logConfigure()
+
+	// Aliases, sensor factors, and the like all affect the results of queries
+	radGeneration.Add(1)
+
+	return changed, nil
+}
 
+// Return the JSON names of the fields that differ between two configs
+func configChanges(previous Config, current Config) (changed []string) {
+	t := reflect.TypeOf(current)
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(reflect.ValueOf(previous).Field(i).Interface(), reflect.ValueOf(current).Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		changed = append(changed, name)
+	}
+	return
+}
+
+// Validate a loaded config
+func configValidate(c Config) error {
+
+	timeouts := map[string]int{
+		"read_timeout":        c.ReadTimeoutSecs,
+		"read_header_timeout": c.ReadHeaderTimeoutSecs,
+		"write_timeout":       c.WriteTimeoutSecs,
+		"idle_timeout":        c.IdleTimeoutSecs,
+	}
+	for name, secs := range timeouts {
+		if secs < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
+	if c.StartupJitterMs < 0 {
+		return fmt.Errorf("startup_jitter_ms must not be negative")
+	}
+
+	if c.PersistIntervalMs < 0 {
+		return fmt.Errorf("persist_interval_ms must not be negative")
+	}
+
+	if c.WriteCoalesceMs < 0 {
+		return fmt.Errorf("write_coalesce_ms must not be negative")
+	}
+
+	if c.WriteQueueMax < 0 {
+		return fmt.Errorf("write_queue_max must not be negative")
+	}
+	if c.WriteQueueRetryAfterSecs < 0 {
+		return fmt.Errorf("write_queue_retry_after_secs must not be negative")
+	}
+
+	if c.HistoryMaxPerDevice < 0 {
+		return fmt.Errorf("history_max_per_device must not be negative")
+	}
+
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+
+	if c.RetentionSweepMins < 0 {
+		return fmt.Errorf("retention_sweep_mins must not be negative")
+	}
+
+	if c.SnapshotIntervalSecs < 0 {
+		return fmt.Errorf("snapshot_interval_secs must not be negative")
+	}
+
+	switch c.WhenUnit {
+	case "", whenUnitAuto, whenUnitSeconds, whenUnitMilliseconds:
+	default:
+		return fmt.Errorf("when_unit must be %s, %s, or %s", whenUnitAuto, whenUnitSeconds, whenUnitMilliseconds)
+	}
+
+	if c.MaxPastAgeSecs < 0 {
+		return fmt.Errorf("max_past_age_seconds must not be negative")
+	}
+	switch c.PastAgePolicy {
+	case "", pastAgePolicyReject, pastAgePolicyClamp:
+	default:
+		return fmt.Errorf("past_age_policy must be %s or %s", pastAgePolicyReject, pastAgePolicyClamp)
+	}
+
+	switch c.PrimaryMetric {
+	case "", defaultMetric, cpmMetric:
+	default:
+		return fmt.Errorf("primary_metric must be %s or %s", defaultMetric, cpmMetric)
+	}
+
+	for sensor, factor := range c.SensorFactors {
+		if factor <= 0 {
+			return fmt.Errorf("sensor_factors %s must be positive", sensor)
+		}
+	}
+	if c.IdwPower != 0 && (c.IdwPower < idwMinPower || c.IdwPower > idwMaxPower) {
+		return fmt.Errorf("idw_power must be between %g and %g", idwMinPower, idwMaxPower)
+	}
+
+	if c.SensorDefaultFactor < 0 {
+		return fmt.Errorf("sensor_default_factor must not be negative")
+	}
+
+	switch c.EmptyBodyPolicy {
+	case "", emptyBodyPolicySkip, emptyBodyPolicyStore:
+	default:
+		return fmt.Errorf("empty_body_policy must be %s or %s", emptyBodyPolicySkip, emptyBodyPolicyStore)
+	}
+
+	if c.RateLimitPerMinute < 0 || c.IngestRateLimitPerMinute < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+
+	if _, known := logLevels[c.LogLevel]; c.LogLevel != "" && !known {
+		return fmt.Errorf("log_level must be debug, info, warn, or error")
+	}
+
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+
+	if c.HealthStaleSecs < 0 {
+		return fmt.Errorf("health_stale_secs must not be negative")
+	}
+
+	if c.LocationCheckMeters < 0 {
+		return fmt.Errorf("location_check_meters must not be negative")
+	}
+	switch c.LocationCheckPolicy {
+	case "", locationCheckPolicyReject, locationCheckPolicyFlag:
+	default:
+		return fmt.Errorf("location_check_policy must be %s or %s", locationCheckPolicyReject, locationCheckPolicyFlag)
+	}
+
+	if _, known := earthRadii[c.EarthRadius]; c.EarthRadius != "" && !known {
+		return fmt.Errorf("earth_radius must be %s, %s, or %s", earthRadiusMean, earthRadiusEquatorial, earthRadiusAuthalic)
+	}
+
+	switch c.LocationAccuracyPolicy {
+	case "", locationAccuracyInclude, locationAccuracyExclude, locationAccuracyWeight:
+	default:
+		return fmt.Errorf("location_accuracy_policy must be %s, %s, or %s", locationAccuracyInclude, locationAccuracyExclude, locationAccuracyWeight)
+	}
+	for locationType, meters := range c.LocationAccuracyMeters {
+		if meters <= 0 {
+			return fmt.Errorf("location_accuracy_meters for %s must be positive", locationType)
+		}
+	}
+
+	if c.AlertOnUsv < 0 {
+		return fmt.Errorf("alert_on_usv must not be negative")
+	}
+	if c.AlertOnUsv > 0 && (c.AlertOffUsv <= 0 || c.AlertOffUsv >= c.AlertOnUsv) {
+		return fmt.Errorf("alert_off_usv must be greater than 0 and less than alert_on_usv")
+	}
+
+	if c.LowVoltageThreshold < 0 {
+		return fmt.Errorf("low_voltage_threshold must not be negative")
+	}
+
+	if c.SpikeDeltaUsv < 0 {
+		return fmt.Errorf("spike_delta_usv must not be negative")
+	}
+	if c.SpikeWindowSecs < 0 {
+		return fmt.Errorf("spike_window_secs must not be negative")
+	}
+
+	radnoteAlert := map[string]float64{
+		"radnote_alert_level_usv":     c.RadnoteAlertLevelUsv,
+		"radnote_alert_region_meters": c.RadnoteAlertRegionMeters,
+		"radnote_alert_mins":          float64(c.RadnoteAlertMins),
+		"radnote_alert_sample_mins":   float64(c.RadnoteAlertSampleMins),
+		"radnote_alert_sync_mins":     float64(c.RadnoteAlertSyncMins),
+	}
+	for name, v := range radnoteAlert {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
+	for _, tenant := range c.AccountKeys {
+		if !validTenantName(tenant) {
+			return fmt.Errorf("account_keys tenant %q must be letters, digits, '-', or '_'", tenant)
+		}
+	}
+
+	for name := range c.Features {
+		known := false
+		for _, featureName := range featureNames {
+			known = known || name == featureName
+		}
+		if !known {
+			return fmt.Errorf("unknown feature: %s", name)
+		}
+	}
+
+	if c.LargeRadiusMeters < 0 {
+		return fmt.Errorf("large_radius_meters must not be negative")
+	}
+
+	switch c.EmptyRegionStatus {
+	case 0, 200, 204:
+	default:
+		return fmt.Errorf("empty_region_status must be 200 or 204")
+	}
+
+	if c.QueryCacheSecs < 0 {
+		return fmt.Errorf("query_cache_secs must not be negative")
+	}
+	if c.QueryCacheKeyPrecision != nil && (*c.QueryCacheKeyPrecision < 0 || *c.QueryCacheKeyPrecision > 10) {
+		return fmt.Errorf("query_cache_key_precision must be between 0 and 10")
+	}
+
+	if c.FeedMaxItems < 0 || c.FeedMaxItems == 1 {
+		return fmt.Errorf("feed_max_items must be 0 (unlimited) or at least 2")
+	}
+
+	for i := 1; i < len(c.HistogramEdgesUsv); i++ {
+		if c.HistogramEdgesUsv[i] <= c.HistogramEdgesUsv[i-1] {
+			return fmt.Errorf("histogram_edges_usv must be in ascending order")
+		}
+	}
+
+	return nil
+
+}
+
+// Determine whether a feature is enabled
+func featureEnabled(name string) bool {
+	enabled, configured := config().Features[name]
+	if !configured {
+		return !featuresDisabledByDefault[name]
+	}
+	return enabled
+}
+
+// Convert a configured number of seconds to a duration, using the default if unset
+func configSeconds(secs int, defaultSecs int) time.Duration {
+	if secs == 0 {
+		secs = defaultSecs
+	}
+	return time.Duration(secs) * time.Second
 }
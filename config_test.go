@@ -0,0 +1,52 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+// Reloading the config applies a changed alert threshold to the next reading,
+// while an invalid config is refused and leaves the current one in effect
+func TestConfigReloadThreshold(t *testing.T) {
+	testService(t, Config{AlertOnUsv: 1, AlertOffUsv: 0.5})
+
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.8})
+	if alerts := testAlerts(t); len(alerts) != 0 {
+		t.Fatalf("alert raised below the threshold: %v", alerts)
+	}
+
+	err := os.WriteFile(configPath(), []byte(`{"alert_on_usv":0.7,"alert_off_usv":0.5}`), 0644)
+	if err != nil {
+		t.Fatalf("can't write config: %s", err)
+	}
+	changed, err := configReload()
+	if err != nil {
+		t.Fatalf("can't reload config: %s", err)
+	}
+	if !slices.Equal(changed, []string{"alert_on_usv"}) {
+		t.Errorf("changed: got %v, want alert_on_usv", changed)
+	}
+	testPostReading(t, "dev:1", 1700000060, 42.1, -71.1, map[string]interface{}{"usv": 0.8})
+	if _, active := testAlerts(t)["dev:1/"+alertTypeLevel]; !active {
+		t.Errorf("no alert raised at the reloaded threshold")
+	}
+
+	for _, contents := range []string{`{"alert_on_usv":0.4,"alert_off_usv":0.5}`, `{"alert_on_usv":`} {
+		err = os.WriteFile(configPath(), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("can't write config: %s", err)
+		}
+		_, err = configReload()
+		if err == nil {
+			t.Errorf("%s: reloaded an invalid config", contents)
+		}
+		if config().AlertOnUsv != 0.7 {
+			t.Errorf("%s: alert_on_usv is %g after refusing it, want 0.7", contents, config().AlertOnUsv)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The methods and request headers that cross-origin requests may use, and the
+// response headers that they may read
+const (
+	corsAllowMethods  = "GET, HEAD, POST, OPTIONS"
+	corsAllowHeaders  = "Accept-Encoding, Authorization, Content-Type, If-None-Match, X-API-Key, X-Account-Key, X-Empty-Region-Status"
+	corsExposeHeaders = "ETag, Retry-After, Server-Timing, Warning"
+)
+
+// How long, in seconds, browsers may cache the result of a preflight request
+const corsMaxAgeSecs = 600
+
+// Determine whether cross-origin requests are allowed from an origin, either
+// because it is configured or because "*" is
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range config().CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap a handler so that browsers may fetch feeds from the configured origins.
+// Preflight requests are answered here, with a 204 for allowed origins and a 403
+// otherwise.  Nothing is changed if no origins are configured.
+func corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(config().CORSOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := corsOriginAllowed(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		if preflight {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAgeSecs))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
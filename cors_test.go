@@ -0,0 +1,67 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Serve a request from an origin through the CORS middleware
+func testServeCORS(method string, origin string, preflight bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/radiation", nil)
+	r.Header.Set("Origin", origin)
+	if preflight {
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		r.Header.Set("Access-Control-Request-Headers", "If-None-Match")
+	}
+	w := httptest.NewRecorder()
+	corsHandler(newRouter()).ServeHTTP(w, r)
+	return w
+}
+
+// Preflight and actual requests from configured origins are allowed, those from
+// other origins aren't, and no CORS headers are sent unless origins are
+// configured
+func TestCORS(t *testing.T) {
+	testService(t, Config{CORSOrigins: []string{"https://map.example.com"}})
+
+	w := testServeCORS(http.MethodOptions, "https://map.example.com", true)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("allowed preflight: got %d, want %d", w.Code, http.StatusNoContent)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://map.example.com",
+		"Access-Control-Allow-Methods": corsAllowMethods,
+		"Access-Control-Allow-Headers": corsAllowHeaders,
+		"Access-Control-Max-Age":       "600",
+	} {
+		if w.Header().Get(header) != want {
+			t.Errorf("allowed preflight: %s is %q, want %q", header, w.Header().Get(header), want)
+		}
+	}
+
+	w = testServeCORS(http.MethodOptions, "https://evil.example.com", true)
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("denied preflight: got %d with origin %q, want %d", w.Code, w.Header().Get("Access-Control-Allow-Origin"), http.StatusForbidden)
+	}
+
+	w = testServeCORS(http.MethodGet, "https://MAP.example.com", false)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://MAP.example.com" || w.Header().Get("Access-Control-Expose-Headers") != corsExposeHeaders {
+		t.Errorf("allowed GET: got %d with headers %v", w.Code, w.Header())
+	}
+
+	w = testServeCORS(http.MethodGet, "https://evil.example.com", false)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("denied GET: got Access-Control-Allow-Origin %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	testService(t, Config{})
+	w = testServeCORS(http.MethodGet, "https://map.example.com", false)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "" {
+		t.Errorf("unconfigured: got CORS headers %v", w.Header())
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// How long a reading is remembered for duplicate detection, by default
+const dedupDefaultTTLSecs = 600
+
+// Numeric body fields are rounded to this many decimal places before hashing,
+// so that insignificant formatting differences don't defeat deduplication
+const dedupRoundingPlaces = 6
+
+// Recently-seen readings, keyed by dedupKey, with the time at which each expires
+var dedupLock sync.Mutex
+var dedupSeen = map[string]time.Time{}
+var dedupLastSweep time.Time
+
+// Return a key identifying a reading.  A reading carrying the event UID that
+// Notehub assigns is identified by it, so that a retried POST is recognized even
+// if the body was re-encoded.  Otherwise it is identified by its tenant and
+// device, its When, and a hash of its body with numeric values rounded.
+func dedupKey(tenant string, event note.Event) string {
+	if event.EventUID != "" {
+		return fmt.Sprintf("%s|event|%s", tenant, event.EventUID)
+	}
+	fields := []string{}
+	if event.Body != nil {
+		for k, v := range *event.Body {
+			switch n := v.(type) {
+			case json.Number:
+				f, err := n.Float64()
+				if err == nil {
+					scale := math.Pow(10, dedupRoundingPlaces)
+					v = math.Round(f*scale) / scale
+				}
+			case float64:
+				scale := math.Pow(10, dedupRoundingPlaces)
+				v = math.Round(n*scale) / scale
+			}
+			fields = append(fields, fmt.Sprintf("%q:%v", k, v))
+		}
+	}
+	sort.Strings(fields)
+	h := sha256.New()
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s|%d|%s", tenantDevice(tenant, event.DeviceUID), event.When, hex.EncodeToString(h.Sum(nil)))
+}
+
+// Record that a reading was received for a tenant, returning true if the same
+// reading was already received within the TTL
+func dedupCheck(tenant string, event note.Event, now time.Time) (duplicate bool) {
+
+	ttl := time.Duration(config().DedupTTLSecs) * time.Second
+	if ttl == 0 {
+		ttl = dedupDefaultTTLSecs * time.Second
+	}
+	key := dedupKey(tenant, event)
+
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+
+	// Periodically forget expired readings to bound memory
+	if now.Sub(dedupLastSweep) >= ttl {
+		for k, expires := range dedupSeen {
+			if !now.Before(expires) {
+				delete(dedupSeen, k)
+			}
+		}
+		dedupLastSweep = now
+	}
+
+	expires, seen := dedupSeen[key]
+	if seen && now.Before(expires) {
+		return true
+	}
+	dedupSeen[key] = now.Add(ttl)
+	return false
+
+}
+
+// Forget that a reading was received for a tenant, so that a retry of a reading
+// that was refused rather than stored isn't mistaken for a duplicate
+func dedupForget(tenant string, event note.Event) {
+	key := dedupKey(tenant, event)
+	dedupLock.Lock()
+	delete(dedupSeen, key)
+	dedupLock.Unlock()
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Return the number of readings in a device's history of the default tenant
+func testHistoryLen(deviceUID string) int {
+	radLock.RLock()
+	defer radLock.RUnlock()
+	return len(radHistory[""][deviceUID])
+}
+
+// The same reading POSTed twice, even with insignificant differences in its body,
+// is acknowledged the second time without being recorded again
+func TestDedupSameReadingTwice(t *testing.T) {
+	testService(t, Config{})
+
+	for _, usv := range []float64{0.1, 0.1000000001} {
+		w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": usv, "cpm": 33}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	if n := testHistoryLen("dev:1"); n != 1 {
+		t.Errorf("history has %d readings, want 1", n)
+	}
+
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.2, "cpm": 66}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := testHistoryLen("dev:1"); n != 2 {
+		t.Errorf("a different reading with the same When wasn't recorded: history has %d readings, want 2", n)
+	}
+}
+
+// A retried POST of an event with the same event UID is acknowledged without
+// being stored or persisted again, even if its body was re-encoded
+func TestDedupEventUID(t *testing.T) {
+	testService(t, Config{})
+
+	e := testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	e.EventUID = "3f5e8d2a-0001"
+	w := testPost(t, e)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	persisted, err := os.ReadFile(configDataDirectory + radnoteFile)
+	if err != nil {
+		t.Fatalf("can't read data file: %s", err)
+	}
+	err = os.Remove(configDataDirectory + radnoteFile)
+	if err != nil {
+		t.Fatalf("can't remove data file: %s", err)
+	}
+
+	retry := testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1, "cpm": 33})
+	retry.EventUID = e.EventUID
+	w = testPost(t, retry)
+	if w.Code != http.StatusOK {
+		t.Fatalf("retry: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := testHistoryLen("dev:1"); n != 1 {
+		t.Errorf("retry: history has %d readings, want 1", n)
+	}
+	if stored, _ := testStored("dev:1"); stored.Body.Cpm != 0 {
+		t.Errorf("retry replaced the stored reading")
+	}
+	if _, err = os.Stat(configDataDirectory + radnoteFile); !os.IsNotExist(err) {
+		t.Errorf("retry rewrote the data file")
+	}
+	err = os.WriteFile(configDataDirectory+radnoteFile, persisted, 0644)
+	if err != nil {
+		t.Fatalf("can't restore data file: %s", err)
+	}
+
+	// A different event UID is a different reading, even with the same When
+	other := testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	other.EventUID = "3f5e8d2a-0002"
+	w = testPost(t, other)
+	if w.Code != http.StatusOK {
+		t.Fatalf("other event: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := testHistoryLen("dev:1"); n != 2 {
+		t.Errorf("other event: history has %d readings, want 2", n)
+	}
+}
+
+// A reading is remembered only for the TTL, after which its key is forgotten by
+// the next sweep so that the remembered set stays bounded
+func TestDedupExpiry(t *testing.T) {
+	testService(t, Config{DedupTTLSecs: 60})
+	now := time.Unix(1700000000, 0)
+	e := testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	e.EventUID = "3f5e8d2a-0001"
+
+	if dedupCheck("", e, now) {
+		t.Errorf("first receipt is a duplicate")
+	}
+	if !dedupCheck("", e, now.Add(59*time.Second)) {
+		t.Errorf("receipt within the TTL isn't a duplicate")
+	}
+	if dedupCheck("acme", e, now.Add(59*time.Second)) {
+		t.Errorf("receipt for another tenant is a duplicate")
+	}
+	for i := 0; i < 100; i++ {
+		other := e
+		other.EventUID = fmt.Sprintf("3f5e8d2a-1%03d", i)
+		dedupCheck("", other, now)
+	}
+	if dedupCheck("", e, now.Add(61*time.Second)) {
+		t.Errorf("receipt after the TTL is a duplicate")
+	}
+	dedupLock.Lock()
+	remembered := len(dedupSeen)
+	dedupLock.Unlock()
+	// Only the reading received again and the other tenant's, received later
+	if remembered != 2 {
+		t.Errorf("%d readings remembered after the TTL, want 2", remembered)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A device in the inventory of devices that have reported
+type deviceInventoryEntry struct {
+	DeviceUID  string  `json:"device_uid"`
+	BestLat    float64 `json:"best_lat"`
+	BestLon    float64 `json:"best_lon"`
+	LastSeen   int64   `json:"last_seen"`
+	Usv        float64 `json:"usv"`
+	Stale      bool    `json:"stale,omitempty"`
+	NoLocation bool    `json:"no_location,omitempty"`
+}
+
+// The inventory of devices, with how many of them have no location
+type deviceInventory struct {
+	Devices         []deviceInventoryEntry `json:"devices"`
+	NoLocationCount int                    `json:"no_location_count"`
+}
+
+// Devices handler, listing every device that has reported with its latest
+// location and reading, most recently seen first, and then by device UID so that
+// the order is stable.  If stale_secs is specified, devices whose latest reading
+// is older than that are flagged as stale.  Devices whose latest reading has no
+// location, and so appear in no region, are flagged and counted in
+// no_location_count, as they are in a region's response.
+func httpRadnoteDevicesHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Make sure the data is available
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	if !ensureQueryable(w) {
+		return
+	}
+
+	staleSecs := int64(0)
+	staleSecsStr := r.URL.Query().Get("stale_secs")
+	if staleSecsStr != "" {
+		var err error
+		staleSecs, err = strconv.ParseInt(staleSecsStr, 10, 64)
+		if err != nil || staleSecs < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("stale_secs must be a positive number of seconds"))
+			return
+		}
+	}
+
+	now := time.Now().UTC().Unix()
+	devices := []deviceInventoryEntry{}
+	noLocation := 0
+	for _, e := range snapshotEvents(tenant) {
+		entry := deviceInventoryEntry{
+			DeviceUID: e.Event.DeviceUID,
+			BestLat:   e.Event.BestLat,
+			BestLon:   e.Event.BestLon,
+			LastSeen:  e.Event.When,
+			Usv:       e.Body.Usv,
+		}
+		entry.Stale = staleSecs > 0 && now-e.Event.When > staleSecs
+		entry.NoLocation = e.Event.BestLat == 0 && e.Event.BestLon == 0
+		if entry.NoLocation {
+			noLocation++
+		}
+		devices = append(devices, entry)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].LastSeen != devices[j].LastSeen {
+			return devices[i].LastSeen > devices[j].LastSeen
+		}
+		return devices[i].DeviceUID < devices[j].DeviceUID
+	})
+
+	devicesJSON, err := json.MarshalIndent(deviceInventory{Devices: devices, NoLocationCount: noLocation}, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(devicesJSON)
+
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Return the inventory listed by the devices endpoint with a query
+func testInventory(t *testing.T, query string) (inventory deviceInventory) {
+	t.Helper()
+	w := testGet("/radnote/devices" + query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /radnote/devices%s: got %d", query, w.Code)
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &inventory)
+	if err != nil || inventory.Devices == nil {
+		t.Fatalf("devices aren't a JSON inventory: %s", w.Body.String())
+	}
+	return
+}
+
+// Return the devices listed by the devices endpoint with a query
+func testDevices(t *testing.T, query string) []deviceInventoryEntry {
+	t.Helper()
+	return testInventory(t, query).Devices
+}
+
+// Devices are listed most recently seen first, and then by device UID, and those
+// not seen within stale_secs are flagged
+func TestDevicesOrderAndStaleness(t *testing.T) {
+	testService(t, Config{})
+	now := time.Now().UTC().Unix()
+	testPostReading(t, "dev:hour", now-3600, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:minute", now-60, 42.2, -71.2, map[string]interface{}{"usv": 0.2})
+	testPostReading(t, "dev:day", now-86400, 42.3, -71.3, map[string]interface{}{"usv": 0.3})
+	testPostReading(t, "dev:hour-b", now-3600, 42.4, -71.4, map[string]interface{}{"usv": 0.4})
+	testPostReading(t, "dev:hour-a", now-3600, 42.5, -71.5, map[string]interface{}{"usv": 0.5})
+
+	devices := testDevices(t, "")
+	order := []string{"dev:minute", "dev:hour", "dev:hour-a", "dev:hour-b", "dev:day"}
+	if len(devices) != len(order) {
+		t.Fatalf("got %d devices, want %d", len(devices), len(order))
+	}
+	for i, deviceUID := range order {
+		if devices[i].DeviceUID != deviceUID {
+			t.Errorf("device %d: got %s, want %s", i, devices[i].DeviceUID, deviceUID)
+		}
+		if devices[i].Stale {
+			t.Errorf("%s is flagged stale without stale_secs", deviceUID)
+		}
+	}
+	if devices[0].Usv != 0.2 || devices[0].BestLat != 42.2 || devices[0].LastSeen != now-60 {
+		t.Errorf("dev:minute: got %+v", devices[0])
+	}
+
+	stale := map[string]bool{}
+	for _, device := range testDevices(t, "?stale_secs=1800") {
+		stale[device.DeviceUID] = device.Stale
+	}
+	want := map[string]bool{"dev:minute": false, "dev:hour": true, "dev:hour-a": true, "dev:hour-b": true, "dev:day": true}
+	for deviceUID, wantStale := range want {
+		if stale[deviceUID] != wantStale {
+			t.Errorf("%s: stale %t, want %t", deviceUID, stale[deviceUID], wantStale)
+		}
+	}
+
+	for _, query := range []string{"?stale_secs=0", "?stale_secs=soon"} {
+		w := testGet("/radnote/devices" + query)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// A device reporting without a location is kept and listed, but appears in no
+// region, and is counted by both the region response and the inventory until it
+// reports with a location
+func TestDevicesWithoutLocation(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:located", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:unlocated", 1700000060, 0, 0, map[string]interface{}{"usv": 0.2})
+
+	if _, exists := testStored("dev:unlocated"); !exists {
+		t.Fatalf("device without a location wasn't stored")
+	}
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if content["count"] != float64(1) || content["no_location_count"] != float64(1) {
+		t.Errorf("region: got count %v no_location_count %v, want 1 and 1", content["count"], content["no_location_count"])
+	}
+	content = testFeedContent(t, testGet("/radiation?lat=0.001&lon=0.001&radius_meters=1000"))
+	if content["count"] != float64(0) {
+		t.Errorf("region by 0,0: got count %v, want 0", content["count"])
+	}
+
+	inventory := testInventory(t, "")
+	if inventory.NoLocationCount != 1 {
+		t.Errorf("inventory: got no_location_count %d, want 1", inventory.NoLocationCount)
+	}
+	noLocation := map[string]bool{}
+	for _, device := range inventory.Devices {
+		noLocation[device.DeviceUID] = device.NoLocation
+	}
+	if len(noLocation) != 2 || noLocation["dev:located"] || !noLocation["dev:unlocated"] {
+		t.Errorf("got no_location %v, want only dev:unlocated flagged", noLocation)
+	}
+
+	// Once it reports with a location it is counted in its region instead
+	testPostReading(t, "dev:unlocated", 1700000120, 42.101, -71.1, map[string]interface{}{"usv": 0.2})
+	content = testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if content["count"] != float64(2) || content["no_location_count"] != float64(0) {
+		t.Errorf("located again: got count %v no_location_count %v, want 2 and 0", content["count"], content["no_location_count"])
+	}
+	if count := testInventory(t, "").NoLocationCount; count != 0 {
+		t.Errorf("located again: inventory: got no_location_count %d, want 0", count)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+// The radii of the sphere approximating the earth that may be configured
+const (
+	earthRadiusMean       = "mean"
+	earthRadiusEquatorial = "equatorial"
+	earthRadiusAuthalic   = "authalic"
+)
+
+// The radius of each sphere, in meters.  The mean radius is the rounded figure
+// that distances have always been computed with.  The equatorial radius is the
+// WGS84 semi-major axis, which overstates distances away from the equator by up
+// to the 0.3% flattening of the earth, and the authalic radius is that of the
+// sphere with the same surface area as the WGS84 ellipsoid.
+var earthRadii = map[string]float64{
+	earthRadiusMean:       6371000,
+	earthRadiusEquatorial: 6378137,
+	earthRadiusAuthalic:   6371007.2,
+}
+
+// Return the name of the configured radius
+func earthRadiusName() string {
+	if config().EarthRadius == "" {
+		return earthRadiusMean
+	}
+	return config().EarthRadius
+}
+
+// Return the configured radius of the earth, in meters, which every distance and
+// region computation uses
+func earthRadiusMeters() float64 {
+	r, known := earthRadii[earthRadiusName()]
+	if !known {
+		return earthRadii[earthRadiusMean]
+	}
+	return r
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// The WGS84 lengths of a degree, in meters, against which the spherical models
+// are compared
+const (
+	testWGS84EquatorLonDegree = 111319.49
+	testWGS84EquatorLatDegree = 110574.39
+	testWGS84PoleLatDegree    = 111693.98
+)
+
+// Documents the accuracy of each radius: a sphere can't match both the flattened
+// meridian at the equator and its curvature near the poles, so the mean and
+// authalic radii overstate a degree of latitude at the equator by about 0.56%
+// and understate it near the poles by about 0.45%, and understate distances
+// along the equator by about 0.11%, while the equatorial radius is exact along
+// the equator but overstates latitude there by about 0.67%
+func TestEarthRadiusAccuracy(t *testing.T) {
+	tests := []struct {
+		radius              string
+		equatorLon          float64
+		equatorLat, poleLat float64
+	}{
+		{"", -0.0011, 0.0056, -0.0045},
+		{earthRadiusMean, -0.0011, 0.0056, -0.0045},
+		{earthRadiusAuthalic, -0.0011, 0.0056, -0.0045},
+		{earthRadiusEquatorial, 0, 0.0067, -0.0033},
+	}
+	for _, test := range tests {
+		testService(t, Config{EarthRadius: test.radius})
+		errors := []struct {
+			name     string
+			got      float64
+			want     float64
+			relative float64
+		}{
+			{"equator, degree of longitude", metersApart(0, 0, 0, 1), testWGS84EquatorLonDegree, test.equatorLon},
+			{"equator, degree of latitude", metersApart(-0.5, 0, 0.5, 0), testWGS84EquatorLatDegree, test.equatorLat},
+			{"pole, degree of latitude", metersApart(89, 0, 90, 0), testWGS84PoleLatDegree, test.poleLat},
+		}
+		for _, e := range errors {
+			relative := (e.got - e.want) / e.want
+			if math.Abs(relative-e.relative) > 0.0001 {
+				t.Errorf("%s radius, %s: got %.0fm, %.4f%% from WGS84, want %.2f%%", earthRadiusName(), e.name, e.got, 100*relative, 100*e.relative)
+			}
+		}
+	}
+}
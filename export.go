@@ -0,0 +1,105 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Export formats of the full event list
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+// The metrics exported as CSV columns, following the location
+var exportCSVMetrics = []string{defaultMetric, cpmMetric, temperatureMetric, voltageMetric}
+
+// The columns of a CSV export
+var exportCSVColumns = append([]string{"device_uid", "when", "best_lat", "best_lon"}, exportCSVMetrics...)
+
+// Return a copy of a tenant's latest events, ordered by device UID, so that they
+// can be written out without holding radLock for the duration of the write
+func snapshotEvents(tenant string) (events []RadnoteEvent) {
+	radLock.RLock()
+	for _, e := range tenantEvents(tenant) {
+		events = append(events, e)
+	}
+	radLock.RUnlock()
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Event.DeviceUID < events[j].Event.DeviceUID
+	})
+	return
+}
+
+// Write a tenant's latest events as CSV, one row per device, streamed to the
+// client as rows are formatted rather than built up in memory.  A metric that
+// the device didn't report is left empty, so that it isn't mistaken for a 0.
+func writeEventsCSV(w http.ResponseWriter, tenant string) {
+
+	events := snapshotEvents(tenant)
+
+	filename := fmt.Sprintf("radnote-%s.csv", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write(exportCSVColumns)
+	for _, e := range events {
+		row := []string{
+			e.Event.DeviceUID,
+			strconv.FormatInt(e.Event.When, 10),
+			formatFloat(e.Event.BestLat),
+			formatFloat(e.Event.BestLon),
+		}
+		for _, metric := range exportCSVMetrics {
+			value, present := e.metricValue(metric)
+			if present {
+				row = append(row, formatFloat(value))
+			} else {
+				row = append(row, "")
+			}
+		}
+		err := cw.Write(row)
+		if err != nil {
+			slog.Warn("can't write csv export", "error", err)
+			return
+		}
+	}
+	cw.Flush()
+	err := cw.Error()
+	if err != nil {
+		slog.Warn("can't write csv export", "error", err)
+	}
+
+}
+
+// Write a tenant's latest events as newline-delimited JSON, one event per line,
+// each encoded and written to the client in turn
+func writeEventsNDJSON(w http.ResponseWriter, tenant string) {
+
+	events := snapshotEvents(tenant)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		err := enc.Encode(e)
+		if err != nil {
+			slog.Warn("can't write ndjson export", "error", err)
+			return
+		}
+	}
+
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A CSV export leaves the metrics a device didn't report empty, while reporting
+// those it did, including any that are 0
+func TestExportCSVMissingMetrics(t *testing.T) {
+	testService(t, Config{})
+
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.25, "temperature": 0}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+
+	w = testGet("/radiation?format=csv")
+	if w.Code != http.StatusOK {
+		t.Fatalf("csv export: got %d, want %d", w.Code, http.StatusOK)
+	}
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("csv export doesn't parse: %s", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("csv export: got %d rows, want a header and 1 device", len(rows))
+	}
+	want := []string{"dev:1", "1700000000", "42.1", "-71.1", "0.25", "", "0", ""}
+	if strings.Join(rows[0], ",") != strings.Join(exportCSVColumns, ",") {
+		t.Errorf("csv header: got %v, want %v", rows[0], exportCSVColumns)
+	}
+	if strings.Join(rows[1], ",") != strings.Join(want, ",") {
+		t.Errorf("csv row: got %q, want %q", rows[1], want)
+	}
+}
+
+// An NDJSON export parses back, line by line, into the stored events
+func TestExportNDJSON(t *testing.T) {
+	testService(t, Config{})
+	for i := 0; i < 3; i++ {
+		deviceUID := fmt.Sprintf("dev:%d", i)
+		testPostReading(t, deviceUID, 1700000000+int64(i), 42.1, -71.1+float64(i)/100, map[string]interface{}{"usv": 0.1 * float64(i+1)})
+	}
+
+	w := testGet("/radiation?format=ndjson")
+	if w.Code != http.StatusOK {
+		t.Fatalf("ndjson export: got %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Content-Type: got %q", w.Header().Get("Content-Type"))
+	}
+	records := map[string]RadnoteEvent{}
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		e := RadnoteEvent{}
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("line doesn't parse: %s: %s", err, scanner.Text())
+		}
+		records[e.Event.DeviceUID] = e
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	for deviceUID, e := range records {
+		stored, _ := testStored(deviceUID)
+		if e.Event.When != stored.Event.When || e.Event.BestLon != stored.Event.BestLon || e.Metrics[defaultMetric] != stored.Metrics[defaultMetric] {
+			t.Errorf("%s: got %+v, want %+v", deviceUID, e, stored)
+		}
+	}
+}
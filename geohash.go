@@ -0,0 +1,223 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// The geohash alphabet, in which each character encodes five bits
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// The longest geohash by which devices are indexed, whose cells are roughly
+// 1.2km by 0.6km.  Devices are indexed by every prefix of it, so that queries
+// of any radius can use cells just larger than their region.
+const geohashIndexPrecision = 6
+
+// Each tenant's located devices, keyed by the geohash of the location of their
+// latest reading at each precision up to geohashIndexPrecision, protected by
+// radLock
+var radGeohashIndex = map[string]map[string]map[string]bool{}
+
+// Each tenant's devices whose latest reading has no location, which therefore
+// aren't in the geohash index, protected by radLock
+var radUnlocated = map[string]map[string]bool{}
+
+// Encode a location as a geohash of the specified number of characters
+func geohashEncode(lat float64, lon float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+	var hash strings.Builder
+	even := true
+	bits := 0
+	ch := 0
+	for hash.Len() < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if lon >= mid {
+				ch = ch<<1 | 1
+				minLon = mid
+			} else {
+				ch = ch << 1
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch = ch << 1
+				maxLat = mid
+			}
+		}
+		even = !even
+		bits++
+		if bits == 5 {
+			hash.WriteByte(geohashBase32[ch])
+			bits = 0
+			ch = 0
+		}
+	}
+	return hash.String()
+}
+
+// Decode a geohash into the bounds of its cell
+func geohashDecode(hash string) (minLat, maxLat, minLon, maxLon float64) {
+	minLat, maxLat = -90.0, 90.0
+	minLon, maxLon = -180.0, 180.0
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(geohashBase32, hash[i])
+		for bit := 4; bit >= 0; bit-- {
+			set := ch>>bit&1 == 1
+			if even {
+				mid := (minLon + maxLon) / 2
+				if set {
+					minLon = mid
+				} else {
+					maxLon = mid
+				}
+			} else {
+				mid := (minLat + maxLat) / 2
+				if set {
+					minLat = mid
+				} else {
+					maxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return
+}
+
+// Return the height and width, in degrees, of the cells of geohashes of the
+// specified number of characters
+func geohashCellSize(precision int) (height float64, width float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// Return the geohashes of the cells surrounding a geohash's cell, wrapping around
+// the antimeridian.  Cells at the poles have no neighbors beyond the pole.
+func geohashNeighbors(hash string) (neighbors []string) {
+	minLat, maxLat, minLon, maxLon := geohashDecode(hash)
+	height := maxLat - minLat
+	width := maxLon - minLon
+	lat := (minLat + maxLat) / 2
+	lon := (minLon + maxLon) / 2
+	for _, dLat := range []float64{-height, 0, height} {
+		neighborLat := lat + dLat
+		if neighborLat < -90 || neighborLat > 90 {
+			continue
+		}
+		for _, dLon := range []float64{-width, 0, width} {
+			if dLat == 0 && dLon == 0 {
+				continue
+			}
+			neighborLon := math.Mod(lon+dLon+540, 360) - 180
+			neighbor := geohashEncode(neighborLat, neighborLon, len(hash))
+			if neighbor != hash {
+				neighbors = append(neighbors, neighbor)
+			}
+		}
+	}
+	return
+}
+
+// Add a device to, or remove it from, a tenant's geohash index.  Readings without
+// a location aren't indexed, but are tracked in radUnlocated.  The caller must
+// hold radLock.
+func geohashIndexUpdate(tenant string, deviceUID string, lat float64, lon float64, add bool) {
+	if lat == 0 && lon == 0 {
+		if add {
+			if radUnlocated[tenant] == nil {
+				radUnlocated[tenant] = map[string]bool{}
+			}
+			radUnlocated[tenant][deviceUID] = true
+		} else {
+			delete(radUnlocated[tenant], deviceUID)
+		}
+		return
+	}
+	index := radGeohashIndex[tenant]
+	if index == nil {
+		index = map[string]map[string]bool{}
+		radGeohashIndex[tenant] = index
+	}
+	hash := geohashEncode(lat, lon, geohashIndexPrecision)
+	for precision := 1; precision <= geohashIndexPrecision; precision++ {
+		cell := hash[:precision]
+		if add {
+			if index[cell] == nil {
+				index[cell] = map[string]bool{}
+			}
+			index[cell][deviceUID] = true
+		} else {
+			delete(index[cell], deviceUID)
+			if len(index[cell]) == 0 {
+				delete(index, cell)
+			}
+		}
+	}
+}
+
+// Move a device within a tenant's geohash index from the location of its previous
+// latest reading, if any, to that of its new one.  The caller must hold radLock.
+func geohashIndexMove(tenant string, deviceUID string, previous *RadnoteEvent, latest RadnoteEvent) {
+	if previous != nil {
+		geohashIndexUpdate(tenant, deviceUID, previous.Event.BestLat, previous.Event.BestLon, false)
+	}
+	geohashIndexUpdate(tenant, deviceUID, latest.Event.BestLat, latest.Event.BestLon, true)
+}
+
+// Rebuild a tenant's geohash index from its stored events.  The caller must hold
+// radLock.
+func geohashIndexTenant(tenant string) {
+	delete(radGeohashIndex, tenant)
+	delete(radUnlocated, tenant)
+	for deviceUID, e := range tenantEvents(tenant) {
+		geohashIndexUpdate(tenant, deviceUID, e.Event.BestLat, e.Event.BestLon, true)
+	}
+}
+
+// Return those of a tenant's latest events that may fall within the circle of the
+// specified radius around a point, found in the geohash index by looking in the
+// cell containing the point and the cells surrounding it, at the finest precision
+// at which those cells enclose the circle.  False is returned if no precision is
+// coarse enough, such as when the circle reaches a pole, in which case the caller
+// should examine every event.  The caller must hold radLock.
+func geohashCandidates(tenant string, lat float64, lon float64, radiusMeters float64) (candidates map[string]RadnoteEvent, ok bool) {
+	minLat, maxLat, minLon, maxLon := boundingBox(lat, lon, radiusMeters)
+	if minLat <= -90 || maxLat >= 90 {
+		return nil, false
+	}
+	deltaLat := (maxLat - minLat) / 2
+	deltaLon := math.Mod(maxLon-minLon+360, 360) / 2
+	precision := geohashIndexPrecision
+	for ; precision > 0; precision-- {
+		height, width := geohashCellSize(precision)
+		if deltaLat <= height && deltaLon <= width {
+			break
+		}
+	}
+	if precision == 0 {
+		return nil, false
+	}
+	hash := geohashEncode(lat, lon, precision)
+	index := radGeohashIndex[tenant]
+	events := tenantEvents(tenant)
+	candidates = map[string]RadnoteEvent{}
+	for _, cell := range append(geohashNeighbors(hash), hash) {
+		for deviceUID := range index[cell] {
+			candidates[deviceUID] = events[deviceUID]
+		}
+	}
+	return candidates, true
+}
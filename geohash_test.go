@@ -0,0 +1,162 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Locations encode to their well-known geohashes, and decode to cells that
+// contain them
+func TestGeohashEncode(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		hash     string
+	}{
+		{57.64911, 10.40744, "u4pruydqqvj"},
+		{42.6, -5.6, "ezs42"},
+		{-25.382708, -49.265506, "6gkzwgjzn820"},
+	}
+	for _, test := range tests {
+		hash := geohashEncode(test.lat, test.lon, len(test.hash))
+		if hash != test.hash {
+			t.Errorf("%f,%f: got %s, want %s", test.lat, test.lon, hash, test.hash)
+		}
+		minLat, maxLat, minLon, maxLon := geohashDecode(hash)
+		if test.lat < minLat || test.lat > maxLat || test.lon < minLon || test.lon > maxLon {
+			t.Errorf("%s decodes to a cell not containing %f,%f", hash, test.lat, test.lon)
+		}
+	}
+}
+
+// A cell's neighbors are the eight cells of the same size around it, wrapping
+// around the antimeridian, and only five at a pole
+func TestGeohashNeighbors(t *testing.T) {
+	for _, hash := range []string{"drt2z", "9q8yy", "xbpbp", "zzzz"} {
+		neighbors := geohashNeighbors(hash)
+		want := 8
+		if _, maxLat, _, _ := geohashDecode(hash); maxLat == 90 {
+			want = 5
+		}
+		if len(neighbors) != want {
+			t.Errorf("%s: got %d neighbors, want %d: %v", hash, len(neighbors), want, neighbors)
+		}
+		minLat, maxLat, minLon, maxLon := geohashDecode(hash)
+		height := maxLat - minLat
+		width := maxLon - minLon
+		seen := map[string]bool{}
+		for _, neighbor := range neighbors {
+			if len(neighbor) != len(hash) || neighbor == hash || seen[neighbor] {
+				t.Errorf("%s: neighbor %s isn't a distinct cell of the same size", hash, neighbor)
+			}
+			seen[neighbor] = true
+			nMinLat, _, nMinLon, _ := geohashDecode(neighbor)
+			dLat := math.Abs(nMinLat-minLat) / height
+			dLon := math.Abs(nMinLon - minLon)
+			dLon = math.Min(dLon, 360-dLon) / width
+			if math.Round(dLat) > 1 || math.Round(dLon) > 1 {
+				t.Errorf("%s: neighbor %s isn't adjacent", hash, neighbor)
+			}
+		}
+	}
+}
+
+// Store devices at random locations within the specified bounds, keyed as
+// dev:<n>, and index them
+func testScatterDevices(rng *rand.Rand, n int, minLat, maxLat, minLon, maxLon float64) {
+	radLock.Lock()
+	defer radLock.Unlock()
+	for i := 0; i < n; i++ {
+		deviceUID := fmt.Sprintf("dev:%d", len(radnoteEvents))
+		lat := minLat + rng.Float64()*(maxLat-minLat)
+		lon := math.Mod(minLon+rng.Float64()*(maxLon-minLon)+540, 360) - 180
+		event := testReading(deviceUID, 1700000000, lat, lon, nil)
+		radnoteEvents[deviceUID] = RadnoteEvent{Event: event, Metrics: map[string]float64{defaultMetric: 0.1}}
+	}
+	geohashIndexTenant("")
+}
+
+// Return the UIDs of every device within a radius of a point, by computing every
+// device's distance
+func testBruteForce(lat float64, lon float64, radiusMeters float64) (uids []string) {
+	radLock.RLock()
+	defer radLock.RUnlock()
+	for deviceUID, e := range radnoteEvents {
+		if metersApart(e.Event.BestLat, e.Event.BestLon, lat, lon) <= radiusMeters {
+			uids = append(uids, deviceUID)
+		}
+	}
+	sort.Strings(uids)
+	return
+}
+
+// Return the UIDs of the devices of a region scanned using the geohash index
+func testScanRegion(lat float64, lon float64, radiusMeters float64) (uids []string) {
+	samples, _, _ := scanRegion(context.Background(), "", lat, lon, radiusMeters, defaultMetric, 0, 0, "")
+	for _, sample := range samples {
+		uids = append(uids, sample.Event.Event.DeviceUID)
+	}
+	sort.Strings(uids)
+	return
+}
+
+// Regions found through the geohash index match those found by computing every
+// device's distance, at radii spanning every index precision, near cell edges,
+// across the antimeridian, and near the poles
+func TestGeohashCandidatesMatchBruteForce(t *testing.T) {
+	testService(t, Config{})
+	rng := rand.New(rand.NewSource(1))
+	testScatterDevices(rng, 2000, 41, 43, -72, -70)
+	testScatterDevices(rng, 500, -1, 1, 179, 181)
+	testScatterDevices(rng, 500, 88, 90, -180, 180)
+	testScatterDevices(rng, 1000, -80, 80, -180, 180)
+
+	centers := [][2]float64{{42, -71}, {42.1875, -70.3125}, {0, 180}, {0.5, -179.99}, {89.5, 10}, {-30, 100}}
+	for i := 0; i < 20; i++ {
+		centers = append(centers, [2]float64{41 + rng.Float64()*2, -72 + rng.Float64()*2})
+	}
+	checked := 0
+	for _, center := range centers {
+		for _, radius := range []float64{100, 500, 2000, 10000, 50000, 200000, 1000000, 5000000} {
+			want := testBruteForce(center[0], center[1], radius)
+			got := testScanRegion(center[0], center[1], radius)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%f,%f radius %g: got %d devices, want %d", center[0], center[1], radius, len(got), len(want))
+			}
+			checked += len(want)
+		}
+	}
+	if checked == 0 {
+		t.Fatalf("no region contained any devices")
+	}
+}
+
+// Scanning a 2km region of 10k devices through the geohash index, compared with
+// examining every device
+func BenchmarkRegionGeohash(b *testing.B) {
+	testService(b, Config{})
+	testScatterDevices(rand.New(rand.NewSource(1)), 10000, 37, 47, -80, -66)
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			testScanRegion(42.36, -71.06, 2000)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			radLock.RLock()
+			region := newQueryRegion(42.36, -71.06, 2000)
+			for _, e := range canonicalEvents("") {
+				region.contains(e.Event.BestLat, e.Event.BestLon)
+			}
+			radLock.RUnlock()
+		}
+	})
+}
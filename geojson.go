@@ -0,0 +1,91 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+)
+
+// A GeoJSON FeatureCollection
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// A GeoJSON Feature
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// A GeoJSON Geometry.  Coordinates are in [lon, lat] order, and are a single
+// position for a Point or a list of linear rings for a Polygon.
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// The number of sides of the polygon used to approximate a query region
+const geojsonCircleSides = 32
+
+// The value of the "role" property of the feature describing the query region
+const geojsonRoleQueryBoundary = "query_boundary"
+
+// Return the point reached by travelling the specified distance along the
+// specified initial bearing (in degrees clockwise from north) from a point
+func destinationPoint(lat float64, lon float64, bearingDegrees float64, distanceMeters float64) (lat2 float64, lon2 float64) {
+	R := earthRadiusMeters()
+	phi1 := lat * math.Pi / 180
+	lambda1 := lon * math.Pi / 180
+	theta := bearingDegrees * math.Pi / 180
+	delta := distanceMeters / R
+	phi2 := math.Asin(math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(theta))
+	lambda2 := lambda1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(phi1), math.Cos(delta)-math.Sin(phi1)*math.Sin(phi2))
+	lat2 = phi2 * 180 / math.Pi
+	lon2 = math.Mod(lambda2*180/math.Pi+540, 360) - 180
+	return
+}
+
+// Return a GeoJSON polygon feature approximating the circular query region, so
+// that map clients can draw the queried area without recomputing its geometry
+func geojsonQueryBoundary(lat float64, lon float64, radiusMeters float64) (f GeoJSONFeature) {
+	ring := [][]float64{}
+	for i := 0; i < geojsonCircleSides; i++ {
+		pointLat, pointLon := destinationPoint(lat, lon, float64(i)*360/geojsonCircleSides, radiusMeters)
+		ring = append(ring, []float64{pointLon, pointLat})
+	}
+	ring = append(ring, ring[0])
+	f.Type = "Feature"
+	f.Geometry.Type = "Polygon"
+	f.Geometry.Coordinates = [][][]float64{ring}
+	f.Properties = map[string]interface{}{
+		"role":          geojsonRoleQueryBoundary,
+		"lat":           lat,
+		"lon":           lon,
+		"radius_meters": radiusMeters,
+	}
+	return
+}
+
+// Return a GeoJSON point feature describing a device's latest reading
+func geojsonDeviceFeature(e RadnoteEvent) (f GeoJSONFeature) {
+	f.Type = "Feature"
+	f.Geometry.Type = "Point"
+	f.Geometry.Coordinates = []float64{e.Event.BestLon, e.Event.BestLat}
+	f.Properties = map[string]interface{}{
+		"device_uid":  e.Event.DeviceUID,
+		"when":        e.Event.When,
+		"usv":         e.Body.Usv,
+		"cpm":         e.Body.Cpm,
+		"temperature": e.Body.TemperatureC,
+	}
+	for metric, value := range e.Metrics {
+		if _, exists := f.Properties[metric]; !exists {
+			f.Properties[metric] = value
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// A region query with format=geojson is a FeatureCollection of the query
+// boundary followed by a point for each device in the region
+func TestRegionGeoJSON(t *testing.T) {
+	testService(t, Config{})
+
+	readings := []interface{}{
+		testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1, "cpm": 12.0}),
+		testReading("dev:2", 1700000000, 42.101, -71.101, map[string]interface{}{"usv": 0.2}),
+		testReading("dev:3", 1700000000, 48.8, 2.3, map[string]interface{}{"usv": 0.3}),
+	}
+	w := testPost(t, readings)
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest readings: got %d", w.Code)
+	}
+
+	w = testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&format=geojson")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("Content-Type") != "application/geo+json" {
+		t.Errorf("Content-Type: got %q", w.Header().Get("Content-Type"))
+	}
+	fc := GeoJSONFeatureCollection{}
+	err := json.Unmarshal(w.Body.Bytes(), &fc)
+	if err != nil {
+		t.Fatalf("response doesn't parse as GeoJSON: %s", err)
+	}
+	if fc.Type != "FeatureCollection" {
+		t.Errorf("type: got %q, want FeatureCollection", fc.Type)
+	}
+	if len(fc.Features) != 3 {
+		t.Fatalf("got %d features, want the boundary and 2 devices", len(fc.Features))
+	}
+
+	boundary := fc.Features[0]
+	if boundary.Geometry.Type != "Polygon" || boundary.Properties["role"] != geojsonRoleQueryBoundary {
+		t.Errorf("first feature isn't the query boundary: %v", boundary)
+	}
+	rings, _ := boundary.Geometry.Coordinates.([]interface{})
+	if len(rings) != 1 {
+		t.Fatalf("boundary has %d rings, want 1", len(rings))
+	}
+	ring, _ := rings[0].([]interface{})
+	if len(ring) != geojsonCircleSides+1 || !testJSONEqual(ring[0], ring[len(ring)-1]) {
+		t.Errorf("boundary ring isn't closed with %d positions", geojsonCircleSides+1)
+	}
+
+	devices := map[string][]interface{}{}
+	for _, f := range fc.Features[1:] {
+		if f.Type != "Feature" || f.Geometry.Type != "Point" {
+			t.Errorf("device feature isn't a point: %v", f)
+		}
+		deviceUID, _ := f.Properties["device_uid"].(string)
+		devices[deviceUID], _ = f.Geometry.Coordinates.([]interface{})
+	}
+	position := devices["dev:1"]
+	if len(position) != 2 || position[0] != -71.1 || position[1] != 42.1 {
+		t.Errorf("dev:1 position: got %v, want [-71.1 42.1]", position)
+	}
+	if _, exists := devices["dev:2"]; !exists {
+		t.Errorf("dev:2 isn't a feature")
+	}
+
+	// Without a format the response is still a JSON feed
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if content["count"] != float64(2) {
+		t.Errorf("JSON feed count: got %v, want 2", content["count"])
+	}
+}
+
+// Determine whether two values marshal to the same JSON
+func testJSONEqual(a interface{}, b interface{}) bool {
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return string(aJSON) == string(bJSON)
+}
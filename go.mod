@@ -1,8 +1,20 @@
 module github.com/blues/geofeeds
 
-go 1.21.7
+go 1.24
 
 require (
-	github.com/blues/note-go v1.7.1 // indirect
-	github.com/kr/jsonfeed v0.1.1 // indirect
+	github.com/blues/note-go v1.7.1
+	github.com/kr/jsonfeed v0.1.1
+	github.com/prometheus/client_golang v1.18.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions/v2 v2.0.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.45.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -0,0 +1,254 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/blues/note-go/note"
+)
+
+// The file in which each device's past readings are retained
+var radnoteHistoryFile = "radnote-history.json"
+
+// The number of readings retained per device, unless configured
+const historyDefaultMaxPerDevice = 100
+
+// Past readings of each tenant's devices, oldest first, keyed by tenant and then
+// by device UID, protected by radLock
+var radHistory = map[string]map[string][]RadnoteEvent{}
+
+// Return the maximum number of readings retained per device
+func historyMaxPerDevice() int {
+	if config().HistoryMaxPerDevice > 0 {
+		return config().HistoryMaxPerDevice
+	}
+	return historyDefaultMaxPerDevice
+}
+
+// Return the name of the history file of a tenant, within the data directory
+func tenantHistoryFile(tenant string) string {
+	if tenant == "" {
+		return radnoteHistoryFile
+	}
+	return strings.TrimSuffix(radnoteHistoryFile, ".json") + "." + tenant + ".json"
+}
+
+// The version of the history file format written by this version of the service.
+// Version 1 is a map of device UID to its readings, which was rewritten in full
+// whenever it was persisted.  Version 2 is a log: a header line carrying the
+// version, followed by a line per reading, to which readings are appended as
+// they are persisted.
+const historyFileVersion = 2
+
+// A history log is compacted, by rewriting it with just the retained readings,
+// once it holds this many times as many readings as are retained
+const historyCompactFactor = 2
+
+// The header line of a history log
+type historyFileHeader struct {
+	Version int `json:"version"`
+}
+
+// Readings recorded in each tenant's history that haven't yet been appended to
+// its log, in the order they were recorded, protected by radLock
+var radHistoryUnlogged = map[string][]RadnoteEvent{}
+
+// The number of readings in each tenant's history log, protected by radLock.  A
+// tenant without an entry has no log that can be appended to, because it doesn't
+// exist, is of an earlier version, or no longer reflects the history, and its
+// log is rewritten when next persisted.
+var radHistoryLogged = map[string]int{}
+
+// Load the history in a history file, returning an empty history if it doesn't
+// yet exist, along with the number of readings in its log or -1 if it must be
+// rewritten before it can be appended to.  A reading cut short on the last line
+// of the log, as by a crash while it was being appended, is ignored.
+func loadHistory(file string) (history map[string][]RadnoteEvent, logged int, err error) {
+	history = map[string][]RadnoteEvent{}
+	logged = -1
+	contents, err := os.ReadFile(configDataDirectory + file)
+	if err == nil {
+		logged, err = unmarshalHistoryFile(contents, history)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		slog.Error("can't load history", "file", file, "error", err)
+		return nil, -1, err
+	}
+	return history, logged, nil
+}
+
+// Unmarshal the readings of a history file of any version into a history,
+// returning the number of readings in its log or -1 if it must be rewritten
+func unmarshalHistoryFile(contents []byte, history map[string][]RadnoteEvent) (logged int, err error) {
+	header := struct {
+		Version *int `json:"version"`
+	}{}
+	first, rest, _ := bytes.Cut(contents, []byte("\n"))
+	err = json.Unmarshal(first, &header)
+	if err != nil || header.Version == nil {
+		legacy := map[string][]RadnoteEvent{}
+		err = note.JSONUnmarshal(contents, &legacy)
+		if err != nil {
+			return -1, err
+		}
+		for _, readings := range legacy {
+			for _, e := range readings {
+				historyInsert(history, e)
+			}
+		}
+		return -1, nil
+	}
+	if *header.Version != historyFileVersion {
+		return -1, fmt.Errorf("history file version %d isn't supported by this version, which supports %d", *header.Version, historyFileVersion)
+	}
+	lines := bytes.Split(bytes.TrimRight(rest, "\n"), []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		e := RadnoteEvent{}
+		err = note.JSONUnmarshal(line, &e)
+		if err != nil && i == len(lines)-1 {
+			slog.Warn("ignoring incomplete history reading", "error", err)
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		historyInsert(history, e)
+		logged++
+	}
+	return logged, nil
+}
+
+// Marshal readings as lines of a history log, preceded by its header if the log
+// is being rewritten
+func marshalHistoryLog(readings []RadnoteEvent, header bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if header {
+		err := enc.Encode(historyFileHeader{Version: historyFileVersion})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range readings {
+		err := enc.Encode(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Return the number of a tenant's retained readings.  The caller must hold
+// radLock.
+func historyRetained(tenant string) (count int) {
+	for _, deviceReadings := range radHistory[tenant] {
+		count += len(deviceReadings)
+	}
+	return
+}
+
+// Return all of a tenant's retained readings.  The caller must hold radLock.
+func historyReadings(tenant string) (readings []RadnoteEvent) {
+	for _, deviceReadings := range radHistory[tenant] {
+		readings = append(readings, deviceReadings...)
+	}
+	return
+}
+
+// Record a reading in its device's history, and note that it is yet to be
+// appended to the tenant's log.  The caller must hold radLock.
+func historyAppend(tenant string, e RadnoteEvent) {
+	history := radHistory[tenant]
+	if history == nil {
+		history = map[string][]RadnoteEvent{}
+		radHistory[tenant] = history
+	}
+	historyInsert(history, e)
+	radHistoryUnlogged[tenant] = append(radHistoryUnlogged[tenant], e)
+}
+
+// Insert a reading into its device's history, in order of When, discarding the
+// oldest readings beyond the per-device maximum
+func historyInsert(history map[string][]RadnoteEvent, e RadnoteEvent) {
+	readings := history[e.Event.DeviceUID]
+	i := sort.Search(len(readings), func(i int) bool {
+		return readings[i].Event.When > e.Event.When
+	})
+	readings = append(readings, RadnoteEvent{})
+	copy(readings[i+1:], readings[i:])
+	readings[i] = e
+	max := historyMaxPerDevice()
+	if len(readings) > max {
+		readings = append([]RadnoteEvent{}, readings[len(readings)-max:]...)
+	}
+	history[e.Event.DeviceUID] = readings
+}
+
+// Replace a tenant's history with one loaded from its history file, whose log
+// holds the specified number of readings or -1 if it must be rewritten.  The
+// caller must hold radLock.
+func historyLoaded(tenant string, history map[string][]RadnoteEvent, logged int) {
+	radHistory[tenant] = history
+	historyRewrite(tenant)
+	if logged >= 0 {
+		radHistoryLogged[tenant] = logged
+	}
+}
+
+// Forget a tenant's history log, so that it is rewritten when next persisted,
+// as when readings have been removed from the history.  The caller must hold
+// radLock.
+func historyRewrite(tenant string) {
+	delete(radHistoryLogged, tenant)
+	delete(radHistoryUnlogged, tenant)
+}
+
+// History handler, returning a device's retained readings, oldest first
+func httpRadnoteHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Make sure the data is available
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	if !ensureQueryable(w) {
+		return
+	}
+
+	deviceUID := r.URL.Query().Get("device")
+	if deviceUID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("device must be specified"))
+		return
+	}
+
+	radLock.RLock()
+	readings := append([]RadnoteEvent{}, deviceReadings(tenant, deviceUID)...)
+	radLock.RUnlock()
+
+	o := map[string]interface{}{}
+	o["device"] = deviceUID
+	o["readings"] = readings
+	historyJSON, err := json.MarshalIndent(o, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(historyJSON)
+
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// Return the lines of a tenant's history file
+func testHistoryLines(t *testing.T, tenant string) [][]byte {
+	t.Helper()
+	contents, err := os.ReadFile(configDataDirectory + tenantHistoryFile(tenant))
+	if err != nil {
+		t.Fatalf("can't read history file: %s", err)
+	}
+	return bytes.Split(bytes.TrimRight(contents, "\n"), []byte("\n"))
+}
+
+// Return the uSv readings retained for a device of the default tenant
+func testHistoryUsv(deviceUID string) (usv []float64) {
+	radLock.RLock()
+	defer radLock.RUnlock()
+	for _, e := range radHistory[""][deviceUID] {
+		usv = append(usv, e.Body.Usv)
+	}
+	return
+}
+
+// Readings are appended to the history log as they are persisted, and the log is
+// compacted once it holds too many readings that are no longer retained, so that
+// it always reloads to the retained history
+func TestHistoryLogAppendAndCompact(t *testing.T) {
+	testService(t, Config{HistoryMaxPerDevice: 3})
+
+	for i := 0; i < 10; i++ {
+		w := testPost(t, testReading("dev:1", 1700000000+int64(i)*60, 42.1, -71.1, map[string]interface{}{"usv": float64(i)}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("can't ingest reading %d: got %d", i, w.Code)
+		}
+		lines := testHistoryLines(t, "")
+		header := historyFileHeader{}
+		err := json.Unmarshal(lines[0], &header)
+		if err != nil || header.Version != historyFileVersion {
+			t.Fatalf("after reading %d: history file header is %s", i, lines[0])
+		}
+		if len(lines)-1 > historyCompactFactor*3 {
+			t.Fatalf("after reading %d: history log holds %d readings, more than %d times the 3 retained", i, len(lines)-1, historyCompactFactor)
+		}
+		if i == 1 && len(lines)-1 != 2 {
+			t.Fatalf("after reading %d: history log holds %d readings, want 2", i, len(lines)-1)
+		}
+	}
+
+	want := []float64{7, 8, 9}
+	history, _, err := loadHistory(tenantHistoryFile(""))
+	if err != nil {
+		t.Fatalf("can't load history: %s", err)
+	}
+	got := []float64{}
+	for _, e := range history["dev:1"] {
+		got = append(got, e.Body.Usv)
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("reloaded history: got %v, want %v", got, want)
+	}
+}
+
+// A history file in the unversioned format, a map of device UID to readings, is
+// loaded and rewritten as a log when next persisted
+func TestHistoryLoadLegacy(t *testing.T) {
+	testService(t, Config{})
+	legacy := map[string][]RadnoteEvent{
+		"dev:1": {
+			{Event: testReading("dev:1", 1700000000, 42.1, -71.1, nil), Body: RadnoteEventBody{Usv: 0.1}},
+			{Event: testReading("dev:1", 1700000060, 42.1, -71.1, nil), Body: RadnoteEventBody{Usv: 0.2}},
+		},
+	}
+	legacyJSON, _ := json.Marshal(legacy)
+	err := os.WriteFile(configDataDirectory+tenantHistoryFile(""), legacyJSON, 0644)
+	if err != nil {
+		t.Fatalf("can't write history file: %s", err)
+	}
+	radLock.Lock()
+	radnoteEvents = nil
+	radLock.Unlock()
+	err = ensureLoaded()
+	if err != nil {
+		t.Fatalf("can't load legacy history: %s", err)
+	}
+	if got := testHistoryUsv("dev:1"); len(got) != 2 || got[0] != 0.1 || got[1] != 0.2 {
+		t.Fatalf("legacy history: got %v, want [0.1 0.2]", got)
+	}
+
+	w := testPost(t, testReading("dev:1", 1700000120, 42.1, -71.1, map[string]interface{}{"usv": 0.3}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	lines := testHistoryLines(t, "")
+	if len(lines) != 4 {
+		t.Fatalf("rewritten history log has %d lines, want a header and 3 readings", len(lines))
+	}
+	history, logged, err := loadHistory(tenantHistoryFile(""))
+	if err != nil || logged != 3 || len(history["dev:1"]) != 3 {
+		t.Errorf("rewritten history: got %d readings, %d logged, error %v, want 3 readings logged", len(history["dev:1"]), logged, err)
+	}
+}
+
+// A reading cut short at the end of the log is ignored, and the log rewritten,
+// while a file of an unknown version isn't loaded
+func TestHistoryLoadDamaged(t *testing.T) {
+	testService(t, Config{})
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	path := configDataDirectory + tenantHistoryFile("")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("can't open history file: %s", err)
+	}
+	_, _ = f.Write([]byte(`{"event":{"device":"dev:1","wh`))
+	_ = f.Close()
+
+	history, logged, err := loadHistory(tenantHistoryFile(""))
+	if err != nil || len(history["dev:1"]) != 1 || logged != -1 {
+		t.Errorf("torn history: got %d readings, %d logged, error %v, want 1 reading and a rewrite", len(history["dev:1"]), logged, err)
+	}
+
+	err = os.WriteFile(path, []byte("{\"version\":99}\n"), 0644)
+	if err != nil {
+		t.Fatalf("can't write history file: %s", err)
+	}
+	_, _, err = loadHistory(tenantHistoryFile(""))
+	if err == nil {
+		t.Errorf("history file of an unknown version was loaded")
+	}
+}
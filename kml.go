@@ -0,0 +1,86 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The KML namespace
+const kmlNamespace = "http://www.opengis.net/kml/2.2"
+
+// The content type of KML documents
+const kmlContentType = "application/vnd.google-earth.kml+xml"
+
+// A KML document
+type KML struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Document KMLDocument `xml:"Document"`
+}
+
+// A KML Document, containing a placemark per device
+type KMLDocument struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	Placemarks  []KMLPlacemark `xml:"Placemark"`
+}
+
+// A KML Placemark
+type KMLPlacemark struct {
+	Name        string   `xml:"name"`
+	Description string   `xml:"description"`
+	TimeStamp   string   `xml:"TimeStamp>when,omitempty"`
+	Point       KMLPoint `xml:"Point"`
+}
+
+// A KML Point, whose coordinates are "lon,lat"
+type KMLPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// Return a KML placemark describing a device's reading
+func kmlDevicePlacemark(e RadnoteEvent) (p KMLPlacemark) {
+	p.Name = e.Event.DeviceUID
+	p.Description = fmt.Sprintf("%s uSv/h, %s CPM", strconv.FormatFloat(e.Body.Usv, 'f', -1, 64), strconv.FormatFloat(e.Body.Cpm, 'f', -1, 64))
+	if e.Event.When != 0 {
+		p.TimeStamp = time.Unix(e.Event.When, 0).UTC().Format(time.RFC3339)
+	}
+	p.Point.Coordinates = strconv.FormatFloat(e.Event.BestLon, 'f', -1, 64) + "," + strconv.FormatFloat(e.Event.BestLat, 'f', -1, 64)
+	return
+}
+
+// Write a KML document with a placemark per located event
+func writeKML(w http.ResponseWriter, name string, description string, events []RadnoteEvent, timing *serverTiming) {
+
+	doc := KML{Xmlns: kmlNamespace}
+	doc.Document.Name = name
+	doc.Document.Description = description
+	for _, e := range events {
+		if e.Event.BestLat == 0 && e.Event.BestLon == 0 {
+			continue
+		}
+		doc.Document.Placemarks = append(doc.Document.Placemarks, kmlDevicePlacemark(e))
+	}
+
+	kmlXML, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		slog.Error("can't marshal kml", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	timing.mark("serialize")
+	timing.writeHeader(w)
+
+	w.Header().Set("Content-Type", kmlContentType)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(kmlXML)
+
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Parse a KML response, failing the test unless it is well-formed
+func testKML(t *testing.T, target string) (doc KML) {
+	t.Helper()
+	w := testGet(target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d, want %d", target, w.Code, http.StatusOK)
+	}
+	if w.Header().Get("Content-Type") != kmlContentType {
+		t.Errorf("%s: Content-Type %q, want %q", target, w.Header().Get("Content-Type"), kmlContentType)
+	}
+	d := xml.NewDecoder(strings.NewReader(w.Body.String()))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s: KML isn't well-formed: %s", target, err)
+		}
+	}
+	err := xml.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("%s: KML doesn't parse: %s", target, err)
+	}
+	if doc.XMLName.Space != kmlNamespace || doc.XMLName.Local != "kml" {
+		t.Errorf("%s: root is %v, want kml in %s", target, doc.XMLName, kmlNamespace)
+	}
+	return
+}
+
+// A region's KML has a placemark per device in the region, and the full list's
+// one per located device, each at the device's location
+func TestKMLPlacemarks(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:2", 1700000000, 42.101, -71.1, map[string]interface{}{"usv": 0.2})
+	testPostReading(t, "dev:<3>&", 1700000000, 42.1, -71.101, map[string]interface{}{"usv": 0.3})
+	testPostReading(t, "dev:far", 1700000000, 48.8, 2.3, map[string]interface{}{"usv": 0.4})
+	testPostReading(t, "dev:unlocated", 1700000000, 0, 0, map[string]interface{}{"usv": 0.5})
+
+	doc := testKML(t, "/radiation?lat=42.1&lon=-71.1&radius_meters=1000&format=kml")
+	if len(doc.Document.Placemarks) != 3 {
+		t.Errorf("region: got %d placemarks, want 3", len(doc.Document.Placemarks))
+	}
+	for _, p := range doc.Document.Placemarks {
+		if p.Name == "dev:1" && (p.Point.Coordinates != "-71.1,42.1" || !strings.Contains(p.Description, "0.1 uSv/h")) {
+			t.Errorf("dev:1: got %+v", p)
+		}
+		if p.Name == "dev:far" {
+			t.Errorf("region includes a device outside it")
+		}
+	}
+
+	doc = testKML(t, "/radiation?format=kml")
+	names := map[string]bool{}
+	for _, p := range doc.Document.Placemarks {
+		names[p.Name] = true
+	}
+	if len(doc.Document.Placemarks) != 4 || !names["dev:<3>&"] || names["dev:unlocated"] {
+		t.Errorf("full list: got placemarks %v, want the 4 located devices", names)
+	}
+}
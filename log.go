@@ -0,0 +1,31 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Log levels that may be configured
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// The level below which messages aren't logged, which may be changed while running
+var logLevel = new(slog.LevelVar)
+
+// Log structured messages to stdout, at the configured level or info by default
+func logConfigure() {
+	level, known := logLevels[config().LogLevel]
+	if !known {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A log handler that captures the records logged, with their attributes
+type testLogHandler struct {
+	lock    *sync.Mutex
+	records *[]slog.Record
+}
+
+// Capture records at every level
+func (h testLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+// Capture a record
+func (h testLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	*h.records = append(*h.records, r.Clone())
+	return nil
+}
+
+// Ignore attributes added by loggers, capturing only those of records
+func (h testLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+// Ignore groups
+func (h testLogHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// Capture what is logged for the rest of the test, returning a function that
+// returns the records logged so far
+func testCaptureLog(t *testing.T) func() []slog.Record {
+	h := testLogHandler{lock: &sync.Mutex{}, records: &[]slog.Record{}}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return func() []slog.Record {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		return append([]slog.Record{}, *h.records...)
+	}
+}
+
+// Return the value of a record's attribute, and whether it has it
+func testLogAttr(r slog.Record, key string) (value slog.Value, found bool) {
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			value = a.Value
+			found = true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// A body that can't be parsed is logged as an error, with the parse error and
+// the body as structured fields
+func TestLogBadBody(t *testing.T) {
+	testService(t, Config{})
+	logged := testCaptureLog(t)
+
+	w := testServe(httptest.NewRequest(http.MethodPost, "/radnote", strings.NewReader(`{"device":`)))
+	if w.Code == http.StatusOK {
+		t.Fatalf("bad body was accepted")
+	}
+
+	var parseError *slog.Record
+	for _, r := range logged() {
+		if r.Level == slog.LevelError && r.Message == "can't parse posted event" {
+			parseError = &r
+		}
+	}
+	if parseError == nil {
+		t.Fatalf("no error was logged: %v", logged())
+	}
+	if value, found := testLogAttr(*parseError, "error"); !found || value.String() == "" {
+		t.Errorf("logged error lacks an error field")
+	}
+	if value, found := testLogAttr(*parseError, "body"); !found || value.String() != `{"device":` {
+		t.Errorf("logged error lacks the body: got %q", value.String())
+	}
+}
+
+// A query of an empty region logs just the query and the number of devices,
+// rather than dumping the devices
+func TestLogEmptyRegion(t *testing.T) {
+	testService(t, Config{})
+	for i := 0; i < 10; i++ {
+		testPostReading(t, fmt.Sprintf("dev:%d", i), 1700000000, 48.8, 2.3, map[string]interface{}{"usv": 0.1})
+	}
+	logged := testCaptureLog(t)
+
+	w := testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	notFound := 0
+	for _, r := range logged() {
+		text := r.Message
+		r.Attrs(func(a slog.Attr) bool {
+			text += " " + a.String()
+			return true
+		})
+		if strings.Contains(text, "dev:") {
+			t.Errorf("device dumped to the log: %s", text)
+		}
+		if r.Message != "region not found" {
+			continue
+		}
+		notFound++
+		if r.Level != slog.LevelDebug {
+			t.Errorf("empty region logged at %s, want debug", r.Level)
+		}
+		if devices, _ := testLogAttr(r, "devices"); devices.Int64() != 10 {
+			t.Errorf("devices: got %v, want 10", devices)
+		}
+		if lat, _ := testLogAttr(r, "lat"); lat.Float64() != 42.1 {
+			t.Errorf("lat: got %v, want 42.1", lat)
+		}
+	}
+	if notFound != 1 {
+		t.Errorf("empty region logged %d times, want once", notFound)
+	}
+}
@@ -6,13 +6,22 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Main service entry point
@@ -20,24 +29,173 @@ func main() {
 
 	// Load configuration
 	configLoad()
+	logConfigure()
 
-	// Register root endpoint
-	http.HandleFunc("/", httpRootHandler)
+	// Load the data, after a random delay if configured so that many instances
+	// restarting together don't all read shared storage at the same moment
+	if config().StartupJitterMs > 0 {
+		time.Sleep(time.Duration(rand.Intn(config().StartupJitterMs)) * time.Millisecond)
+	}
+	_ = ensureLoaded()
+
+	// Serve HTTP requests
+	httpServer = &http.Server{
+		Addr:              configListenAddr,
+		Handler:           gzipHandler(corsHandler(rateLimitHandler(recoverHandler(newRouter())))),
+		ReadTimeout:       configSeconds(config().ReadTimeoutSecs, defaultReadTimeoutSecs),
+		ReadHeaderTimeout: configSeconds(config().ReadHeaderTimeoutSecs, defaultReadHeaderTimeoutSecs),
+		WriteTimeout:      configSeconds(config().WriteTimeoutSecs, defaultWriteTimeoutSecs),
+		IdleTimeout:       configSeconds(config().IdleTimeoutSecs, defaultIdleTimeoutSecs),
+		Protocols:         serverProtocols(),
+	}
+	go func() { _ = httpServer.ListenAndServe() }()
+
+	// Spawn the flusher that writes the data when persistence is debounced
+	if config().PersistIntervalMs > 0 {
+		go radFlusher()
+	}
+
+	// Spawn the probe that verifies the data directory remains writable
+	if config().DiskProbeEnabled {
+		go diskProbe()
+	}
 
-	// Register AWS health check endpoint
-	http.HandleFunc("/ping", httpPingHandler)
-	go func() { _ = http.ListenAndServe(":80", nil) }()
+	// Spawn the sweeper that forgets devices that have stopped reporting
+	if config().RetentionDays > 0 {
+		go retentionSweeper()
+	}
 
-	// Register radiation endpoint
-	http.HandleFunc("/radnote", httpRadnoteHandler)
-	http.HandleFunc("/radiation", httpRadiationHandler)
+	// Spawn the periodic snapshot writer
+	if config().SnapshotDirectory != "" && config().SnapshotIntervalSecs > 0 {
+		go snapshotWriter()
+	}
 
 	// Spawn our signal handler
 	go signalHandler()
 
-	// Handle console input so we can manually quit and relaunch
-	inputHandler()
+	// Handle console input so we can manually quit and relaunch.  If there is no
+	// console, keep serving until we're signalled to exit.
+	inputHandler(os.Stdin)
+	select {}
+
+}
+
+// The protocols served.  HTTP/1.1 is always served, and HTTP/2 may be enabled so
+// that clients polling many feeds in parallel can multiplex them over a single
+// connection.  Because we listen in plaintext, typically behind a proxy that
+// terminates TLS, HTTP/2 is served as h2c.
+func serverProtocols() *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	if config().HTTP2Enabled {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return protocols
+}
+
+// The HTTP server
+var httpServer *http.Server
+
+// How long in-flight requests are given to complete when shutting down
+const shutdownTimeout = 30 * time.Second
+
+// Shut down gracefully, by letting in-flight requests complete, then writing
+// any buffered data, and exiting
+func shutdown() {
+	drain()
+	os.Exit(0)
+}
+
+// Stop accepting requests, wait for those in flight to complete, and write any
+// buffered data.  Streams never complete by themselves, so they are closed.
+func drain() {
+	if httpServer != nil {
+		httpServer.RegisterOnShutdown(streamShutdown)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := httpServer.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			slog.Error("can't shut down server", "error", err)
+		}
+	}
+	err := flushNow()
+	if err != nil {
+		slog.Error("can't flush data on shutdown", "error", err)
+	}
+}
+
+// Create the router for all endpoints.  Endpoints of features that have been
+// disabled in the config aren't registered at all, so they fall through to the
+// root handler and return 501.
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Register root endpoint
+	mux.HandleFunc("/", httpRootHandler)
+
+	// Register AWS health check endpoints
+	mux.HandleFunc("/ping", httpPingHandler)
+	mux.HandleFunc("/health", httpHealthHandler)
+	mux.HandleFunc("/version", httpVersionHandler)
+
+	// Register the Prometheus metrics endpoint
+	mux.Handle("/metrics", promhttp.Handler())
+	if featureEnabled(featureReady) {
+		mux.HandleFunc("/ready", httpReadyHandler)
+	}
+
+	// Register radiation endpoints.  Readings are POSTed by Notehub routes to
+	// /radnote, while /radiation is the query-only endpoint that serves the stored
+	// readings and region feeds, and refuses other methods with a 405.
+	if featureEnabled(featureIngest) {
+		mux.HandleFunc("/radnote", httpRadnoteHandler)
+	}
+	if featureEnabled(featureSummary) {
+		mux.HandleFunc("/radnote/summary", httpRadnoteSummaryHandler)
+	}
+	if featureEnabled(featureHistory) {
+		mux.HandleFunc("/radnote/history", httpRadnoteHistoryHandler)
+	}
+	if featureEnabled(featureDevices) {
+		mux.HandleFunc("/radnote/devices", httpRadnoteDevicesHandler)
+	}
+	if featureEnabled(featureRadiation) {
+		mux.HandleFunc("/radiation", httpRadiationHandler)
+	}
+	if featureEnabled(featureStream) {
+		mux.HandleFunc("/radnote/stream", httpRadnoteStreamHandler)
+	}
+	if featureEnabled(featureAlerts) {
+		mux.HandleFunc("/alerts", httpAlertsHandler)
+	}
+
+	// Register utility endpoints
+	if featureEnabled(featureDistance) {
+		mux.HandleFunc("/distance", httpDistanceHandler)
+	}
+
+	return mux
+}
 
+// Wrap a handler so that a panic while serving a request is logged along with the
+// request's path and answered with a 500, rather than dropping the connection.
+// A deliberate http.ErrAbortHandler panic is passed through.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			slog.Error("panic serving request", "method", r.Method, "path", r.URL.Path, "panic", p, "stack", string(debug.Stack()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
 }
 
 // Root handler
@@ -49,25 +207,60 @@ func httpRootHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotImplemented)
 }
 
-// Ping handler, for AWS health checks
+// Ping handler, for AWS health checks, which also identifies the running version
 func httpPingHandler(w http.ResponseWriter, r *http.Request) {
-	_, _ = w.Write([]byte(time.Now().UTC().Format("2006-01-02T15:04:05Z")))
+	_, _ = w.Write([]byte(time.Now().UTC().Format("2006-01-02T15:04:05Z") + " " + Version))
 }
 
-func inputHandler() {
+// Console input handler, which returns when input is exhausted, such as when
+// running non-interactively with stdin closed
+func inputHandler(in io.Reader) {
 
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(in)
 
 	for {
 
-		scanner.Scan()
+		if !scanner.Scan() {
+			err := scanner.Err()
+			if err != nil {
+				slog.Error("console input error", "error", err)
+			} else {
+				slog.Info("console end of input")
+			}
+			return
+		}
 		message := scanner.Text()
 
 		args := strings.Split(message, " ")
 
 		switch args[0] {
 		case "q":
-			os.Exit(0)
+			shutdown()
+		case "migrate":
+			count, err := migrateRadFile(configDataDirectory+radFile, configDataDirectory+radnoteFile)
+			if err != nil {
+				fmt.Printf("migrate: %s\n", err)
+			} else {
+				fmt.Printf("migrate: %d devices migrated from %s to %s\n", count, radFile, radnoteFile)
+			}
+		case "snapshot":
+			count, err := writeSnapshot()
+			if err != nil {
+				fmt.Printf("snapshot: %s\n", err)
+			} else {
+				fmt.Printf("snapshot: %d devices written to %s\n", count, config().SnapshotDirectory)
+			}
+		case "query":
+			consoleQuery(args[1:])
+		case "stats":
+			consoleStats()
+		case "reload":
+			count, err := reloadData()
+			if err != nil {
+				fmt.Printf("reload: %s\n", err)
+			} else {
+				fmt.Printf("reload: %d devices loaded from %s\n", count, configDataDirectory)
+			}
 		case "":
 			// just re-prompt
 		default:
@@ -80,19 +273,81 @@ func inputHandler() {
 
 }
 
+// Console command reporting the primary metric's aggregates within a region of
+// the default tenant, given as lat, lon, and radius in meters
+func consoleQuery(args []string) {
+	if len(args) != 3 {
+		fmt.Printf("query: usage: query <lat> <lon> <radius_meters>\n")
+		return
+	}
+	lat, latErr := strconv.ParseFloat(args[0], 64)
+	lon, lonErr := strconv.ParseFloat(args[1], 64)
+	radiusMeters, radiusErr := strconv.ParseFloat(args[2], 64)
+	if latErr != nil || lonErr != nil || radiusErr != nil || math.IsNaN(lat) || lat < -90 || lat > 90 || math.IsNaN(lon) || lon < -180 || lon > 180 || !(radiusMeters > 0) {
+		fmt.Printf("query: lat, lon, and a positive radius in meters are required\n")
+		return
+	}
+	err := ensureLoaded()
+	if err != nil {
+		fmt.Printf("query: %s\n", err)
+		return
+	}
+	metric := primaryMetric()
+	samples, skipped, _ := scanRegion(context.Background(), "", lat, lon, radiusMeters, metric, 0, 0, config().LocationAccuracyPolicy)
+	agg := aggregateRegion(samples, config().LocationAccuracyPolicy, 0, 0)
+	fmt.Printf("query: %d readings within %gm of %f,%f\n", agg.Count, radiusMeters, lat, lon)
+	if agg.Count > 0 {
+		fmt.Printf("query: %s min %g max %g avg %g\n", metric, agg.Min, agg.Max, agg.Avg)
+	}
+	if skipped > 0 {
+		fmt.Printf("query: %d readings skipped for non-finite values\n", skipped)
+	}
+}
+
+// Console command reporting a snapshot of the service's devices and alerts
+func consoleStats() {
+	err := ensureLoaded()
+	if err != nil {
+		fmt.Printf("stats: %s\n", err)
+		return
+	}
+	stats := gatherServiceStats()
+	fmt.Printf("stats: %d devices, %d with a location\n", stats.Devices, stats.LocatedDevices)
+	if stats.Devices > 0 {
+		fmt.Printf("stats: oldest event %s, newest event %s\n", consoleTime(stats.OldestWhen), consoleTime(stats.NewestWhen))
+	}
+	fmt.Printf("stats: %d active alerts\n", stats.ActiveAlerts)
+}
+
+// Format a Unix time for the console
+func consoleTime(when int64) string {
+	return time.Unix(when, 0).UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// The signals handled by our app's signal handler.  SIGSEGV is deliberately left
+// to the runtime, so that a genuine memory fault crashes the process rather than
+// leaving it wedged.
+var handledSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP}
+
 // Our app's signal handler
 func signalHandler() {
 	ch := make(chan os.Signal, 100)
-	signal.Notify(ch, syscall.SIGTERM)
-	signal.Notify(ch, syscall.SIGINT)
-	signal.Notify(ch, syscall.SIGSEGV)
+	signal.Notify(ch, handledSignals...)
 	for {
 		switch <-ch {
 		case syscall.SIGINT:
-			fmt.Printf("*** Exiting because of SIGNAL \n")
-			os.Exit(0)
+			slog.Info("exiting", "signal", "SIGINT")
+			shutdown()
 		case syscall.SIGTERM:
-			return
+			slog.Info("exiting", "signal", "SIGTERM")
+			shutdown()
+		case syscall.SIGHUP:
+			changed, err := configReload()
+			if err != nil {
+				slog.Error("can't reload config", "path", configPath(), "error", err)
+				break
+			}
+			slog.Info("config reloaded", "path", configPath(), "changed", changed)
 		}
 	}
 }
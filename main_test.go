@@ -0,0 +1,450 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/blues/note-go/note"
+	"github.com/kr/jsonfeed"
+)
+
+// Reset the service to the state of one freshly started with the specified
+// config and an empty data directory, and load its data
+func testService(t testing.TB, c Config) {
+	t.Helper()
+
+	configDataDirectory = withTrailingSlash(t.TempDir())
+	configCurrent.Store(&c)
+
+	radLock.Lock()
+	radnoteEvents = nil
+	radTenantEvents = map[string]map[string]RadnoteEvent{}
+	radHistory = map[string]map[string][]RadnoteEvent{}
+	radHistoryUnlogged = map[string][]RadnoteEvent{}
+	radHistoryLogged = map[string]int{}
+	radGeohashIndex = map[string]map[string]map[string]bool{}
+	radUnlocated = map[string]map[string]bool{}
+	radUnpersisted = map[string]int{}
+	radWriting = map[string]bool{}
+	radWriteAgain = map[string]bool{}
+	radFlushPending = map[string]bool{}
+	radCoalesceUntil = map[string]time.Time{}
+	if radFlushTimer != nil {
+		radFlushTimer.Stop()
+		radFlushTimer = nil
+	}
+	radLock.Unlock()
+
+	dedupLock.Lock()
+	dedupSeen = map[string]time.Time{}
+	dedupLastSweep = time.Time{}
+	dedupLock.Unlock()
+
+	alertLock.Lock()
+	alertActive = map[string]radAlert{}
+	alertLock.Unlock()
+
+	streamLock.Lock()
+	streamSubscribers = map[*streamSubscriber]bool{}
+	streamClosing = false
+	streamLock.Unlock()
+
+	queryCacheLock.Lock()
+	queryCache = map[string]cachedResponse{}
+	queryCacheLock.Unlock()
+	listingETagLock.Lock()
+	listingETags = map[string]listingETag{}
+	listingETagLock.Unlock()
+
+	ingestRateLimiter = &rateLimiter{buckets: map[string]*rateBucket{}}
+	queryRateLimiter = &rateLimiter{buckets: map[string]*rateBucket{}}
+	persistLock.Lock()
+	persistFailing = map[string]error{}
+	persistHealthy.Store(true)
+	persistLock.Unlock()
+	radGeneration.Add(1)
+
+	err := ensureLoaded()
+	if err != nil {
+		t.Fatalf("can't load data: %s", err)
+	}
+}
+
+// Return a data reading taken by a device at a location, with the specified body
+// fields, or without a body if none are specified
+func testReading(deviceUID string, when int64, lat float64, lon float64, body map[string]interface{}) note.Event {
+	event := note.Event{DeviceUID: deviceUID, NotefileID: "_air.qo", When: when, BestLat: lat, BestLon: lon}
+	if body != nil {
+		event.Body = &body
+	}
+	return event
+}
+
+// Serve a request through the router
+func testServe(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// POST an event, or an array of events, to the ingest endpoint
+func testPost(t *testing.T, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("can't marshal request: %s", err)
+	}
+	return testServe(httptest.NewRequest(http.MethodPost, "/radnote", bytes.NewReader(body)))
+}
+
+// POST a reading, failing the test if it isn't accepted
+func testPostReading(t *testing.T, deviceUID string, when int64, lat float64, lon float64, body map[string]interface{}) {
+	t.Helper()
+	w := testPost(t, testReading(deviceUID, when, lat, lon, body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading of %s: got %d: %s", deviceUID, w.Code, w.Body.String())
+	}
+}
+
+// GET a path, with its query
+func testGet(target string) *httptest.ResponseRecorder {
+	return testServe(httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// Return the content of the first item of a JSON feed response, which is the
+// region's aggregate item
+func testFeedContent(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	feed := struct {
+		Items []struct {
+			ContentText string `json:"content_text"`
+		} `json:"items"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil || len(feed.Items) == 0 {
+		t.Fatalf("response isn't a JSON feed with items: %s", w.Body.String())
+	}
+	content := map[string]interface{}{}
+	err = json.Unmarshal([]byte(feed.Items[0].ContentText), &content)
+	if err != nil {
+		t.Fatalf("feed item content isn't JSON: %s", feed.Items[0].ContentText)
+	}
+	return content
+}
+
+// Return the IDs of the items of a JSON feed response, in order
+func testFeedItemIDs(t *testing.T, w *httptest.ResponseRecorder) (ids []string) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	feed := jsonfeed.Feed{}
+	err := json.Unmarshal(w.Body.Bytes(), &feed)
+	if err != nil {
+		t.Fatalf("response isn't a JSON feed: %s", w.Body.String())
+	}
+	for _, item := range feed.Items {
+		ids = append(ids, item.ID)
+	}
+	return
+}
+
+// Return the stored latest event of a device of the default tenant
+func testStored(deviceUID string) (e RadnoteEvent, exists bool) {
+	radLock.RLock()
+	defer radLock.RUnlock()
+	e, exists = tenantEvents("")[deviceUID]
+	return
+}
+
+// Console input that is closed, as when running without a terminal, ends the
+// input handler rather than leaving it spinning
+func TestInputHandlerEOF(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		inputHandler(strings.NewReader(""))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("input handler didn't return at the end of its input")
+	}
+}
+
+// Readings are POSTed to /radnote, while /radiation serves queries and refuses
+// other methods
+func TestRadnoteAndRadiationRoutes(t *testing.T) {
+	testService(t, Config{})
+
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Errorf("POST /radnote: got %d, want %d", w.Code, http.StatusOK)
+	}
+	w = testGet("/radiation")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "dev:1") {
+		t.Errorf("GET /radiation: got %d, %s", w.Code, w.Body.String())
+	}
+	w = testServe(httptest.NewRequest(http.MethodPost, "/radiation", strings.NewReader("{}")))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Errorf("POST /radiation: got %d with Allow %q, want %d", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed)
+	}
+}
+
+// Draining the server on shutdown lets a request in flight complete, closes open
+// streams, refuses new connections, and writes buffered readings
+func TestDrainCompletesInFlightRequests(t *testing.T) {
+	testService(t, Config{PersistIntervalMs: 60000})
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+
+	started := make(chan bool)
+	release := make(chan bool)
+	router := newRouter()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/radiation" {
+			close(started)
+			<-release
+		}
+		router.ServeHTTP(w, r)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	httpServer = &http.Server{Handler: handler}
+	defer func() { httpServer = nil }()
+	go func() { _ = httpServer.Serve(ln) }()
+
+	// A client streaming a region, which would otherwise never complete
+	rsp, err := http.Get("http://" + ln.Addr().String() + "/radnote/stream?lat=42.1&lon=-71.1&radius_meters=1000")
+	if err != nil {
+		t.Fatalf("can't open stream: %s", err)
+	}
+	defer rsp.Body.Close()
+	stream := bufio.NewReader(rsp.Body)
+	testStreamFrame(t, stream)
+
+	url := "http://" + ln.Addr().String() + "/radiation"
+	responses := make(chan int)
+	go func() {
+		rsp, err := http.Get(url)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		rsp.Body.Close()
+		responses <- rsp.StatusCode
+	}()
+	<-started
+
+	drained := make(chan bool)
+	go func() {
+		drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatalf("drain returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case status := <-responses:
+		if status != http.StatusOK {
+			t.Errorf("in-flight request: got %d, want %d", status, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("in-flight request didn't complete")
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("drain didn't return once the request completed")
+	}
+	_, err = io.ReadAll(stream)
+	if err != nil {
+		t.Errorf("stream wasn't closed cleanly: %s", err)
+	}
+
+	_, err = http.Get(url)
+	if err == nil {
+		t.Errorf("request accepted after draining")
+	}
+	if writeQueueDepth() != 0 {
+		t.Errorf("buffered readings weren't written: %d remain", writeQueueDepth())
+	}
+}
+
+// A handler that panics is answered with a 500, and the server goes on serving
+// other requests
+func TestRecoverHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		body["usv"] = 0.1
+	})
+	mux.HandleFunc("/ping", httpPingHandler)
+	server := httptest.NewServer(recoverHandler(mux))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		rsp, err := http.Get(server.URL + "/panic")
+		if err != nil {
+			t.Fatalf("panicking request failed: %s", err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("panicking request: got %d, want %d", rsp.StatusCode, http.StatusInternalServerError)
+		}
+		rsp, err = http.Get(server.URL + "/ping")
+		if err != nil {
+			t.Fatalf("server stopped serving after a panic: %s", err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Errorf("ping after a panic: got %d, want %d", rsp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+// The signal handler is subscribed only to the signals that shut down or reload
+// the config, leaving SIGSEGV to the runtime
+func TestHandledSignals(t *testing.T) {
+	want := map[os.Signal]bool{syscall.SIGTERM: true, syscall.SIGINT: true, syscall.SIGHUP: true}
+	if len(handledSignals) != len(want) {
+		t.Errorf("got %v, want SIGTERM, SIGINT, and SIGHUP", handledSignals)
+	}
+	for _, sig := range handledSignals {
+		if !want[sig] {
+			t.Errorf("subscribed to %s", sig)
+		}
+	}
+}
+
+// Drive the console input handler with a script, returning what it printed
+func testConsole(t *testing.T, script string) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("can't capture console output: %s", err)
+	}
+	output := make(chan string)
+	go func() {
+		printed, _ := io.ReadAll(r)
+		output <- string(printed)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	inputHandler(strings.NewReader(script))
+	os.Stdout = stdout
+	w.Close()
+	return <-output
+}
+
+// The console query command reports the aggregates of a region, and its usage
+// when its arguments are wrong
+func TestConsoleQuery(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.25})
+	testPostReading(t, "dev:2", 1700000000, 42.101, -71.1, map[string]interface{}{"usv": 0.5})
+	testPostReading(t, "dev:3", 1700000000, 42.1, -71.101, map[string]interface{}{"usv": 0.75})
+	testPostReading(t, "dev:far", 1700000000, 48.8, 2.3, map[string]interface{}{"usv": 5})
+
+	printed := testConsole(t, "query 42.1 -71.1 1000\nquery 42.1 -71.1\nquery 95 -71.1 1000\nquery 0.5 0.5 1000\n")
+	for _, want := range []string{
+		"query: 3 readings within 1000m of 42.100000,-71.100000\n",
+		"query: usv min 0.25 max 0.75 avg 0.5\n",
+		"query: usage: query <lat> <lon> <radius_meters>\n",
+		"query: lat, lon, and a positive radius in meters are required\n",
+		"query: 0 readings within 1000m of 0.500000,0.500000\n",
+	} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("console output lacks %q:\n%s", want, printed)
+		}
+	}
+	if strings.Count(printed, " min ") != 1 {
+		t.Errorf("aggregates printed for an empty region:\n%s", printed)
+	}
+}
+
+// The console stats command reports the devices, how many of them are located,
+// the span of their readings, and the active alerts
+func TestConsoleStats(t *testing.T) {
+	testService(t, Config{RadnoteAlertLevelUsv: 1, RadnoteAlertMins: 10})
+	printed := strings.TrimSuffix(testConsole(t, "stats\n"), "\n> ")
+	want := "stats: 0 devices, 0 with a location\nstats: 0 active alerts\n"
+	if printed != want {
+		t.Errorf("no devices: got %q, want %q", printed, want)
+	}
+
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:2", 1700000600, 42.2, -71.2, map[string]interface{}{"usv": 2.0})
+	testPostReading(t, "dev:unlocated", 1700000300, 0, 0, map[string]interface{}{"usv": 0.1})
+	printed = strings.TrimSuffix(testConsole(t, "stats\n"), "\n> ")
+	want = "stats: 3 devices, 2 with a location\n" +
+		"stats: oldest event 2023-11-14T22:13:20Z, newest event 2023-11-14T22:23:20Z\n" +
+		"stats: 1 active alerts\n"
+	if printed != want {
+		t.Errorf("got %q, want %q", printed, want)
+	}
+}
+
+// The console reload command replaces the devices in memory with those of a data
+// file written since it was loaded
+func TestConsoleReload(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:old", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+
+	events := map[string]RadnoteEvent{}
+	for i, deviceUID := range []string{"dev:restored1", "dev:restored2"} {
+		e := RadnoteEvent{Event: testReading(deviceUID, 1700000060, 42.1, -71.1+float64(i)/1000, nil)}
+		e.Body.Usv = 0.2
+		events[deviceUID] = e
+	}
+	contents, err := marshalDataFile(events)
+	if err == nil {
+		err = os.WriteFile(configDataDirectory+radnoteFile, contents, 0644)
+	}
+	if err != nil {
+		t.Fatalf("can't write data file: %s", err)
+	}
+
+	printed := testConsole(t, "reload\n")
+	want := "reload: 2 devices loaded from " + configDataDirectory + "\n"
+	if !strings.HasPrefix(printed, want) {
+		t.Errorf("got %q, want %q", printed, want)
+	}
+	if _, exists := testStored("dev:old"); exists {
+		t.Errorf("device absent from the data file survived the reload")
+	}
+	for deviceUID := range events {
+		if e, exists := testStored(deviceUID); !exists || e.Body.Usv != 0.2 {
+			t.Errorf("%s wasn't reloaded", deviceUID)
+		}
+	}
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if content["count"] != float64(2) {
+		t.Errorf("query after reload: got count %v, want 2", content["count"])
+	}
+}
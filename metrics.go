@@ -0,0 +1,103 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Queries served, by format, and how long they took
+var (
+	metricQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geofeeds_queries_total",
+		Help: "Queries served, by requested format.",
+	}, []string{"format"})
+	metricQueryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "geofeeds_query_duration_seconds",
+		Help:    "Time taken to serve queries.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// The formats by which queries are counted.  Others are counted as "other", so
+// that clients can't create arbitrarily many series.
+var metricQueryFormats = map[string]bool{
+	formatJSONFeed:     true,
+	formatGeoJSON:      true,
+	formatKML:          true,
+	formatAtom:         true,
+	exportFormatCSV:    true,
+	exportFormatNDJSON: true,
+}
+
+// Register the metrics.  The ingestion counters are those already maintained for
+// the summary, which are read when scraped.
+func init() {
+	counter := func(name string, help string, stat *atomic.Int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			return float64(stat.Load())
+		})
+	}
+	skipped := func(reason string, stat *atomic.Int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "geofeeds_events_skipped_total",
+			Help:        "Events received but not stored, by reason.",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, func() float64 {
+			return float64(stat.Load())
+		})
+	}
+	prometheus.MustRegister(
+		metricQueries,
+		metricQueryDuration,
+		counter("geofeeds_events_received_total", "Events received.", &statReceived),
+		counter("geofeeds_events_ingested_total", "Events stored as their device's latest reading.", &statStored),
+		skipped("not_data_reading", &statSkippedNotData),
+		skipped("older", &statSkippedOlder),
+		skipped("duplicate", &statSkippedDuplicate),
+		skipped("invalid", &statRejectedInvalid),
+		skipped("no_body", &statSkippedNoBody),
+		skipped("empty_body", &statSkippedEmptyBody),
+		skipped("backpressure", &statRejectedBackpressure),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "geofeeds_devices",
+			Help: "Devices that have reported, across all tenants.",
+		}, func() float64 {
+			return float64(gatherServiceStats().Devices)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "geofeeds_last_event_age_seconds",
+			Help: "Seconds since the When of the most recent reading of any device.",
+		}, func() float64 {
+			lastWhen := gatherServiceStats().NewestWhen
+			if lastWhen == 0 {
+				return 0
+			}
+			return float64(time.Now().UTC().Unix() - lastWhen)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "geofeeds_write_queue_depth",
+			Help: "Readings acknowledged but not yet written to disk, across all tenants.",
+		}, func() float64 {
+			return float64(writeQueueDepth())
+		}),
+	)
+}
+
+// Record that a query in the specified format, which is the default if empty,
+// has been served
+func metricQueryServed(format string, started time.Time) {
+	switch {
+	case format == "":
+		format = "default"
+	case !metricQueryFormats[format]:
+		format = "other"
+	}
+	metricQueries.WithLabelValues(format).Inc()
+	metricQueryDuration.Observe(time.Since(started).Seconds())
+}
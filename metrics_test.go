@@ -0,0 +1,41 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Scraping the metrics endpoint exposes the ingestion counters, the queries by
+// format and their latency, the device gauges, and the depth of the write queue
+func TestMetricsScrape(t *testing.T) {
+	testService(t, Config{PersistIntervalMs: 60000})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&format=geojson")
+
+	w := testGet("/metrics")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: got %d, want %d", w.Code, http.StatusOK)
+	}
+	scraped := w.Body.String()
+	for _, name := range []string{
+		"geofeeds_events_received_total ",
+		"geofeeds_events_ingested_total ",
+		`geofeeds_events_skipped_total{reason="not_data_reading"} `,
+		`geofeeds_events_skipped_total{reason="duplicate"} `,
+		`geofeeds_queries_total{format="geojson"} `,
+		"geofeeds_query_duration_seconds_bucket{",
+		"geofeeds_query_duration_seconds_count ",
+		"geofeeds_devices 1",
+		"geofeeds_last_event_age_seconds ",
+		"geofeeds_write_queue_depth 1",
+	} {
+		if !strings.Contains(scraped, "\n"+name) {
+			t.Errorf("scrape lacks %s", strings.TrimSpace(name))
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/blues/note-go/note"
+)
+
+// The version of the data file format written by this version of the service.
+// Version 1 is the bare map of device UID to RadnoteEvent that was written before
+// the format was versioned, and version 2 wraps that map in a dataFile envelope.
+const dataFileVersion = 2
+
+// A data file, holding the latest event of each device
+type dataFile struct {
+	Version int                     `json:"version"`
+	Events  map[string]RadnoteEvent `json:"events"`
+}
+
+// The upgrades of the events in a data file from each version to the next,
+// keyed by the version being upgraded from.  Upgrades work on the JSON so that
+// no field is lost by passing it through a struct that no longer has it.
+var dataFileUpgrades = map[int]func(events json.RawMessage) (json.RawMessage, error){
+	1: func(events json.RawMessage) (json.RawMessage, error) {
+		// Only the envelope was introduced
+		return events, nil
+	},
+}
+
+// Marshal events into the current data file format
+func marshalDataFile(events map[string]RadnoteEvent) ([]byte, error) {
+	return json.Marshal(dataFile{Version: dataFileVersion, Events: events})
+}
+
+// Unmarshal the events of a data file of any version, upgrading them to the
+// current format.  A file written by a newer version is refused rather than
+// loaded without the fields this version doesn't know about.
+func unmarshalDataFile(contents []byte) (events map[string]RadnoteEvent, err error) {
+	envelope := struct {
+		Version *int            `json:"version"`
+		Events  json.RawMessage `json:"events"`
+	}{}
+	err = json.Unmarshal(contents, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	version := 1
+	eventJSON := json.RawMessage(contents)
+	if envelope.Version != nil {
+		version = *envelope.Version
+		eventJSON = envelope.Events
+	}
+	if version < 1 || version > dataFileVersion {
+		return nil, fmt.Errorf("data file version %d isn't supported by this version, which supports up to %d", version, dataFileVersion)
+	}
+	for ; version < dataFileVersion; version++ {
+		eventJSON, err = dataFileUpgrades[version](eventJSON)
+		if err != nil {
+			return nil, fmt.Errorf("can't upgrade data file from version %d: %s", version, err)
+		}
+	}
+	if len(eventJSON) > 0 {
+		err = note.JSONUnmarshal(eventJSON, &events)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if events == nil {
+		events = map[string]RadnoteEvent{}
+	}
+	return events, nil
+}
+
+// The legacy flat form of a stored Radnote event, in which the body was reduced
+// to its uSv reading and, later, its numeric metrics
+type RadEvent struct {
+	Event           note.Event         `json:"event,omitempty"`
+	Usv             float64            `json:"usv,omitempty"`
+	Metrics         map[string]float64 `json:"metrics,omitempty"`
+	LocationSuspect bool               `json:"location_suspect,omitempty"`
+}
+
+// Convert a flat RadEvent, whose body was reduced to just its uSv reading, into
+// the canonical nested RadnoteEvent
+func radEventToRadnoteEvent(e RadEvent) (re RadnoteEvent) {
+	re.Event = e.Event
+	re.Event.Body = nil
+	re.Body.Usv = e.Usv
+	re.Body.Cpm = e.Metrics["cpm"]
+	re.Body.CpmCount = int(e.Metrics["cpm_count"])
+	re.Body.CpmCountSecs = int(e.Metrics["csecs"])
+	re.Body.TemperatureC = e.Metrics[temperatureMetric]
+	re.Body.Voltage = e.Metrics[voltageMetric]
+	re.Metrics = e.Metrics
+	re.LocationSuspect = e.LocationSuspect
+	return
+}
+
+// Read a data file in the old flat RadEvent format and rewrite it into the
+// canonical nested RadnoteEvent format, preserving readings and timestamps.  An
+// existing destination file is never overwritten.
+func migrateRadFile(oldPath string, newPath string) (count int, err error) {
+
+	_, err = os.Stat(newPath)
+	if err == nil {
+		return 0, fmt.Errorf("%s already exists", newPath)
+	}
+
+	contents, err := os.ReadFile(oldPath)
+	if err != nil {
+		return 0, err
+	}
+	oldEvents := map[string]RadEvent{}
+	err = note.JSONUnmarshal(contents, &oldEvents)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse %s: %s", oldPath, err)
+	}
+
+	newEvents := map[string]RadnoteEvent{}
+	for deviceUID, e := range oldEvents {
+		newEvents[deviceUID] = radEventToRadnoteEvent(e)
+	}
+
+	contents, err = marshalDataFile(newEvents)
+	if err != nil {
+		return 0, err
+	}
+	err = writeFileAtomic(newPath, contents, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(newEvents), nil
+
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A sample data file in the legacy flat RadEvent format
+const testLegacyRadFile = `{
+	"dev:1": {"event": {"device": "dev:1", "file": "_air.qo", "when": 1700000000, "best_lat": 42.1, "best_lon": -71.1}, "usv": 0.12, "metrics": {"usv": 0.12, "cpm": 40, "temperature": 21.5}},
+	"dev:2": {"event": {"device": "dev:2", "file": "_air.qo", "when": 1700000060}, "usv": 0.08}
+}`
+
+// Migrating a legacy file preserves each device's uSv reading and timestamp, and
+// never overwrites an existing data file
+func TestMigrateRadFile(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "rad.json")
+	newPath := filepath.Join(dir, "radnote.json")
+	err := os.WriteFile(oldPath, []byte(testLegacyRadFile), 0644)
+	if err != nil {
+		t.Fatalf("can't write legacy file: %s", err)
+	}
+
+	count, err := migrateRadFile(oldPath, newPath)
+	if err != nil {
+		t.Fatalf("can't migrate: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("migrated %d devices, want 2", count)
+	}
+	contents, err := os.ReadFile(newPath)
+	if err != nil {
+		t.Fatalf("can't read migrated file: %s", err)
+	}
+	events, err := unmarshalDataFile(contents)
+	if err != nil {
+		t.Fatalf("can't load migrated file: %s", err)
+	}
+	e := events["dev:1"]
+	if e.Body.Usv != 0.12 || e.Event.When != 1700000000 || e.Body.Cpm != 40 || e.Body.TemperatureC != 21.5 {
+		t.Errorf("dev:1: got usv %g when %d cpm %g temperature %g, want 0.12, 1700000000, 40, 21.5", e.Body.Usv, e.Event.When, e.Body.Cpm, e.Body.TemperatureC)
+	}
+	e = events["dev:2"]
+	if e.Body.Usv != 0.08 || e.Event.When != 1700000060 {
+		t.Errorf("dev:2: got usv %g when %d, want 0.08, 1700000060", e.Body.Usv, e.Event.When)
+	}
+
+	_, err = migrateRadFile(oldPath, newPath)
+	if err == nil {
+		t.Errorf("migration overwrote an existing data file")
+	}
+}
+
+// A data file is loaded whether it is the bare map written before the format was
+// versioned or a versioned envelope, and one of a newer version is refused
+func TestUnmarshalDataFile(t *testing.T) {
+	event := `{"event": {"device": "dev:1", "file": "_air.qo", "when": 1700000000, "best_lat": 42.1, "best_lon": -71.1}, "body": {"usv": 0.12, "cpm": 40}}`
+	tests := []struct {
+		name     string
+		contents string
+		devices  int
+		fails    bool
+	}{
+		{"legacy", `{"dev:1": ` + event + `}`, 1, false},
+		{"legacy empty", `{}`, 0, false},
+		{"versioned", `{"version": 2, "events": {"dev:1": ` + event + `}}`, 1, false},
+		{"versioned empty", `{"version": 2, "events": {}}`, 0, false},
+		{"versioned without events", `{"version": 2}`, 0, false},
+		{"explicit version 1", `{"version": 1, "events": {"dev:1": ` + event + `}}`, 1, false},
+		{"newer version", `{"version": 3, "events": {"dev:1": ` + event + `}}`, 0, true},
+		{"unknown version", `{"version": 0, "events": {}}`, 0, true},
+		{"malformed", `{"dev:1": `, 0, true},
+	}
+	for _, test := range tests {
+		events, err := unmarshalDataFile([]byte(test.contents))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: loaded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if events == nil || len(events) != test.devices {
+			t.Errorf("%s: got %d devices, want %d", test.name, len(events), test.devices)
+			continue
+		}
+		if test.devices > 0 {
+			e := events["dev:1"]
+			if e.Body.Usv != 0.12 || e.Body.Cpm != 40 || e.Event.When != 1700000000 || e.Event.BestLat != 42.1 {
+				t.Errorf("%s: got usv %g cpm %g when %d lat %g, want 0.12, 40, 1700000000, 42.1", test.name, e.Body.Usv, e.Body.Cpm, e.Event.When, e.Event.BestLat)
+			}
+		}
+	}
+}
+
+// A legacy data file is loaded by the service and rewritten in the current
+// format when next persisted
+func TestLegacyDataFileRewritten(t *testing.T) {
+	testService(t, Config{})
+	legacy := `{"dev:1": {"event": {"device": "dev:1", "file": "_air.qo", "when": 1700000000, "best_lat": 42.1, "best_lon": -71.1}, "body": {"usv": 0.12}}}`
+	err := os.WriteFile(configDataDirectory+radnoteFile, []byte(legacy), 0644)
+	if err != nil {
+		t.Fatalf("can't write legacy data file: %s", err)
+	}
+	_, err = reloadData()
+	if err != nil {
+		t.Fatalf("can't load legacy data file: %s", err)
+	}
+
+	testPostReading(t, "dev:2", 1700000060, 42.2, -71.2, map[string]interface{}{"usv": 0.2})
+	if _, exists := testStored("dev:1"); !exists {
+		t.Fatalf("device in the legacy data file wasn't loaded")
+	}
+	contents, err := os.ReadFile(configDataDirectory + radnoteFile)
+	if err != nil {
+		t.Fatalf("can't read data file: %s", err)
+	}
+	persisted := dataFile{}
+	err = json.Unmarshal(contents, &persisted)
+	if err != nil || persisted.Version != dataFileVersion || len(persisted.Events) != 2 {
+		t.Errorf("got version %d with %d devices, want version %d with 2: %s", persisted.Version, len(persisted.Events), dataFileVersion, contents)
+	}
+}
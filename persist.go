@@ -0,0 +1,264 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Per-device write coalescing state, protected by radLock.  A device's first
+// reading is written immediately and opens a coalescing window for that device;
+// further readings from it within the window are buffered and flushed together
+// when the window closes.  Windows are keyed by tenantDevice, and pending flushes
+// by tenant, which is also how writes are buffered when persistence is debounced.
+var radCoalesceUntil = map[string]time.Time{}
+var radFlushPending = map[string]bool{}
+var radFlushTimer *time.Timer
+
+// Write a file by writing a temporary file alongside it and renaming it into
+// place, so that readers never observe a partially-written file and a crash
+// mid-write leaves the previous contents intact
+func writeFileAtomic(path string, contents []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Append to a file, creating it if it doesn't exist, and sync it to the disk
+func appendFile(path string, contents []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Tenants whose data file is being written, and those for which another write was
+// requested while it was, protected by radLock
+var radWriting = map[string]bool{}
+var radWriteAgain = map[string]bool{}
+
+// The number of readings stored for each tenant that haven't yet been durably
+// written, protected by radLock.  This is the queue that is bounded by
+// write_queue_max, which grows while writes are coalesced or the disk can't keep
+// up with ingestion.
+var radUnpersisted = map[string]int{}
+
+// The default number of seconds after which a client refused because the write
+// queue is full is asked to retry
+const writeQueueDefaultRetryAfterSecs = 5
+
+// Return whether a tenant's write queue is full, in which case further readings
+// should be refused until it drains.  The caller must hold radLock.
+func writeQueueFull(tenant string) bool {
+	return config().WriteQueueMax > 0 && radUnpersisted[tenant] >= config().WriteQueueMax
+}
+
+// Return the number of seconds after which a refused client should retry
+func writeQueueRetryAfterSecs() int {
+	if config().WriteQueueRetryAfterSecs > 0 {
+		return config().WriteQueueRetryAfterSecs
+	}
+	return writeQueueDefaultRetryAfterSecs
+}
+
+// Return the total number of readings awaiting a durable write
+func writeQueueDepth() (depth int) {
+	radLock.RLock()
+	for _, n := range radUnpersisted {
+		depth += n
+	}
+	radLock.RUnlock()
+	return
+}
+
+// Write all of a tenant's events to its data file, and the readings recorded in
+// its history since the last write to its history log.  The log is rewritten in
+// full, rather than appended to, when it must be or once it has grown to
+// historyCompactFactor times the retained readings, so that the cost of writing
+// each reading's history remains constant however many readings are retained.
+// The events and readings are marshaled while holding radLock, so that the files
+// always reflect a consistent state, but written without it so that ingestion
+// isn't blocked on the disk.  Writes requested while one is in progress collapse
+// into a single further write, made by the writer in progress once it finishes,
+// which captures every change made in the meantime.  The caller must not hold
+// radLock.
+func radPersist(tenant string) (err error) {
+	radLock.Lock()
+	defer radLock.Unlock()
+	if radWriting[tenant] {
+		radWriteAgain[tenant] = true
+		return nil
+	}
+	radWriting[tenant] = true
+	for {
+		delete(radWriteAgain, tenant)
+		captured := radUnpersisted[tenant]
+		logged, appendable := radHistoryLogged[tenant]
+		unlogged := radHistoryUnlogged[tenant]
+		delete(radHistoryUnlogged, tenant)
+		rewrite := !appendable || logged+len(unlogged) > historyCompactFactor*historyRetained(tenant)
+		var retained []RadnoteEvent
+		if rewrite {
+			retained = historyReadings(tenant)
+		}
+		var eventJSON, historyJSON []byte
+		eventJSON, err = marshalDataFile(tenantEvents(tenant))
+		if err == nil && rewrite {
+			historyJSON, err = marshalHistoryLog(retained, true)
+		} else if err == nil {
+			historyJSON, err = marshalHistoryLog(unlogged, false)
+		}
+		radLock.Unlock()
+		if err == nil {
+			historyPath := configDataDirectory + tenantHistoryFile(tenant)
+			if rewrite {
+				err = writeFileAtomic(historyPath, historyJSON, 0644)
+			} else if len(historyJSON) > 0 {
+				err = appendFile(historyPath, historyJSON)
+			}
+			if err == nil {
+				err = writeFileAtomic(configDataDirectory+tenantFile(tenant), eventJSON, 0644)
+			}
+			persistResult(persistSourceData, err)
+		}
+		radLock.Lock()
+		if err == nil {
+			radUnpersisted[tenant] -= captured
+			if rewrite {
+				radHistoryLogged[tenant] = len(retained)
+			} else {
+				radHistoryLogged[tenant] = logged + len(unlogged)
+			}
+		} else {
+			// The log may now end with a partial reading, and lacks those that
+			// weren't appended, so it is rewritten by the next write
+			historyRewrite(tenant)
+		}
+		if err != nil || !radWriteAgain[tenant] {
+			break
+		}
+	}
+	delete(radWriting, tenant)
+	return err
+}
+
+// Determine whether a tenant's events should be persisted now that a device's
+// reading has been updated, returning false if the write is being buffered,
+// either until the next periodic flush if persistence is debounced or because
+// it is being coalesced with others from the same device reporting in a burst.
+// The caller must hold radLock, and must call radPersist after releasing it if
+// true.
+func radPersistDevice(tenant string, deviceUID string) (writeNow bool) {
+
+	// Leave the write to the periodic flusher if persistence is debounced
+	if config().PersistIntervalMs > 0 {
+		radFlushPending[tenant] = true
+		return false
+	}
+
+	window := time.Duration(config().WriteCoalesceMs) * time.Millisecond
+	if window <= 0 {
+		return true
+	}
+
+	// Buffer the write if the device is within its coalescing window
+	now := time.Now()
+	key := tenantDevice(tenant, deviceUID)
+	until, coalescing := radCoalesceUntil[key]
+	if coalescing && now.Before(until) {
+		radFlushPending[tenant] = true
+		if radFlushTimer == nil {
+			radFlushTimer = time.AfterFunc(until.Sub(now), radFlushCoalesced)
+		}
+		return false
+	}
+
+	// Otherwise write now, and open the device's window
+	radCoalesceUntil[key] = now.Add(window)
+	return true
+
+}
+
+// Flush any buffered writes, and forget the windows that have closed
+func radFlushCoalesced() {
+	radLock.Lock()
+	radFlushTimer = nil
+	now := time.Now()
+	for key, until := range radCoalesceUntil {
+		if !now.Before(until) {
+			delete(radCoalesceUntil, key)
+		}
+	}
+	radLock.Unlock()
+	_ = flushNow()
+}
+
+// Write the data files of every tenant with buffered writes, returning the first
+// error encountered.  A tenant whose write fails is left pending, so that its
+// readings are written by the next flush rather than lost.
+func flushNow() (err error) {
+	radLock.Lock()
+	tenants := []string{}
+	for tenant := range radFlushPending {
+		tenants = append(tenants, tenant)
+	}
+	radFlushPending = map[string]bool{}
+	radLock.Unlock()
+	for _, tenant := range tenants {
+		tenantErr := radPersist(tenant)
+		if tenantErr != nil {
+			radLock.Lock()
+			radFlushPending[tenant] = true
+			radLock.Unlock()
+			slog.Error("can't store data", "file", tenantFile(tenant), "error", tenantErr)
+			if err == nil {
+				err = tenantErr
+			}
+		}
+	}
+	return
+}
+
+// Periodically flush buffered writes, when persistence is debounced.  The
+// interval is resolved once, at startup, so that a reload can't set it to 0 and
+// leave the flusher spinning.
+func radFlusher() {
+	interval := time.Duration(config().PersistIntervalMs) * time.Millisecond
+	for {
+		time.Sleep(interval)
+		_ = flushNow()
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A write interrupted before its temporary file is renamed into place leaves the
+// data file intact, so that it still loads
+func TestPersistInterruptedWrite(t *testing.T) {
+	testService(t, Config{})
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	path := configDataDirectory + radnoteFile
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("data file wasn't written: %s", err)
+	}
+	temps, _ := filepath.Glob(path + ".tmp*")
+	if len(temps) != 0 {
+		t.Errorf("temporary files left behind: %v", temps)
+	}
+
+	// A crash partway through writing the next version of the file leaves only
+	// its temporary file truncated
+	partial := append([]byte{}, before[:len(before)/2]...)
+	err = os.WriteFile(path+".tmp123", partial, 0644)
+	if err != nil {
+		t.Fatalf("can't write partial file: %s", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(before, after) {
+		t.Fatalf("data file changed before the rename")
+	}
+
+	count, err := reloadData()
+	if err != nil {
+		t.Fatalf("can't load data after the interrupted write: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("got %d devices, want 1", count)
+	}
+	if _, exists := testStored("dev:1"); !exists {
+		t.Errorf("dev:1 wasn't loaded")
+	}
+}
+
+// A write replaces the whole file, however much shorter than its previous
+// contents
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	err := writeFileAtomic(path, []byte(`{"a":"a long first version"}`), 0644)
+	if err == nil {
+		err = writeFileAtomic(path, []byte(`{}`), 0644)
+	}
+	if err != nil {
+		t.Fatalf("can't write file: %s", err)
+	}
+	contents, _ := os.ReadFile(path)
+	if string(contents) != `{}` {
+		t.Errorf("got %q, want %q", contents, `{}`)
+	}
+}
+
+// Debounced readings aren't written until flushed, and flushNow writes them
+func TestFlushNow(t *testing.T) {
+	testService(t, Config{PersistIntervalMs: 60000})
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	path := configDataDirectory + radnoteFile
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("debounced reading was written before a flush")
+	}
+	if writeQueueDepth() != 1 {
+		t.Errorf("write queue depth: got %d, want 1", writeQueueDepth())
+	}
+
+	err := flushNow()
+	if err != nil {
+		t.Fatalf("can't flush: %s", err)
+	}
+	events, err := loadEvents(radnoteFile, "")
+	if err != nil {
+		t.Fatalf("can't load flushed data: %s", err)
+	}
+	if _, exists := events["dev:1"]; !exists {
+		t.Errorf("flushed data doesn't include dev:1")
+	}
+	if writeQueueDepth() != 0 {
+		t.Errorf("write queue depth after flush: got %d, want 0", writeQueueDepth())
+	}
+}
+
+// A flush that fails leaves the readings pending, so that the next flush writes
+// them
+func TestFlushNowRetriesFailedWrite(t *testing.T) {
+	testService(t, Config{PersistIntervalMs: 60000})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+
+	// A directory in the way of the data file makes the write fail
+	path := configDataDirectory + radnoteFile
+	err := os.MkdirAll(filepath.Join(path, "in-the-way"), 0755)
+	if err != nil {
+		t.Fatalf("can't create directory: %s", err)
+	}
+	if flushNow() == nil {
+		t.Fatalf("flush succeeded with a directory in the way")
+	}
+	if writeQueueDepth() != 1 {
+		t.Errorf("write queue depth after the failed flush: got %d, want 1", writeQueueDepth())
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		t.Fatalf("can't remove directory: %s", err)
+	}
+	err = flushNow()
+	if err != nil {
+		t.Fatalf("can't flush: %s", err)
+	}
+	events, err := loadEvents(radnoteFile, "")
+	if err != nil {
+		t.Fatalf("can't load flushed data: %s", err)
+	}
+	if _, exists := events["dev:1"]; !exists {
+		t.Errorf("retried flush didn't write dev:1")
+	}
+	if writeQueueDepth() != 0 {
+		t.Errorf("write queue depth after the retried flush: got %d, want 0", writeQueueDepth())
+	}
+}
+
+// Ingest readings from 1000 devices, writing after every reading or leaving the
+// writes to be debounced and flushing once at the end
+func benchmarkIngestPersist(b *testing.B, c Config) {
+	testService(b, c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		deviceUID := fmt.Sprintf("dev:%d", i%1000)
+		event := testReading(deviceUID, 1700000000+int64(i), 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+		result := ingestEvent("", event)
+		if result.status != http.StatusOK {
+			b.Fatalf("can't ingest reading: got %d", result.status)
+		}
+		if result.writeNow {
+			err := radPersist("")
+			if err != nil {
+				b.Fatalf("can't write reading: %s", err)
+			}
+		}
+	}
+	err := flushNow()
+	if err != nil {
+		b.Fatalf("can't flush: %s", err)
+	}
+}
+
+// Every reading rewrites the data file
+func BenchmarkIngestPerEventWrite(b *testing.B) {
+	benchmarkIngestPersist(b, Config{})
+}
+
+// Readings are buffered until the flush
+func BenchmarkIngestDebouncedWrite(b *testing.B) {
+	benchmarkIngestPersist(b, Config{PersistIntervalMs: 60000})
+}
@@ -5,12 +5,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -30,120 +36,892 @@ type RadnoteEventBody struct {
 	Usv          float64 `json:"usv,omitempty"`
 }
 
-// An Event with a Radnote-specific body type added
-type RadEvent struct {
-	Event note.Event `json:"event,omitempty"`
-	Usv   float64    `json:"usv,omitempty"`
+// The canonical nested form of a stored Radnote event, in which the decoded body
+// is retained in full so that temperature and voltage are kept alongside the
+// radiation reading.  Metrics retains every numeric field that was decoded from
+// the body so that non-radiation payloads (such as PM2.5 from air-quality
+// Notecards) can flow through the same pipeline.
+type RadnoteEvent struct {
+	Event           note.Event         `json:"event,omitempty"`
+	Body            RadnoteEventBody   `json:"body,omitempty"`
+	Metrics         map[string]float64 `json:"metrics,omitempty"`
+	LocationSuspect bool               `json:"location_suspect,omitempty"`
 }
 
-// Loaded radnote data
-var radLock sync.Mutex
-var radEvents map[string]RadEvent
+// The uSv metric, which is the metric aggregated when none is specified unless the
+// deployment's primary metric is configured to be CPM
+const defaultMetric = "usv"
+
+// The raw counts-per-minute metric, from which uSv is derived
+const cpmMetric = "cpm"
+
+// The device health metrics reported alongside each reading
+const (
+	temperatureMetric = "temperature"
+	voltageMetric     = "voltage"
+)
+
+// The factor converting CPM to uSv/h for sensors without a configured factor,
+// which is that of the LND 7317 tube, at 334 CPM per uSv/h
+const sensorDefaultFactor = 1.0 / 334
+
+// Return the factor converting a sensor's CPM to uSv/h
+func sensorFactor(sensor string) float64 {
+	factor, known := config().SensorFactors[sensor]
+	if known {
+		return factor
+	}
+	if config().SensorDefaultFactor > 0 {
+		return config().SensorDefaultFactor
+	}
+	return sensorDefaultFactor
+}
+
+// Units in which uSv/h readings may be reported, besides uSv/h and CPM
+const unitsNsv = "nsv"
+
+// Return the factor converting a metric's values into the requested units, which
+// may only differ from the metric's own if it is uSv/h.  Conversion to CPM uses
+// the default sensor factor, since a region's readings may come from several
+// sensors.
+func unitsConversion(units string, metric string) (factor float64, err error) {
+	switch units {
+	case "", metric:
+		return 1, nil
+	case defaultMetric, unitsNsv, cpmMetric:
+	default:
+		return 0, fmt.Errorf("units must be %s, %s, or %s", defaultMetric, unitsNsv, cpmMetric)
+	}
+	if metric != defaultMetric {
+		return 0, fmt.Errorf("units may only be converted from the %s metric", defaultMetric)
+	}
+	if units == unitsNsv {
+		return 1000, nil
+	}
+	return 1 / sensorFactor(""), nil
+}
+
+// Return the metric that is aggregated when none is specified
+func primaryMetric() string {
+	if config().PrimaryMetric != "" {
+		return config().PrimaryMetric
+	}
+	return defaultMetric
+}
+
+// Return the value of the named metric for this event, and whether it was present.
+// Events stored before metrics were retained only have a typed body, in which a
+// missing CPM, temperature, or voltage can't be told apart from 0, so those are
+// only present if nonzero.
+func (e RadnoteEvent) metricValue(metric string) (value float64, present bool) {
+	if e.Metrics == nil {
+		switch metric {
+		case defaultMetric:
+			return e.Body.Usv, true
+		case cpmMetric:
+			return e.Body.Cpm, e.Body.Cpm != 0
+		case temperatureMetric:
+			return e.Body.TemperatureC, e.Body.TemperatureC != 0
+		case voltageMetric:
+			return e.Body.Voltage, e.Body.Voltage != 0
+		}
+	}
+	value, present = e.Metrics[metric]
+	return
+}
+
+// Extract all numeric fields from an event body
+func bodyMetrics(body map[string]interface{}) (metrics map[string]float64) {
+	for k, v := range body {
+		var f float64
+		switch n := v.(type) {
+		case json.Number:
+			var err error
+			f, err = n.Float64()
+			if err != nil {
+				continue
+			}
+		case float64:
+			f = n
+		case int:
+			f = float64(n)
+		case int64:
+			f = float64(n)
+		default:
+			continue
+		}
+		if !finite(f) {
+			continue
+		}
+		if metrics == nil {
+			metrics = map[string]float64{}
+		}
+		metrics[k] = f
+	}
+	return
+}
+
+// Loaded radnote data.  Queries only read it, so they share radLock, while
+// ingestion and persistence hold it exclusively.
+var radLock sync.RWMutex
+var radnoteEvents map[string]RadnoteEvent
+var radnoteFile = "radnote.json"
+
+// The data file in the legacy flat RadEvent format, which is migrated on load
 var radFile = "rad.json"
 
-// First time load of data
-func ensureLoaded() {
+// First time load of data, for the default tenant and any configured tenants.  If
+// a data file exists but can't be read or parsed its store remains unloaded, so
+// that we never overwrite it with an empty map, and loading is retried on the next
+// request.
+func ensureLoaded() (err error) {
+
+	// Avoid serializing queries once everything is loaded
+	radLock.RLock()
+	loaded := radnoteEvents != nil
+	for _, tenant := range configTenants() {
+		loaded = loaded && radTenantEvents[tenant] != nil
+	}
+	radLock.RUnlock()
+	if loaded {
+		return nil
+	}
+
 	radLock.Lock()
-	if radEvents == nil {
-		radEvents = map[string]RadEvent{}
-		contents, err := os.ReadFile(configDataDirectory + radFile)
+	if radnoteEvents == nil {
+		var history map[string][]RadnoteEvent
+		var logged int
+		history, logged, err = loadHistory(tenantHistoryFile(""))
 		if err == nil {
-			err = note.JSONUnmarshal(contents, &radEvents)
-			if err != nil {
-				fmt.Printf("radnote: can't load %s: %s\n", radFile, err)
+			radnoteEvents, err = loadEvents(radnoteFile, radFile)
+		}
+		if err == nil {
+			historyLoaded("", history, logged)
+			geohashIndexTenant("")
+		}
+	}
+	for _, tenant := range configTenants() {
+		if err == nil && radTenantEvents[tenant] == nil {
+			var history map[string][]RadnoteEvent
+			var logged int
+			var events map[string]RadnoteEvent
+			history, logged, err = loadHistory(tenantHistoryFile(tenant))
+			if err == nil {
+				events, err = loadEvents(tenantFile(tenant), tenantLegacyFile(tenant))
+			}
+			if err == nil {
+				historyLoaded(tenant, history, logged)
+				radTenantEvents[tenant] = events
+				geohashIndexTenant(tenant)
 			}
 		}
 	}
 	radLock.Unlock()
+	return
+}
+
+// Re-read the data files of the default tenant and any configured tenants,
+// replacing the data in memory and returning the number of devices loaded.  Any
+// buffered writes are flushed first, so that no accepted reading is lost.  The
+// files are then read while holding radLock, so that readings POSTed meanwhile
+// are applied to the reloaded data, and only if every file can be read, so that
+// a bad file leaves the data in memory untouched.  A reload is refused while a
+// write is in progress, or if readings remain that couldn't be written.
+func reloadData() (deviceCount int, err error) {
+	err = flushNow()
+	if err != nil {
+		return 0, fmt.Errorf("can't write buffered readings: %s", err)
+	}
+	radLock.Lock()
+	defer radLock.Unlock()
+	tenants := append([]string{""}, configTenants()...)
+	unpersisted := 0
+	for _, tenant := range tenants {
+		if radWriting[tenant] {
+			return 0, fmt.Errorf("data is being written, so try again")
+		}
+		unpersisted += radUnpersisted[tenant]
+	}
+	if unpersisted > 0 {
+		return 0, fmt.Errorf("%d readings haven't been written and would be lost, so try again", unpersisted)
+	}
+	events := map[string]map[string]RadnoteEvent{}
+	histories := map[string]map[string][]RadnoteEvent{}
+	logged := map[string]int{}
+	for _, tenant := range tenants {
+		histories[tenant], logged[tenant], err = loadHistory(tenantHistoryFile(tenant))
+		if err == nil {
+			events[tenant], err = loadEvents(tenantFile(tenant), tenantLegacyFile(tenant))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, tenant := range tenants {
+		if tenant == "" {
+			radnoteEvents = events[tenant]
+		} else {
+			radTenantEvents[tenant] = events[tenant]
+		}
+		historyLoaded(tenant, histories[tenant], logged[tenant])
+		geohashIndexTenant(tenant)
+		deviceCount += len(events[tenant])
+	}
+	radGeneration.Add(1)
+	return deviceCount, nil
+}
+
+// Load the events in a data file, returning an empty map if it doesn't yet exist.
+// If it doesn't exist but a data file in the legacy format does, that file is
+// first migrated into it.  A data file of an earlier version is upgraded as it is
+// loaded, and rewritten in the current format when next persisted.
+func loadEvents(file string, legacyFile string) (events map[string]RadnoteEvent, err error) {
+	_, err = os.Stat(configDataDirectory + file)
+	if os.IsNotExist(err) {
+		var count int
+		count, err = migrateRadFile(configDataDirectory+legacyFile, configDataDirectory+file)
+		if err == nil {
+			slog.Info("devices migrated", "count", count, "from", legacyFile, "to", file)
+		} else if !os.IsNotExist(err) {
+			slog.Error("can't migrate data", "file", legacyFile, "error", err)
+			return nil, err
+		}
+	}
+	events = map[string]RadnoteEvent{}
+	contents, err := os.ReadFile(configDataDirectory + file)
+	if err == nil {
+		events, err = unmarshalDataFile(contents)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		slog.Error("can't load data", "file", file, "error", err)
+		return nil, err
+	}
+	return events, nil
+}
+
+// Make sure that the data is available to be queried, writing an error response
+// and returning false if it isn't.  If the data was loaded but can no longer be
+// persisted, the in-memory data is still served but is flagged as possibly stale
+// unless stale reads are disabled.
+func ensureQueryable(w http.ResponseWriter) bool {
+	err := ensureLoaded()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("data not loaded: " + err.Error()))
+		return false
+	}
+	if !persistHealthy.Load() {
+		if config().StaleReadsDisabled {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("data persistence is degraded"))
+			return false
+		}
+		w.Header().Set("Warning", `110 geofeeds "Response is Stale"`)
+	}
+	return true
+}
+
+// Respond to a query abandoned because its request was canceled or its deadline
+// passed, returning true if it was
+func queryCanceled(w http.ResponseWriter, r *http.Request) bool {
+	err := r.Context().Err()
+	if err == nil {
+		return false
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write([]byte("query abandoned: " + err.Error()))
+	return true
 }
 
-// Radnote event handler
+// Radnote event handler, accepting either a single event or a JSON array of
+// events from a gateway that has buffered them
 func httpRadnoteHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	// Make sure the data is loaded
-	ensureLoaded()
+	statReceived.Add(1)
+	if !ingestAuthorized(w, r) {
+		return
+	}
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	err = ensureLoaded()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("data not loaded: " + err.Error()))
+		return
+	}
 
-	// Get the event body
-	eventJSON, err := io.ReadAll(r.Body)
+	// Get the event body, refusing any that is too large
+	maxBodyBytes := config().MaxBodyBytes
+	if maxBodyBytes == 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	eventJSON, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		statRejectedInvalid.Add(1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte(fmt.Sprintf("body must not exceed %d bytes", tooLarge.Limit)))
+		return
+	}
 	if err != nil {
-		fmt.Printf("radnote: error reading POSTed body: %s\n", err)
-		_, _ = w.Write([]byte(err.Error()))
+		statRejectedInvalid.Add(1)
+		slog.Error("can't read posted body", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if trimmed := bytes.TrimSpace(eventJSON); len(trimmed) > 0 && trimmed[0] == '[' {
+		ingestBatch(w, tenant, trimmed)
 		return
 	}
 	event := note.Event{}
 	err = note.JSONUnmarshal(eventJSON, &event)
 	if err != nil {
-		fmt.Printf("radnote: error marshaling POSTed body: %s\n%s\n", err, eventJSON)
+		statRejectedInvalid.Add(1)
+		slog.Error("can't parse posted event", "error", err, "body", string(eventJSON))
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Ingest it, and persist it unless the write is being buffered
+	result := ingestEvent(tenant, event)
+	if result.writeNow {
+		err = radPersist(tenant)
+		if err != nil {
+			slog.Error("can't store data", "file", tenantFile(tenant), "error", err)
+		}
+	}
+	if result.status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(writeQueueRetryAfterSecs()))
+	}
+	w.WriteHeader(result.status)
+	if result.message != "" {
+		_, _ = w.Write([]byte(result.message))
+	}
+
+}
+
+// Ingest a batch of events, each exactly as if it had been POSTed on its own,
+// persisting them once at the end.  The response summarizes how many events were
+// accepted and how many were skipped, whether because they weren't data readings
+// or were duplicates, or because they were invalid.  If any were refused because
+// the write queue is full the response is a 503 asking the client to retry, which
+// is safe because the events that were accepted will be recognized as duplicates,
+// while those that were refused were forgotten and will be accepted.
+func ingestBatch(w http.ResponseWriter, tenant string, batchJSON []byte) {
+
+	events := []note.Event{}
+	err := note.JSONUnmarshal(batchJSON, &events)
+	if err != nil {
+		statRejectedInvalid.Add(1)
+		slog.Error("can't parse posted batch", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte(err.Error()))
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if len(events) > 1 {
+		statReceived.Add(int64(len(events) - 1))
+	}
+
+	accepted := 0
+	skipped := 0
+	refused := false
+	writeNow := false
+	for _, event := range events {
+		result := ingestEvent(tenant, event)
+		if result.accepted {
+			accepted++
+		} else {
+			skipped++
+		}
+		refused = refused || result.status == http.StatusServiceUnavailable
+		writeNow = writeNow || result.writeNow
+	}
+	if writeNow {
+		err = radPersist(tenant)
+		if err != nil {
+			slog.Error("can't store data", "file", tenantFile(tenant), "error", err)
+		}
+	}
+
+	o := map[string]interface{}{}
+	o["accepted"] = accepted
+	o["skipped"] = skipped
+	oJSON, _ := json.Marshal(o)
+	w.Header().Set("Content-Type", "application/json")
+	if refused {
+		w.Header().Set("Retry-After", strconv.Itoa(writeQueueRetryAfterSecs()))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(oJSON)
+
+}
+
+// The outcome of ingesting an event: the status and message with which a request
+// for just that event is answered, whether the reading was recorded, and whether
+// the tenant's data should be persisted now
+type ingestResult struct {
+	status   int
+	message  string
+	accepted bool
+	writeNow bool
+}
+
+// Ingest an event, retaining it if it is a valid data reading.  The caller must
+// call radPersist if writeNow is returned, after ingesting any further events.
+func ingestEvent(tenant string, event note.Event) (result ingestResult) {
+	result.status = http.StatusOK
 
 	// Exit if not a data reading
 	if event.NotefileID != "_air.qo" {
-		w.WriteHeader(http.StatusOK)
+		statSkippedNotData.Add(1)
+		return
+	}
+
+	// Reject measurements that aren't finite numbers, which can't be aggregated,
+	// before classifying the body, so that a body whose only measurement isn't
+	// finite is refused rather than acknowledged as empty
+	if field, ok := finiteMeasurements(event); !ok {
+		statRejectedInvalid.Add(1)
+		return ingestResult{status: http.StatusBadRequest, message: field + " must be a finite number"}
+	}
+
+	// Acknowledge, but don't store, readings without a body unless configured to
+	// store them as they always were, as a zero reading
+	switch eventBodyKind(event) {
+	case bodyKindMissing:
+		if config().EmptyBodyPolicy != emptyBodyPolicyStore {
+			statSkippedNoBody.Add(1)
+			return
+		}
+	case bodyKindEmpty:
+		if config().EmptyBodyPolicy != emptyBodyPolicyStore {
+			statSkippedEmptyBody.Add(1)
+			return
+		}
+	case bodyKindNoMeasurement:
+		statNoMeasurement.Add(1)
+	}
+
+	// Normalize timestamps sent in milliseconds to seconds
+	normalizeEventWhen(&event)
+
+	// Reject or clamp events whose timestamps are implausibly old
+	if !checkEventAge(&event, time.Now().UTC().Unix()) {
+		statRejectedInvalid.Add(1)
+		return ingestResult{status: http.StatusBadRequest, message: "event timestamp is too far in the past"}
+	}
+
+	// Store readings without a location, which are served by the full list but
+	// can't be placed within any region
+	if event.BestLat == 0 && event.BestLon == 0 {
+		slog.Debug("reading has no location", "device_uid", event.DeviceUID, "notefile", event.NotefileID)
+	}
+
+	// Reject or flag events located far from their device's registered location
+	locationOK, locationSuspect := checkEventLocation(event)
+	if !locationOK {
+		statRejectedInvalid.Add(1)
+		return ingestResult{status: http.StatusBadRequest, message: "event location is too far from the device's registered location"}
+	}
+
+	// Acknowledge, but otherwise ignore, a reading that we've already received
+	if config().DedupTTLSecs >= 0 && dedupCheck(tenant, event, time.Now()) {
+		statSkippedDuplicate.Add(1)
 		return
 	}
 
-	// Retain the last event and persist the body
+	// Decode the body
+	radevent := RadnoteEvent{}
+	radevent.Event = event
+	radevent.Event.Body = nil
+	radevent.LocationSuspect = locationSuspect
+	if event.Body != nil {
+		bodyJSON, _ := note.JSONMarshal(*event.Body)
+		_ = note.JSONUnmarshal(bodyJSON, &radevent.Body)
+		radevent.Metrics = bodyMetrics(*event.Body)
+	}
+
+	// Derive the uSv reading of a sensor that only reports CPM
+	if radevent.Body.Usv == 0 && radevent.Body.Cpm > 0 {
+		radevent.Body.Usv = radevent.Body.Cpm * sensorFactor(radevent.Body.Sensor)
+		radevent.Metrics[defaultMetric] = radevent.Body.Usv
+	}
+
+	// Record the reading in the device's history, retain it as the device's latest
+	// reading if it is, and determine whether to persist both now
 	radLock.Lock()
-	currentEvent, exists := radEvents[event.DeviceUID]
+	defer radLock.Unlock()
+	if writeQueueFull(tenant) {
+		dedupForget(tenant, event)
+		statRejectedBackpressure.Add(1)
+		return ingestResult{status: http.StatusServiceUnavailable, message: "too many readings are awaiting storage"}
+	}
+	historyAppend(tenant, radevent)
+	events := tenantEvents(tenant)
+	currentEvent, exists := events[event.DeviceUID]
 	if !exists || event.When >= currentEvent.Event.When {
-		radevent := RadEvent{}
-		radevent.Event = event
-		radevent.Event.Body = nil
-		if event.Body != nil {
-			bodyJSON, _ := note.JSONMarshal(*event.Body)
-			var rev RadnoteEventBody
-			_ = note.JSONUnmarshal(bodyJSON, &rev)
-			radevent.Usv = rev.Usv
-		}
-		radEvents[event.DeviceUID] = radevent
-		eventJSON, err = json.Marshal(radEvents)
-		if err == nil {
-			err = os.WriteFile(configDataDirectory+radFile, eventJSON, 0644)
+		events[event.DeviceUID] = radevent
+		if exists {
+			geohashIndexMove(tenant, event.DeviceUID, &currentEvent, radevent)
+		} else {
+			geohashIndexMove(tenant, event.DeviceUID, nil, radevent)
 		}
+		alertEvaluate(tenant, radevent)
+		streamPublish(tenant, radevent)
+		statStored.Add(1)
+	} else {
+		statSkippedOlder.Add(1)
 	}
-	radLock.Unlock()
-	if err != nil {
-		fmt.Printf("radnote: can't store %s: %s\n", radFile, err)
+	radGeneration.Add(1)
+	radUnpersisted[tenant]++
+	result.accepted = true
+	result.writeNow = radPersistDevice(tenant, event.DeviceUID)
+	return
+
+}
+
+// Kinds of event body
+const (
+	bodyKindMissing       = "missing"
+	bodyKindEmpty         = "empty"
+	bodyKindNoMeasurement = "no_measurement"
+	bodyKindMeasured      = "measured"
+)
+
+// The body fields that carry a radiation measurement
+var measurementFields = []string{"usv", "cpm"}
+
+// Classify an event's body as missing altogether, empty (without any numeric
+// fields), present but without any radiation measurement, or measured.  A body
+// without a measurement still carries other metrics, and is stored without a uSv
+// reading rather than with a reading of zero.
+func eventBodyKind(event note.Event) string {
+	if event.Body == nil {
+		return bodyKindMissing
+	}
+	if len(bodyMetrics(*event.Body)) == 0 {
+		return bodyKindEmpty
+	}
+	for _, field := range measurementFields {
+		_, present := (*event.Body)[field]
+		if present {
+			return bodyKindMeasured
+		}
+	}
+	return bodyKindNoMeasurement
+}
+
+// Any When beyond this, which is early in the year 5000 when taken as seconds,
+// is assumed to have been sent in milliseconds
+const maxPlausibleWhenSecs = 95617584000
+
+// Determine whether an event's radiation measurements, if any, are all finite
+// numbers, returning the name of the first that isn't.  A number too large to be
+// represented is treated as infinite.
+func finiteMeasurements(event note.Event) (field string, ok bool) {
+	if event.Body == nil {
+		return "", true
+	}
+	for _, field = range measurementFields {
+		var f float64
+		switch n := (*event.Body)[field].(type) {
+		case json.Number:
+			var err error
+			f, err = n.Float64()
+			if err != nil {
+				return field, false
+			}
+		case float64:
+			f = n
+		default:
+			continue
+		}
+		if !finite(f) {
+			return field, false
+		}
+	}
+	return "", true
+}
+
+// Normalize an event's When to seconds.  By default the unit is detected from
+// the magnitude of the value, but it may also be fixed by configuration.
+func normalizeEventWhen(event *note.Event) {
+	switch config().WhenUnit {
+	case whenUnitSeconds:
+		return
+	case whenUnitMilliseconds:
+	default:
+		if event.When <= maxPlausibleWhenSecs {
+			return
+		}
+	}
+	when := event.When / 1000
+	slog.Debug("converting when from milliseconds", "device_uid", event.DeviceUID, "notefile", event.NotefileID, "when", event.When, "seconds", when)
+	event.When = when
+}
+
+// Apply the configured max_past_age_seconds policy to an event received at the
+// specified time, returning false if the event should be rejected.  Under the
+// clamp policy the event is accepted but its When is replaced by the receipt time.
+func checkEventAge(event *note.Event, received int64) bool {
+	if config().MaxPastAgeSecs <= 0 || event.When >= received-int64(config().MaxPastAgeSecs) {
+		return true
+	}
+	if config().PastAgePolicy == pastAgePolicyClamp {
+		slog.Warn("clamping stale timestamp", "device_uid", event.DeviceUID, "notefile", event.NotefileID, "when", event.When, "received", received)
+		event.When = received
+		return true
 	}
+	slog.Warn("rejecting stale timestamp", "device_uid", event.DeviceUID, "notefile", event.NotefileID, "when", event.When)
+	return false
+}
 
+// Compare an event's location with its device's registered location, if location
+// checking is configured, returning false if the event should be rejected and,
+// under the flag policy, whether it should be stored marked as suspect
+func checkEventLocation(event note.Event) (accept bool, suspect bool) {
+	if config().LocationCheckMeters <= 0 || (event.BestLat == 0 && event.BestLon == 0) {
+		return true, false
+	}
+	registered, exists := config().RegisteredLocations[event.DeviceUID]
+	if !exists {
+		registered, exists = config().RegisteredLocations[canonicalDeviceUID(event.DeviceUID)]
+	}
+	if !exists {
+		return true, false
+	}
+	distance := metersApart(event.BestLat, event.BestLon, registered.Lat, registered.Lon)
+	if distance <= config().LocationCheckMeters {
+		return true, false
+	}
+	if config().LocationCheckPolicy == locationCheckPolicyFlag {
+		slog.Warn("flagging location far from registered location", "device_uid", event.DeviceUID, "notefile", event.NotefileID, "distance_meters", math.Round(distance))
+		return true, true
+	}
+	slog.Warn("rejecting location far from registered location", "device_uid", event.DeviceUID, "notefile", event.NotefileID, "distance_meters", math.Round(distance))
+	return false, false
 }
 
-// Radiation query handler
+// Radiation query handler, which is query-only
 func httpRadiationHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	// Make sure the data is loaded
-	ensureLoaded()
+	// Only queries are served here; readings are POSTed to /radnote
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer metricQueryServed(r.URL.Query().Get("format"), time.Now())
+
+	// Abandon the query once its response could no longer be written anyway
+	ctx, cancel := context.WithTimeout(r.Context(), configSeconds(config().WriteTimeoutSecs, defaultWriteTimeoutSecs))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// Make sure the data is available
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	if !ensureQueryable(w) {
+		return
+	}
 
 	// See if lat/lon are specified, and if so, generate a feed
 	query := r.URL.Query()
 	latStr := query.Get("lat")
 	lonStr := query.Get("lon")
 	radiusMetersStr := query.Get("radius_meters")
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = primaryMetric()
+	}
 	if latStr != "" && lonStr != "" {
 		lat, latErr := strconv.ParseFloat(latStr, 64)
 		lon, lonErr := strconv.ParseFloat(lonStr, 64)
+
+		// Reject coordinates that are out of range.  A location of exactly 0,0 is
+		// what devices report when they have no location, so it is never queried,
+		// and the full list is returned instead.
+		if latErr == nil && (math.IsNaN(lat) || lat < -90 || lat > 90) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("lat must be a number between -90 and 90"))
+			return
+		}
+		if lonErr == nil && (math.IsNaN(lon) || lon < -180 || lon > 180) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("lon must be a number between -180 and 180"))
+			return
+		}
+
+		// A nearest query takes precedence over a region query, and any
+		// radius_meters specified alongside it is ignored
+		nearestStr := query.Get("nearest")
+		if nearestStr != "" && latErr == nil && lonErr == nil && !(lat == 0 && lon == 0) {
+			n, err := strconv.Atoi(nearestStr)
+			if err != nil || n < 1 || n > maxNearest() {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(fmt.Sprintf("nearest must be between 1 and %d", maxNearest())))
+				return
+			}
+			generateNearestFeed(w, r, tenant, lat, lon, n, metric)
+			return
+		}
+
+		// Without a radius, list every device by its distance from the point,
+		// unless the full list was requested in an export format
+		if radiusMetersStr == "" && query.Get("format") == "" && latErr == nil && lonErr == nil && !(lat == 0 && lon == 0) {
+			generateDistanceList(w, r, tenant, lat, lon)
+			return
+		}
+
+		// Reject a radius that can't bound a region.  A radius of 0 asks for the
+		// small region around the point that it always has.
 		radiusMeters, radiusErr := strconv.ParseFloat(radiusMetersStr, 64)
+		if radiusErr == nil && (math.IsNaN(radiusMeters) || math.IsInf(radiusMeters, 0) || radiusMeters < 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("radius_meters must be a finite number of meters, and not negative"))
+			return
+		}
 		if latErr == nil && lonErr == nil && radiusErr == nil && !(lat == 0 && lon == 0) {
-			generateJsonFeed(w, r, lat, lon, radiusMeters)
+			if query.Get("peak") == "true" {
+				if !featureEnabled(featurePeak) {
+					w.WriteHeader(http.StatusNotImplemented)
+					return
+				}
+				since, until, err := parseTimeRange(query)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(err.Error()))
+					return
+				}
+				generatePeakFeed(w, r, tenant, lat, lon, radiusMeters, since, until)
+				return
+			}
+			if !queryCacheEnabled() {
+				generateJsonFeed(w, r, tenant, lat, lon, radiusMeters, metric)
+				return
+			}
+			// The query is answered for the coordinates rounded to form its key,
+			// so that a cached response is correct for every query sharing it
+			key := queryCacheKey(tenant, r.URL.Path, query, lat, lon, emptyRegionStatus(r))
+			if !queryCacheServe(w, key) {
+				queryCacheGenerate(w, key, func(w http.ResponseWriter) {
+					generateJsonFeed(w, r, tenant, roundCoordinate(lat), roundCoordinate(lon), radiusMeters, metric)
+				})
+			}
+			return
+		}
+	}
+
+	// Export the full list in another format if requested
+	switch query.Get("format") {
+	case exportFormatCSV:
+		writeEventsCSV(w, tenant)
+		return
+	case exportFormatNDJSON:
+		writeEventsNDJSON(w, tenant)
+		return
+	case formatKML:
+		writeKML(w, "radnote readings", "", snapshotEvents(tenant), nil)
+		return
+	}
+
+	// Optionally include a recent series of readings for each device
+	sparklineLen := 0
+	sparklineStr := query.Get("sparkline")
+	if sparklineStr != "" {
+		if !featureEnabled(featureSparkline) {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		sparklineLen, err = strconv.Atoi(sparklineStr)
+		if err != nil || sparklineLen < 1 || sparklineLen > maxSparklineLen {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("sparkline must be between 1 and %d", maxSparklineLen)))
+			return
+		}
+	}
+
+	// Optionally page through the list, in order of device UID
+	paged := query.Get("limit") != "" || query.Get("offset") != ""
+	limit := listingDefaultLimit
+	offset := 0
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > listingMaxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("limit must be between 1 and %d", listingMaxLimit)))
+			return
+		}
+	}
+	if query.Get("offset") != "" {
+		offset, err = strconv.Atoi(query.Get("offset"))
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("offset must not be negative"))
 			return
 		}
 	}
 
+	// A client that already has the current list is told it hasn't changed
+	etagKey := listingETagKey(tenant, r.URL.RawQuery)
+	etag, known := listingETagCurrent(etagKey)
+	if known && etagMatches(r, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// Just retrieve the full list
-	w.WriteHeader(http.StatusOK)
+	timing := newServerTiming()
 	var eventJSON []byte
-	radLock.Lock()
-	eventJSON, err = json.MarshalIndent(radEvents, "", "    ")
-	radLock.Unlock()
-	if err == nil {
-		_, _ = w.Write(eventJSON)
+	radLock.RLock()
+	generation := radGeneration.Load()
+	if paged {
+		eventJSON, err = json.MarshalIndent(listingPage(tenant, offset, limit, sparklineLen), "", "    ")
+	} else if sparklineLen == 0 {
+		eventJSON, err = json.MarshalIndent(tenantEvents(tenant), "", "    ")
+	} else {
+		listing := map[string]radListingEntry{}
+		for deviceUID, e := range tenantEvents(tenant) {
+			if r.Context().Err() != nil {
+				break
+			}
+			listing[deviceUID] = radListingEntry{RadnoteEvent: e, Sparkline: deviceSparkline(tenant, deviceUID, sparklineLen)}
+		}
+		if r.Context().Err() == nil {
+			eventJSON, err = json.MarshalIndent(listing, "", "    ")
+		}
+	}
+	radLock.RUnlock()
+	if queryCanceled(w, r) {
+		return
 	}
+	timing.mark("serialize")
+	timing.writeHeader(w)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	etag = listingETagStore(etagKey, generation, eventJSON)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(eventJSON)
 	return
 
 }
@@ -158,8 +936,8 @@ func httpRadiationHandler(w http.ResponseWriter, r *http.Request) {
 //
 // distance returned is METERS
 func metersApart(lat1 float64, lon1 float64, lat2 float64, lon2 float64) (distanceMeters float64) {
-	const R = 6371
-	const degreesToRadians = (3.1415926536 / 180)
+	R := earthRadiusMeters()
+	const degreesToRadians = math.Pi / 180
 	var dx, dy, dz float64
 	lon1 = lon1 - lon2
 	lon1 = lon1 * degreesToRadians
@@ -168,93 +946,1132 @@ func metersApart(lat1 float64, lon1 float64, lat2 float64, lon2 float64) (distan
 	dz = math.Sin(lat1) - math.Sin(lat2)
 	dx = math.Cos(lon1)*math.Cos(lat1) - math.Cos(lat2)
 	dy = math.Sin(lon1) * math.Cos(lat1)
-	distanceMeters = 1000 * (math.Asin(math.Sqrt(math.Abs(dx*dx+dy*dy+dz*dz))/2) * 2 * R)
+	distanceMeters = math.Asin(math.Sqrt(math.Abs(dx*dx+dy*dy+dz*dz))/2) * 2 * R
 	return
 }
 
-// Generate a JSON feed for the specified location
-func generateJsonFeed(w http.ResponseWriter, r *http.Request, lat float64, lon float64, radiusMeters float64) {
-
-	// If 0, make it a small region
-	if radiusMeters == 0 {
-		radiusMeters = 10
+// Return the initial bearing, in degrees clockwise from north in [0, 360), of the
+// great circle path from the first point to the second.  Coincident points have a
+// bearing of 0.
+func bearing(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	const degreesToRadians = math.Pi / 180
+	phi1 := lat1 * degreesToRadians
+	phi2 := lat2 * degreesToRadians
+	deltaLambda := (lon2 - lon1) * degreesToRadians
+	y := math.Sin(deltaLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(deltaLambda)
+	if math.Abs(x) < 1e-15 && math.Abs(y) < 1e-15 {
+		return 0
 	}
+	degrees := math.Mod(math.Atan2(y, x)/degreesToRadians+360, 360)
+	if degrees >= 360 {
+		degrees = 0
+	}
+	return degrees
+}
 
-	// See if this location is within the region
-	count := float64(0)
-	min := float64(0)
-	max := float64(0)
-	sum := float64(0)
-	radLock.Lock()
-	for _, e := range radEvents {
-		if e.Event.BestLat != 0 || e.Event.BestLon != 0 {
-			if metersApart(e.Event.BestLat, e.Event.BestLon, lat, lon) <= radiusMeters {
-				if count == 0 {
-					min = e.Usv
-					max = e.Usv
-				}
-				if e.Usv < min {
-					min = e.Usv
-				}
-				if e.Usv > max {
-					max = e.Usv
-				}
-				sum += e.Usv
-				count++
+// Distance handler, which lets integrators check their own distance math
+// against that used by the server
+func httpDistanceHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	names := []string{"lat1", "lon1", "lat2", "lon2"}
+	coords := map[string]float64{}
+	for _, name := range names {
+		v, err := strconv.ParseFloat(query.Get(name), 64)
+		limit := 90.0
+		if name == "lon1" || name == "lon2" {
+			limit = 180.0
+		}
+		if err != nil || math.IsNaN(v) || v < -limit || v > limit {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("%s must be a number between %g and %g", name, -limit, limit)))
+			return
+		}
+		coords[name] = v
+	}
+
+	o := map[string]interface{}{}
+	for name, v := range coords {
+		o[name] = v
+	}
+	o["distance_meters"] = metersApart(coords["lat1"], coords["lon1"], coords["lat2"], coords["lon2"])
+	o["earth_radius"] = earthRadiusName()
+	o["earth_radius_meters"] = earthRadiusMeters()
+	oJSON, err := json.Marshal(o)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(oJSON)
+
+}
+
+// The greatest possible distance between two points, which is half the
+// circumference of the earth using the same radius as metersApart
+func maxMetersApart() float64 {
+	return math.Pi * earthRadiusMeters()
+}
+
+// Compute the lat/lon box, in degrees, that encloses the circle of the specified
+// radius around a point.  The longitude span is that of the circle's widest point,
+// which is poleward of its center, so that no point within the circle falls
+// outside the box.  If the circle reaches a pole the box is widened to span all
+// longitudes.  If it crosses the antimeridian the box wraps around, with minLon
+// greater than maxLon, and spans the two ranges [minLon, 180] and [-180, maxLon].
+func boundingBox(lat float64, lon float64, radiusMeters float64) (minLat, maxLat, minLon, maxLon float64) {
+	angularRadius := radiusMeters / earthRadiusMeters()
+	deltaLat := angularRadius * (180 / math.Pi)
+	minLat = lat - deltaLat
+	maxLat = lat + deltaLat
+	minLon = -180
+	maxLon = 180
+	if minLat <= -90 || maxLat >= 90 {
+		minLat = math.Max(minLat, -90)
+		maxLat = math.Min(maxLat, 90)
+		return
+	}
+	deltaLon := math.Asin(math.Sin(angularRadius)/math.Cos(lat*math.Pi/180)) * (180 / math.Pi)
+	minLon = lon - deltaLon
+	maxLon = lon + deltaLon
+	if minLon < -180 {
+		minLon += 360
+	}
+	if maxLon > 180 {
+		maxLon -= 360
+	}
+	return
+}
+
+// A query region, with its enclosing bounding box computed once so that points
+// far outside it are rejected cheaply, before computing their precise distance
+type queryRegion struct {
+	lat, lon, radiusMeters         float64
+	minLat, maxLat, minLon, maxLon float64
+}
+
+// Create a query region of the specified radius around a point
+func newQueryRegion(lat float64, lon float64, radiusMeters float64) (q queryRegion) {
+	q.lat = lat
+	q.lon = lon
+	q.radiusMeters = radiusMeters
+	q.minLat, q.maxLat, q.minLon, q.maxLon = boundingBox(lat, lon, radiusMeters)
+	return
+}
+
+// Determine whether a point falls within the region.  A radius covering the
+// entire earth includes everything without computing any distances.  Points
+// outside the enclosing bounding box, which is matched as two longitude ranges if
+// it wraps around the antimeridian, are excluded without computing distances.
+// A radius at or above the configured large_radius_meters threshold uses just
+// the bounding box rather than the precise distance, which is an approximation
+// that also includes points in the corners of the box, up to ~41% beyond the
+// radius along the diagonals.
+func (q queryRegion) contains(lat float64, lon float64) bool {
+	if q.radiusMeters >= maxMetersApart() {
+		return true
+	}
+	if lat < q.minLat || lat > q.maxLat {
+		return false
+	}
+	if q.minLon <= q.maxLon && (lon < q.minLon || lon > q.maxLon) {
+		return false
+	}
+	if q.minLon > q.maxLon && lon < q.minLon && lon > q.maxLon {
+		return false
+	}
+	if config().LargeRadiusMeters > 0 && q.radiusMeters >= config().LargeRadiusMeters {
+		return true
+	}
+	return metersApart(lat, lon, q.lat, q.lon) <= q.radiusMeters
+}
+
+// Return the canonical UID of a device that may have been known by an alias
+func canonicalDeviceUID(deviceUID string) string {
+	canonicalUID, aliased := config().DeviceAliases[deviceUID]
+	if aliased {
+		return canonicalUID
+	}
+	return deviceUID
+}
+
+// Return a tenant's stored events with aliased devices collapsed to their canonical
+// UID, retaining the freshest reading of any device that still has separate entries
+// under old and new UIDs.  The caller must hold radLock and must not modify the
+// returned map.
+func canonicalEvents(tenant string) map[string]RadnoteEvent {
+	if len(config().DeviceAliases) == 0 {
+		return tenantEvents(tenant)
+	}
+	events := map[string]RadnoteEvent{}
+	for deviceUID, e := range tenantEvents(tenant) {
+		canonicalUID := canonicalDeviceUID(deviceUID)
+		existing, exists := events[canonicalUID]
+		if !exists || e.Event.When > existing.Event.When {
+			events[canonicalUID] = e
+		}
+	}
+	return events
+}
+
+// The request header with which a client may override the configured status of
+// responses for empty regions
+const emptyRegionStatusHeader = "X-Empty-Region-Status"
+
+// Determine the status with which to respond when a region contains no sensors.
+// This is 200, with a count of 0, unless 204 is configured for the deployment or
+// requested in the request's header.
+func emptyRegionStatus(r *http.Request) int {
+	switch r.Header.Get(emptyRegionStatusHeader) {
+	case "200":
+		return http.StatusOK
+	case "204":
+		return http.StatusNoContent
+	}
+	if config().EmptyRegionStatus == http.StatusNoContent {
+		return http.StatusNoContent
+	}
+	return http.StatusOK
+}
+
+// An event found within a query region, with the value of the queried metric and,
+// if it was needed, its distance from the query point
+type regionSample struct {
+	Event          RadnoteEvent
+	Value          float64
+	DistanceMeters float64
+	BearingDegrees float64
+	Weight         float64
+}
+
+// Return where a sample lies relative to the query point, for inclusion in its
+// device's feed item
+func (s regionSample) placement() map[string]interface{} {
+	return map[string]interface{}{"distance_meters": s.DistanceMeters, "bearing_degrees": s.BearingDegrees}
+}
+
+// Policies for readings whose location is less certain than a query's radius
+const (
+	locationAccuracyInclude = "include"
+	locationAccuracyExclude = "exclude"
+	locationAccuracyWeight  = "weight"
+)
+
+// The uncertainty, in meters, of each type of location, unless configured
+var defaultLocationAccuracyMeters = map[string]float64{
+	"gps":          10,
+	"triangulated": 200,
+	"tower":        5000,
+}
+
+// Return the uncertainty of an event's location, in meters, estimated from the
+// type of its best location, and whether it is known
+func locationAccuracyMeters(event note.Event) (meters float64, known bool) {
+	meters, known = config().LocationAccuracyMeters[event.BestLocationType]
+	if !known {
+		meters, known = defaultLocationAccuracyMeters[event.BestLocationType]
+	}
+	return
+}
+
+// Return the confidence with which an event lies within a query's radius, which
+// is 1 unless the uncertainty of its location exceeds the radius, in which case
+// it is the radius as a fraction of that uncertainty
+func locationWeight(event note.Event, radiusMeters float64) float64 {
+	meters, known := locationAccuracyMeters(event)
+	if !known || meters <= radiusMeters {
+		return 1
+	}
+	return radiusMeters / meters
+}
+
+// Orderings of the contributing events listed by include_events
+const (
+	eventSortWhen     = "when"
+	eventSortDistance = "distance"
+	eventSortUsv      = "usv"
+)
+
+// Sort samples most recent first, nearest first, or highest value first.  Ties
+// are broken by recency and then by device UID so that the order is stable.
+func sortRegionSamples(samples []regionSample, by string) {
+	sort.Slice(samples, func(i, j int) bool {
+		a := samples[i]
+		b := samples[j]
+		switch by {
+		case eventSortDistance:
+			if a.DistanceMeters != b.DistanceMeters {
+				return a.DistanceMeters < b.DistanceMeters
+			}
+		case eventSortUsv:
+			if a.Value != b.Value {
+				return a.Value > b.Value
 			}
 		}
+		if a.Event.Event.When != b.Event.Event.When {
+			return a.Event.Event.When > b.Event.Event.When
+		}
+		return a.Event.Event.DeviceUID < b.Event.Event.DeviceUID
+	})
+}
+
+// Collect every reading within a region that has a finite value for the metric,
+// along with its distance from the query point and its location weight.  Those
+// skipped for non-finite values are counted, as are those that couldn't be
+// placed in any region because they have no location.  A time range selects from
+// each device's stored readings rather than its latest.  The scan stops early if
+// the context is done.
+func scanRegion(ctx context.Context, tenant string, lat float64, lon float64, radiusMeters float64, metric string, since int64, until int64, accuracy string) (samples []regionSample, skipped int, noLocation int) {
+	samples = []regionSample{}
+	radLock.RLock()
+	defer radLock.RUnlock()
+	region := newQueryRegion(lat, lon, radiusMeters)
+	// The geohash index only locates devices by their latest reading, so it can't
+	// be used for time ranges, whose readings may have been taken elsewhere, nor
+	// when aliases merge devices' entries
+	candidates := canonicalEvents(tenant)
+	if since == 0 && until == 0 && len(config().DeviceAliases) == 0 {
+		indexed, ok := geohashCandidates(tenant, lat, lon, radiusMeters)
+		if ok {
+			candidates = indexed
+			noLocation = len(radUnlocated[tenant])
+		}
 	}
-	radLock.Unlock()
-	avg := float64(0)
-	if count > 0 {
-		avg = sum / count
+	for _, latest := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		readings := []RadnoteEvent{latest}
+		if since != 0 || until != 0 {
+			readings = readingsBetween(deviceReadings(tenant, latest.Event.DeviceUID), since, until)
+		}
+		for _, e := range readings {
+			if e.Event.BestLat == 0 && e.Event.BestLon == 0 {
+				noLocation++
+				continue
+			}
+			if !region.contains(e.Event.BestLat, e.Event.BestLon) {
+				continue
+			}
+			value, present := e.metricValue(metric)
+			if present && !finite(value) {
+				skipped++
+				present = false
+			}
+			weight := locationWeight(e.Event, radiusMeters)
+			if accuracy == locationAccuracyExclude && weight < 1 {
+				present = false
+			}
+			if present {
+				sample := regionSample{Event: e, Value: value, Weight: weight}
+				sample.DistanceMeters = metersApart(e.Event.BestLat, e.Event.BestLon, lat, lon)
+				sample.BearingDegrees = bearing(lat, lon, e.Event.BestLat, e.Event.BestLon)
+				samples = append(samples, sample)
+			}
+		}
 	}
+	return
+}
+
+// Summary statistics of the values in a region.  All are 0 for an empty region.
+type regionAggregate struct {
+	Count  int
+	Min    float64
+	Max    float64
+	Avg    float64
+	Median float64
+	Stddev float64
+}
+
+// Aggregate a region's samples, weighting the average by location accuracy if
+// requested, and by recency if a decay half-life is specified, so that a reading
+// halfLifeSecs older than now counts half as much as one taken now.  Readings
+// from the future count as if taken now.  The min and max are seeded from the
+// first value, so that zero and negative readings are handled.
+func aggregateRegion(samples []regionSample, accuracy string, halfLifeSecs float64, now int64) (a regionAggregate) {
+	if len(samples) == 0 {
+		return
+	}
+	weighted := accuracy == locationAccuracyWeight || halfLifeSecs > 0
+	values := []float64{}
+	sum := float64(0)
+	weightedSum := float64(0)
+	weightSum := float64(0)
+	for i, sample := range samples {
+		weight := float64(1)
+		if accuracy == locationAccuracyWeight {
+			weight = sample.Weight
+		}
+		if halfLifeSecs > 0 {
+			age := math.Max(0, float64(now-sample.Event.Event.When))
+			weight *= math.Exp2(-age / halfLifeSecs)
+		}
+		value := sample.Value
+		if i == 0 || value < a.Min {
+			a.Min = value
+		}
+		if i == 0 || value > a.Max {
+			a.Max = value
+		}
+		sum += value
+		weightedSum += value * weight
+		weightSum += weight
+		values = append(values, value)
+	}
+	a.Count = len(values)
+	if weighted && weightSum > 0 {
+		a.Avg = weightedSum / weightSum
+	} else {
+		a.Avg = sum / float64(a.Count)
+	}
+	a.Stddev = stddev(values)
+	sort.Float64s(values)
+	a.Median = percentile(values, 50)
+	return
+}
+
+// Generate a JSON feed for the specified location, aggregating the named metric
+func generateJsonFeed(w http.ResponseWriter, r *http.Request, tenant string, lat float64, lon float64, radiusMeters float64, metric string) {
 
-	// debug
-	if count == 0 {
-		fmt.Printf("NOT FOUND: %f,%f %f\n", lat, lon, radiusMeters)
-		radLock.Lock()
-		fmt.Printf("%+v\n", radEvents)
-		radLock.Unlock()
+	// If 0, make it a small region
+	if radiusMeters == 0 {
+		radiusMeters = 10
+	}
+
+	// Validate the requested aggregations, if any
+	query := r.URL.Query()
+	aggs, err := parseAggregations(query.Get("agg"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Validate the estimation mode, if any, which may also be requested as
+	// interpolate=idw with the power as p
+	estimate := query.Get("estimate")
+	if estimate == "" {
+		estimate = query.Get("interpolate")
+	}
+	powerStr := query.Get("power")
+	if powerStr == "" {
+		powerStr = query.Get("p")
+	}
+	power := idwDefaultPower
+	switch estimate {
+	case "":
+	case "idw":
+		power, err = idwPower(powerStr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("unknown estimate: " + estimate))
+		return
+	}
+
+	// Validate the contributing events option, if any
+	includeEvents := query.Get("include_events") == "true"
+	eventSort := query.Get("sort")
+	switch eventSort {
+	case "", eventSortWhen, eventSortDistance, eventSortUsv:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("sort must be when, distance, or usv"))
+		return
+	}
+
+	// Validate the output format
+	format := query.Get("format")
+	switch format {
+	case "", formatJSONFeed, formatGeoJSON, formatKML, formatAtom:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("format must be jsonfeed, geojson, kml, or atom"))
+		return
+	}
+
+	// Validate the time range, if any
+	since, until, err := parseTimeRange(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Validate the units in which the region's values are reported, which are
+	// converted from the uSv readings
+	units := query.Get("units")
+	unitsFactor, err := unitsConversion(units, metric)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Validate the feed items mode
+	itemsMode := query.Get("items")
+	switch itemsMode {
+	case "", itemsRegion, itemsDevices:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("items must be region or devices"))
+		return
+	}
+
+	// Validate the location accuracy policy, which may be overridden per request
+	accuracy := query.Get("accuracy")
+	if accuracy == "" {
+		accuracy = config().LocationAccuracyPolicy
+	}
+	switch accuracy {
+	case "", locationAccuracyInclude, locationAccuracyExclude, locationAccuracyWeight:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("accuracy must be include, exclude, or weight"))
+		return
+	}
+
+	// Validate the recency decay half-life, if any
+	halfLifeSecs := float64(0)
+	decayStr := query.Get("decay")
+	if decayStr != "" {
+		halfLifeSecs, err = strconv.ParseFloat(decayStr, 64)
+		if err != nil || !(halfLifeSecs > 0) || math.IsInf(halfLifeSecs, 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("decay must be a positive half-life in seconds"))
+			return
+		}
+	}
+
+	// Collect every event within the region, along with its distance from the
+	// query point
+	timing := newServerTiming()
+	samples, skipped, noLocation := scanRegion(r.Context(), tenant, lat, lon, radiusMeters, metric, since, until, accuracy)
+	if queryCanceled(w, r) {
+		return
+	}
+	values := []float64{}
+	distances := []float64{}
+	for i := range samples {
+		samples[i].Value *= unitsFactor
+		values = append(values, samples[i].Value)
+		distances = append(distances, samples[i].DistanceMeters)
+	}
+	timing.mark("scan")
+
+	// An empty region may be reported without content, rather than with a count of 0
+	if len(samples) == 0 && emptyRegionStatus(r) == http.StatusNoContent {
+		timing.writeHeader(w)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Aggregate them
+	agg := aggregateRegion(samples, accuracy, halfLifeSecs, time.Now().UTC().Unix())
+	timing.mark("aggregate")
+
+	// Note queries that match nothing, without holding the lock while logging
+	if agg.Count == 0 && slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+		radLock.RLock()
+		deviceCount := len(tenantEvents(tenant))
+		radLock.RUnlock()
+		slog.Debug("region not found", "lat", lat, "lon", lon, "radius_meters", radiusMeters, "since", since, "until", until, "devices", deviceCount)
 	}
-	// debug
 
 	o := map[string]interface{}{}
 	o["lat"] = lat
 	o["lon"] = lon
 	o["radius_meters"] = radiusMeters
-	o["count"] = count
-	o["usv_min"] = min
-	o["usv_max"] = max
-	o["usv_avg"] = avg
+	if since != 0 {
+		o["since"] = since
+	}
+	if until != 0 {
+		o["until"] = until
+	}
+	o["count"] = agg.Count
+	if skipped > 0 {
+		o["skipped_count"] = skipped
+	}
+	o["no_location_count"] = noLocation
+	o["metric"] = metric
+	label := metric
+	if units != "" {
+		label = units
+		o["units"] = units
+	}
+	o[label+"_min"] = agg.Min
+	o[label+"_max"] = agg.Max
+	o[label+"_avg"] = agg.Avg
+	o[label+"_median"] = agg.Median
+	o[label+"_stddev"] = agg.Stddev
+	if accuracy != "" && accuracy != locationAccuracyInclude {
+		o["accuracy"] = accuracy
+	}
+	if halfLifeSecs > 0 {
+		o["decay_half_life_secs"] = halfLifeSecs
+	}
+	o["devices"] = regionDevices(samples, label)
+	if len(aggs) > 0 {
+		o["stats"] = computeAggregations(values, aggs)
+	}
+	if estimate == "idw" && len(values) > 0 {
+		est := map[string]interface{}{}
+		est["method"] = estimate
+		est["power"] = power
+		est[label] = idwEstimate(values, distances, power)
+		o["estimate"] = est
+	}
+	if query.Get("histogram") == "true" {
+		edges := []float64{}
+		for _, edge := range config().HistogramEdgesUsv {
+			edges = append(edges, edge*unitsFactor)
+		}
+		openEnded := metric == defaultMetric && len(edges) > 0
+		if !openEnded {
+			edges = histogramAutoEdges(values)
+		}
+		h := map[string]interface{}{}
+		h["edges"] = edges
+		h["buckets"] = histogram(values, edges, openEnded)
+		o["histogram"] = h
+	}
+	if includeEvents {
+		sortRegionSamples(samples, eventSort)
+		events := []map[string]interface{}{}
+		for _, sample := range samples {
+			entry := map[string]interface{}{}
+			entry["device_uid"] = sample.Event.Event.DeviceUID
+			entry["when"] = sample.Event.Event.When
+			entry["lat"] = sample.Event.Event.BestLat
+			entry["lon"] = sample.Event.Event.BestLon
+			entry[label] = sample.Value
+			entry["distance_meters"] = sample.DistanceMeters
+			entry["bearing_degrees"] = sample.BearingDegrees
+			events = append(events, entry)
+		}
+		o["events"] = events
+	}
+	if !persistHealthy.Load() {
+		o["stale"] = true
+	}
+	o["captured"] = time.Now().UTC().Unix()
+	if format == formatGeoJSON {
+		writeRegionGeoJSON(w, lat, lon, radiusMeters, o, samples, timing)
+		return
+	}
+	if format == formatAtom {
+		writeRegionAtom(w, lat, lon, o, samples, timing)
+		return
+	}
+	if format == formatKML {
+		events := []RadnoteEvent{}
+		for _, sample := range samples {
+			events = append(events, sample.Event)
+		}
+		name := fmt.Sprintf("radnote readings within %gm of %f,%f", radiusMeters, lat, lon)
+		description := fmt.Sprintf("%d readings, averaging %s %s", len(samples), strconv.FormatFloat(agg.Avg, 'f', -1, 64), label)
+		writeKML(w, name, description, events, timing)
+		return
+	}
+	var deviceItems []jsonfeed.Item
+	if itemsMode == itemsDevices {
+		for _, sample := range samples {
+			deviceItems = append(deviceItems, deviceFeedItem(sample.Event, sample.placement()))
+		}
+	}
+	writeRegionFeed(w, r, "region", lat, lon, o, deviceItems, timing)
+
+}
+
+// Return the devices contributing to a region, nearest first, each with its most
+// recent contributing value, labeled as specified, and its distance from the
+// query point
+func regionDevices(samples []regionSample, label string) (devices []map[string]interface{}) {
+	latest := map[string]regionSample{}
+	for _, sample := range samples {
+		deviceUID := sample.Event.Event.DeviceUID
+		if prev, exists := latest[deviceUID]; !exists || sample.Event.Event.When > prev.Event.Event.When {
+			latest[deviceUID] = sample
+		}
+	}
+	nearest := []regionSample{}
+	for _, sample := range latest {
+		nearest = append(nearest, sample)
+	}
+	sortRegionSamples(nearest, eventSortDistance)
+	devices = []map[string]interface{}{}
+	for _, sample := range nearest {
+		entry := map[string]interface{}{}
+		entry["device_uid"] = sample.Event.Event.DeviceUID
+		entry[label] = sample.Value
+		entry["distance_meters"] = sample.DistanceMeters
+		entry["bearing_degrees"] = sample.BearingDegrees
+		devices = append(devices, entry)
+	}
+	return
+}
+
+// Return the largest number of devices that a nearest query may request, which
+// is bounded by feed_max_items so that its items are never paged, as paging
+// would reorder them by recency rather than distance
+func maxNearest() int {
+	if config().FeedMaxItems > 0 {
+		return config().FeedMaxItems - 1
+	}
+	return math.MaxInt32
+}
+
+// Generate a JSON feed of the n geolocated devices nearest to a point, however
+// far away they are, nearest first.  Devices at the same distance are ordered
+// most recent first, then by device UID.  The first item summarizes the query,
+// and each device's item includes its distance from the point.
+func generateNearestFeed(w http.ResponseWriter, r *http.Request, tenant string, lat float64, lon float64, n int, metric string) {
+
+	timing := newServerTiming()
+	samples := []regionSample{}
+	radLock.RLock()
+	for _, e := range canonicalEvents(tenant) {
+		if e.Event.BestLat == 0 && e.Event.BestLon == 0 {
+			continue
+		}
+		value, present := e.metricValue(metric)
+		if !present || !finite(value) {
+			continue
+		}
+		sample := regionSample{Event: e, Value: value}
+		sample.DistanceMeters = metersApart(e.Event.BestLat, e.Event.BestLon, lat, lon)
+		sample.BearingDegrees = bearing(lat, lon, e.Event.BestLat, e.Event.BestLon)
+		samples = append(samples, sample)
+	}
+	radLock.RUnlock()
+	sortRegionSamples(samples, eventSortDistance)
+	if len(samples) > n {
+		samples = samples[:n]
+	}
+	timing.mark("scan")
+
+	o := map[string]interface{}{}
+	o["lat"] = lat
+	o["lon"] = lon
+	o["nearest"] = n
+	o["count"] = len(samples)
+	o["metric"] = metric
+	if len(samples) > 0 {
+		o["farthest_meters"] = samples[len(samples)-1].DistanceMeters
+	}
+	if !persistHealthy.Load() {
+		o["stale"] = true
+	}
 	o["captured"] = time.Now().UTC().Unix()
+
+	items := []jsonfeed.Item{}
+	for _, sample := range samples {
+		items = append(items, deviceFeedItem(sample.Event, sample.placement()))
+	}
+	writeRegionFeed(w, r, "nearest", lat, lon, o, items, timing)
+
+}
+
+// Output formats of region queries
+const (
+	formatJSONFeed = "jsonfeed"
+	formatGeoJSON  = "geojson"
+	formatKML      = "kml"
+	formatAtom     = "atom"
+)
+
+// Write a region as a GeoJSON FeatureCollection, in which the query boundary
+// carries the region's aggregate properties and each device in the region is a
+// point feature
+func writeRegionGeoJSON(w http.ResponseWriter, lat float64, lon float64, radiusMeters float64, o map[string]interface{}, samples []regionSample, timing *serverTiming) {
+
+	boundary := geojsonQueryBoundary(lat, lon, radiusMeters)
+	for k, v := range o {
+		if k != "events" && k != "devices" {
+			boundary.Properties[k] = v
+		}
+	}
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{boundary}}
+	for _, sample := range samples {
+		fc.Features = append(fc.Features, geojsonDeviceFeature(sample.Event))
+	}
+
+	fcJSON, err := json.Marshal(fc)
+	if err != nil {
+		slog.Error("can't marshal geojson", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	timing.mark("serialize")
+	timing.writeHeader(w)
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	_, _ = w.Write(fcJSON)
+
+}
+
+// Feed item modes of region queries: a single aggregate item for the region, or
+// that item followed by one item per device in the region
+const (
+	itemsRegion  = "region"
+	itemsDevices = "devices"
+)
+
+// Return a feed item describing a device's latest reading, published at its When,
+// with any further properties supplied
+func deviceFeedItem(e RadnoteEvent, extra map[string]interface{}) (i jsonfeed.Item) {
+	o := map[string]interface{}{}
+	for k, v := range extra {
+		o[k] = v
+	}
+	o["device_uid"] = e.Event.DeviceUID
+	o["when"] = e.Event.When
+	o["lat"] = e.Event.BestLat
+	o["lon"] = e.Event.BestLon
+	o["usv"] = e.Body.Usv
+	o["cpm"] = e.Body.Cpm
+	for metric, value := range e.Metrics {
+		if _, exists := o[metric]; !exists {
+			o[metric] = value
+		}
+	}
+	oJSON, _ := json.Marshal(o)
+	i.ID = e.Event.DeviceUID
+	i.URL = fmt.Sprintf("https://geofeeds.net/radnote/history?device=%s", url.QueryEscape(e.Event.DeviceUID))
+	i.ContentText = string(oJSON)
+	i.DatePublished = time.Unix(e.Event.When, 0).UTC()
+	i.DateModified = i.DatePublished
+	return
+}
+
+// Write a JSON feed whose first item's content is the specified object, followed
+// by any further items, including the request's timing if supplied
+func writeRegionFeed(w http.ResponseWriter, r *http.Request, itemID string, lat float64, lon float64, o map[string]interface{}, items []jsonfeed.Item, timing *serverTiming) {
+
 	oJSON, err := json.Marshal(o)
 	if err != nil {
-		fmt.Printf("generateJsonFeed: %s\n", err)
+		slog.Error("can't marshal feed item", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var i jsonfeed.Item
-	i.ID = "region"
+	i.ID = itemID
 	i.URL = fmt.Sprintf("https://geofeeds.net/radnote/%s?lat=%f&lon=%f", i.ID, lat, lon)
 	i.ContentText = string(oJSON)
 	i.DatePublished = time.Now().UTC()
 	i.DateModified = i.DatePublished
 
+	writeFeed(w, r, lat, lon, append([]jsonfeed.Item{i}, items...), timing)
+
+}
+
+// Write a JSON feed containing the specified items, capped to feed_max_items
+func writeFeed(w http.ResponseWriter, r *http.Request, lat float64, lon float64, items []jsonfeed.Item, timing *serverTiming) {
+
 	var f jsonfeed.Feed
 	f.Version = "https://jsonfeed.org/version/1"
 	f.Title = fmt.Sprintf("radnote geofeed for %f,%f", lat, lon)
 	f.FeedURL = fmt.Sprintf("https://geofeeds.net/radnote/?lat=%f&lon=%f", lat, lon)
-	f.Items = append(f.Items, i)
+	f.Items = items
+	capFeedItems(&f, r)
 
 	feedJSON, err := f.MarshalJSON()
 	if err != nil {
-		fmt.Printf("generateJsonFeed: %s\n", err)
+		slog.Error("can't marshal feed", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	timing.mark("serialize")
+	timing.writeHeader(w)
 
 	_, _ = w.Write(feedJSON)
 
 }
+
+// Truncate a feed to at most feed_max_items items.  The first item, which is the
+// aggregate for the region, is always retained.  The remaining items are ordered
+// most recently published first, and the page of them starting at the request's
+// offset parameter is retained, with next_url set to continue from the next page.
+func capFeedItems(f *jsonfeed.Feed, r *http.Request) {
+
+	maxItems := config().FeedMaxItems
+	if maxItems <= 0 || len(f.Items) <= 1 {
+		return
+	}
+	pageSize := maxItems - 1
+	pinned := f.Items[0]
+	rest := append([]jsonfeed.Item{}, f.Items[1:]...)
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset <= 0 && len(rest) <= pageSize {
+		return
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(rest) {
+		offset = len(rest)
+	}
+
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].DatePublished.After(rest[j].DatePublished)
+	})
+	end := offset + pageSize
+	if end > len(rest) {
+		end = len(rest)
+	}
+	f.Items = append([]jsonfeed.Item{pinned}, rest[offset:end]...)
+
+	if end < len(rest) {
+		query.Set("offset", strconv.Itoa(end))
+		f.NextURL = fmt.Sprintf("https://geofeeds.net%s?%s", r.URL.Path, query.Encode())
+	}
+
+}
+
+// Parse the since and until query parameters, which may be Unix seconds or
+// RFC3339 timestamps.  A missing parameter is returned as 0, leaving that end of
+// the range unbounded.
+func parseTimeRange(query url.Values) (since int64, until int64, err error) {
+	since, err = parseTimeParam("since", query.Get("since"))
+	if err == nil {
+		until, err = parseTimeParam("until", query.Get("until"))
+	}
+	if err == nil && since != 0 && until != 0 && until < since {
+		err = fmt.Errorf("until must not be before since")
+	}
+	return
+}
+
+// Parse a time query parameter given as Unix seconds or an RFC3339 timestamp
+func parseTimeParam(name string, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return secs, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be Unix seconds or an RFC3339 timestamp", name)
+	}
+	return t.Unix(), nil
+}
+
+// Return the readings whose When falls within [since, until], where a zero since
+// or until leaves that end unbounded
+func readingsBetween(readings []RadnoteEvent, since int64, until int64) (within []RadnoteEvent) {
+	for _, reading := range readings {
+		if since != 0 && reading.Event.When < since {
+			continue
+		}
+		if until != 0 && reading.Event.When > until {
+			continue
+		}
+		within = append(within, reading)
+	}
+	return
+}
+
+// Readings retained for a tenant's device, oldest first.  A device whose latest
+// reading was stored before history was retained degrades to that single reading.
+// The caller must hold radLock and must not modify the returned slice.
+func deviceReadings(tenant string, deviceUID string) (readings []RadnoteEvent) {
+	readings = radHistory[tenant][deviceUID]
+	if len(readings) > 0 {
+		return
+	}
+	e, exists := tenantEvents(tenant)[deviceUID]
+	if exists {
+		readings = append(readings, e)
+	}
+	return
+}
+
+// A device in the list sorted by distance from a point.  Devices without a
+// location have no distance or bearing.
+type radDistanceEntry struct {
+	RadnoteEvent
+	DistanceMeters *float64 `json:"distance_meters,omitempty"`
+	BearingDegrees *float64 `json:"bearing_degrees,omitempty"`
+}
+
+// Write every device of a tenant as an array, nearest to a point first, followed
+// by any devices without a location.  Devices at the same distance, and those
+// without a location, are ordered by device UID.
+func generateDistanceList(w http.ResponseWriter, r *http.Request, tenant string, lat float64, lon float64) {
+
+	timing := newServerTiming()
+	entries := []radDistanceEntry{}
+	radLock.RLock()
+	for _, e := range tenantEvents(tenant) {
+		entry := radDistanceEntry{RadnoteEvent: e}
+		if !(e.Event.BestLat == 0 && e.Event.BestLon == 0) {
+			distance := metersApart(e.Event.BestLat, e.Event.BestLon, lat, lon)
+			direction := bearing(lat, lon, e.Event.BestLat, e.Event.BestLon)
+			entry.DistanceMeters = &distance
+			entry.BearingDegrees = &direction
+		}
+		entries = append(entries, entry)
+	}
+	radLock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		di, dj := entries[i].DistanceMeters, entries[j].DistanceMeters
+		if (di == nil) != (dj == nil) {
+			return dj == nil
+		}
+		if di != nil && *di != *dj {
+			return *di < *dj
+		}
+		return entries[i].Event.DeviceUID < entries[j].Event.DeviceUID
+	})
+	timing.mark("sort")
+
+	listJSON, err := json.MarshalIndent(entries, "", "    ")
+	timing.mark("serialize")
+	timing.writeHeader(w)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(listJSON)
+
+}
+
+// The longest sparkline that may be requested when listing devices
+const maxSparklineLen = 100
+
+// A device in the full listing, optionally with its recent uSv readings
+type radListingEntry struct {
+	RadnoteEvent
+	Sparkline []float64 `json:"sparkline,omitempty"`
+}
+
+// The number of devices in a page of the full list, by default and at most
+const (
+	listingDefaultLimit = 100
+	listingMaxLimit     = 1000
+)
+
+// Return a page of a tenant's devices, in order of device UID, along with the
+// total number of devices.  An offset beyond the last device yields an empty
+// page.  The caller must hold radLock.
+func listingPage(tenant string, offset int, limit int, sparklineLen int) map[string]interface{} {
+	events := tenantEvents(tenant)
+	deviceUIDs := []string{}
+	for deviceUID := range events {
+		deviceUIDs = append(deviceUIDs, deviceUID)
+	}
+	sort.Strings(deviceUIDs)
+	devices := []radListingEntry{}
+	for i := offset; i < len(deviceUIDs) && i < offset+limit; i++ {
+		entry := radListingEntry{RadnoteEvent: events[deviceUIDs[i]]}
+		if sparklineLen > 0 {
+			entry.Sparkline = deviceSparkline(tenant, deviceUIDs[i], sparklineLen)
+		}
+		devices = append(devices, entry)
+	}
+	o := map[string]interface{}{}
+	o["total"] = len(deviceUIDs)
+	o["offset"] = offset
+	o["limit"] = limit
+	o["devices"] = devices
+	return o
+}
+
+// Return up to the last n uSv readings for a device, oldest first, or nil if
+// there is too little history to draw a trend.  The caller must hold radLock.
+func deviceSparkline(tenant string, deviceUID string, n int) (series []float64) {
+	readings := deviceReadings(tenant, deviceUID)
+	if len(readings) < 2 {
+		return nil
+	}
+	if len(readings) > n {
+		readings = readings[len(readings)-n:]
+	}
+	for _, reading := range readings {
+		series = append(series, reading.Body.Usv)
+	}
+	return
+}
+
+// Generate a JSON feed describing the highest uSv reading ever recorded within
+// the region, optionally constrained to readings whose When falls within [since,
+// until].  A zero since or until leaves that end unbounded.  Each reading is
+// placed by its own location, so a device that has moved is only credited with
+// the readings it took within the region, and readings without a uSv
+// measurement are ignored.
+func generatePeakFeed(w http.ResponseWriter, r *http.Request, tenant string, lat float64, lon float64, radiusMeters float64, since int64, until int64) {
+
+	// If 0, make it a small region
+	if radiusMeters == 0 {
+		radiusMeters = 10
+	}
+
+	// Scan the stored readings of every device in the region
+	timing := newServerTiming()
+	found := false
+	var peak RadnoteEvent
+	peakUsv := float64(0)
+	region := newQueryRegion(lat, lon, radiusMeters)
+	radLock.RLock()
+	for deviceUID := range tenantEvents(tenant) {
+		if r.Context().Err() != nil {
+			break
+		}
+		for _, reading := range readingsBetween(deviceReadings(tenant, deviceUID), since, until) {
+			if reading.Event.BestLat == 0 && reading.Event.BestLon == 0 {
+				continue
+			}
+			if !region.contains(reading.Event.BestLat, reading.Event.BestLon) {
+				continue
+			}
+			usv, present := reading.metricValue(defaultMetric)
+			if !present || !finite(usv) {
+				continue
+			}
+			if !found || usv > peakUsv {
+				peak = reading
+				peakUsv = usv
+				found = true
+			}
+		}
+	}
+	radLock.RUnlock()
+	if queryCanceled(w, r) {
+		return
+	}
+	timing.mark("scan")
+
+	o := map[string]interface{}{}
+	o["lat"] = lat
+	o["lon"] = lon
+	o["radius_meters"] = radiusMeters
+	if since != 0 {
+		o["since"] = since
+	}
+	if until != 0 {
+		o["until"] = until
+	}
+	o["found"] = found
+	if found {
+		o["usv"] = peakUsv
+		o["when"] = peak.Event.When
+		o["device"] = peak.Event.DeviceUID
+	}
+	if !persistHealthy.Load() {
+		o["stale"] = true
+	}
+	o["captured"] = time.Now().UTC().Unix()
+	writeRegionFeed(w, r, "peak", lat, lon, o, nil, timing)
+
+}
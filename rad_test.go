@@ -0,0 +1,1227 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/blues/note-go/note"
+)
+
+// A reading refused because the write queue is full must be stored when retried
+// once the queue has drained, rather than acknowledged as a duplicate
+func TestIngestRetryAfterQueueFull(t *testing.T) {
+	testService(t, Config{PersistIntervalMs: 60000, WriteQueueMax: 1})
+
+	first := testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	first.EventUID = "event-1"
+	w := testPost(t, first)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first reading: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	second := testReading("dev:2", 1700000060, 42.2, -71.2, map[string]interface{}{"usv": 0.2})
+	second.EventUID = "event-2"
+	w = testPost(t, second)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("reading with a full queue: got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("refused reading has no Retry-After")
+	}
+	if _, exists := testStored("dev:2"); exists {
+		t.Fatalf("refused reading was stored")
+	}
+
+	err := flushNow()
+	if err != nil {
+		t.Fatalf("can't flush: %s", err)
+	}
+	duplicates := statSkippedDuplicate.Load()
+	w = testPost(t, second)
+	if w.Code != http.StatusOK {
+		t.Fatalf("retried reading: got %d, want %d", w.Code, http.StatusOK)
+	}
+	e, exists := testStored("dev:2")
+	if !exists || e.Body.Usv != 0.2 {
+		t.Fatalf("retried reading wasn't stored: exists %t, usv %g", exists, e.Body.Usv)
+	}
+	if statSkippedDuplicate.Load() != duplicates {
+		t.Errorf("retried reading was counted as a duplicate")
+	}
+}
+
+// The peak of a region is the highest uSv reading taken within it, placing each
+// reading by its own location rather than by its device's latest location
+func TestPeakFeedPlacesEachReading(t *testing.T) {
+	testService(t, Config{})
+
+	readings := []note.Event{
+		// A device that has since left the region
+		testReading("dev:left", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.5}),
+		testReading("dev:left", 1700000100, 10, 10, map[string]interface{}{"usv": 0.1}),
+		// A device that has since entered the region
+		testReading("dev:entered", 1700000000, 10, 10, map[string]interface{}{"usv": 9.0}),
+		testReading("dev:entered", 1700000100, 42.1, -71.1, map[string]interface{}{"usv": 0.2}),
+		// A device whose reading has no uSv measurement
+		testReading("dev:unmeasured", 1700000200, 42.1, -71.1, map[string]interface{}{"temperature": 21.5}),
+	}
+	for _, reading := range readings {
+		w := testPost(t, reading)
+		if w.Code != http.StatusOK {
+			t.Fatalf("can't ingest reading: got %d", w.Code)
+		}
+	}
+
+	peak := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&peak=true"))
+	if peak["found"] != true || peak["usv"] != 0.5 || peak["device"] != "dev:left" {
+		t.Errorf("peak: got found %v usv %v device %v, want found true usv 0.5 device dev:left", peak["found"], peak["usv"], peak["device"])
+	}
+}
+
+// A region whose readings have no uSv measurement has no peak
+func TestPeakFeedWithoutMeasurements(t *testing.T) {
+	testService(t, Config{})
+
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"temperature": 21.5}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+
+	peak := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&peak=true"))
+	if peak["found"] != false {
+		t.Errorf("peak: got found %v usv %v, want found false", peak["found"], peak["usv"])
+	}
+}
+
+// Reloading the data first writes readings whose write was buffered, rather than
+// discarding them
+func TestReloadKeepsBufferedReadings(t *testing.T) {
+	testService(t, Config{PersistIntervalMs: 60000})
+
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	count, err := reloadData()
+	if err != nil {
+		t.Fatalf("can't reload: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("reload: got %d devices, want 1", count)
+	}
+	if _, exists := testStored("dev:1"); !exists {
+		t.Errorf("buffered reading was lost by the reload")
+	}
+	if depth := writeQueueDepth(); depth != 0 {
+		t.Errorf("write queue depth after reload: got %d, want 0", depth)
+	}
+}
+
+// Return whether two values are equal within a small tolerance
+func testNear(a float64, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+// Every value reported for a region is converted into the requested units, and
+// an unknown unit is refused
+func TestUnitsConversion(t *testing.T) {
+	testService(t, Config{HistogramEdgesUsv: []float64{0.1, 0.3}})
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.2}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	region := "/radiation?lat=42.1&lon=-71.1&radius_meters=1000"
+
+	o := testFeedContent(t, testGet(region+"&units=nsv&histogram=true&include_events=true&agg=max&estimate=idw"))
+	checks := map[string]interface{}{
+		"nsv_avg":          o["nsv_avg"],
+		"devices[0].nsv":   o["devices"].([]interface{})[0].(map[string]interface{})["nsv"],
+		"events[0].nsv":    o["events"].([]interface{})[0].(map[string]interface{})["nsv"],
+		"stats.max":        o["stats"].(map[string]interface{})["max"],
+		"estimate.nsv":     o["estimate"].(map[string]interface{})["nsv"],
+		"histogram.edges1": o["histogram"].(map[string]interface{})["edges"].([]interface{})[1],
+	}
+	want := map[string]float64{"histogram.edges1": 300}
+	for name, got := range checks {
+		wantValue, specified := want[name]
+		if !specified {
+			wantValue = 200
+		}
+		v, ok := got.(float64)
+		if !ok || !testNear(v, wantValue) {
+			t.Errorf("%s: got %v, want %g", name, got, wantValue)
+		}
+	}
+
+	o = testFeedContent(t, testGet(region+"&units=cpm"))
+	if v, ok := o["cpm_avg"].(float64); !ok || !testNear(v, 0.2/sensorDefaultFactor) {
+		t.Errorf("cpm_avg: got %v, want %g", o["cpm_avg"], 0.2/sensorDefaultFactor)
+	}
+
+	w = testGet(region + "&units=nsv&format=kml")
+	if !strings.Contains(w.Body.String(), "averaging 200 nsv") {
+		t.Errorf("kml description isn't in nSv: %s", w.Body.String())
+	}
+
+	w = testGet(region + "&units=sievert")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown units: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Readings older than max_past_age_seconds are rejected, or clamped to the time
+// they were received, depending on the policy
+func TestPastAgePolicies(t *testing.T) {
+	now := time.Now().UTC().Unix()
+	stale := testReading("dev:1", now-7200, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+
+	testService(t, Config{MaxPastAgeSecs: 3600, PastAgePolicy: pastAgePolicyReject})
+	w := testPost(t, stale)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("reject policy: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if _, exists := testStored("dev:1"); exists {
+		t.Errorf("reject policy: stale reading was stored")
+	}
+	w = testPost(t, testReading("dev:2", now-60, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Errorf("reject policy: recent reading got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	testService(t, Config{MaxPastAgeSecs: 3600, PastAgePolicy: pastAgePolicyClamp})
+	w = testPost(t, stale)
+	if w.Code != http.StatusOK {
+		t.Fatalf("clamp policy: got %d, want %d", w.Code, http.StatusOK)
+	}
+	e, exists := testStored("dev:1")
+	if !exists || e.Event.When < now {
+		t.Errorf("clamp policy: got when %d, want the receipt time, at least %d", e.Event.When, now)
+	}
+}
+
+// A device with entries under both an old and a new UID is counted once in a
+// region, by its freshest reading
+func TestAliasedDeviceCountedOnce(t *testing.T) {
+	testService(t, Config{DeviceAliases: map[string]string{"dev:old": "dev:new"}})
+	readings := []note.Event{
+		testReading("dev:old", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 1.0}),
+		testReading("dev:new", 1700000060, 42.1, -71.1, map[string]interface{}{"usv": 0.2}),
+	}
+	for _, reading := range readings {
+		w := testPost(t, reading)
+		if w.Code != http.StatusOK {
+			t.Fatalf("can't ingest reading: got %d", w.Code)
+		}
+	}
+
+	o := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if o["count"] != float64(1) || o["usv_avg"] != 0.2 {
+		t.Errorf("got count %v usv_avg %v, want 1 and 0.2", o["count"], o["usv_avg"])
+	}
+}
+
+// Timestamps sent in milliseconds are normalized to seconds, whether detected by
+// their magnitude or configured
+func TestNormalizeEventWhen(t *testing.T) {
+	tests := []struct {
+		unit string
+		when int64
+		want int64
+	}{
+		{"", 1700000000, 1700000000},
+		{"", 1700000000123, 1700000000},
+		{whenUnitAuto, 1700000000123, 1700000000},
+		{whenUnitSeconds, 1700000000, 1700000000},
+		{whenUnitMilliseconds, 1700000000123, 1700000000},
+		{whenUnitMilliseconds, 1700000000, 1700000},
+	}
+	for _, test := range tests {
+		testService(t, Config{WhenUnit: test.unit})
+		event := note.Event{When: test.when}
+		normalizeEventWhen(&event)
+		if event.When != test.want {
+			t.Errorf("when_unit %q, when %d: got %d, want %d", test.unit, test.when, event.When, test.want)
+		}
+	}
+
+	testService(t, Config{})
+	w := testPost(t, testReading("dev:1", 1700000000123, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+	e, _ := testStored("dev:1")
+	if e.Event.When != 1700000000 {
+		t.Errorf("stored when: got %d, want 1700000000", e.Event.When)
+	}
+}
+
+// Each kind of body is classified, and stored or skipped according to the empty
+// body policy
+func TestEventBodyKinds(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        map[string]interface{}
+		kind        string
+		storedSkip  bool
+		storedStore bool
+	}{
+		{"missing", nil, bodyKindMissing, false, true},
+		{"empty", map[string]interface{}{}, bodyKindEmpty, false, true},
+		{"non-numeric", map[string]interface{}{"sensor": "LND7317"}, bodyKindEmpty, false, true},
+		{"no measurement", map[string]interface{}{"temperature": 21.5}, bodyKindNoMeasurement, true, true},
+		{"measured", map[string]interface{}{"usv": 0.1}, bodyKindMeasured, true, true},
+	}
+	for _, test := range tests {
+		event := testReading("dev:1", 1700000000, 42.1, -71.1, test.body)
+		if kind := eventBodyKind(event); kind != test.kind {
+			t.Errorf("%s: got kind %s, want %s", test.name, kind, test.kind)
+		}
+		for _, policy := range []string{emptyBodyPolicySkip, emptyBodyPolicyStore} {
+			testService(t, Config{EmptyBodyPolicy: policy})
+			w := testPost(t, event)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s, %s policy: got %d, want %d", test.name, policy, w.Code, http.StatusOK)
+			}
+			want := test.storedSkip
+			if policy == emptyBodyPolicyStore {
+				want = test.storedStore
+			}
+			e, stored := testStored("dev:1")
+			if stored != want {
+				t.Errorf("%s, %s policy: got stored %t, want %t", test.name, policy, stored, want)
+			}
+			if stored && test.kind == bodyKindNoMeasurement {
+				if _, present := e.metricValue(defaultMetric); present {
+					t.Errorf("%s, %s policy: stored with a uSv reading", test.name, policy)
+				}
+			}
+		}
+	}
+}
+
+// A reading POSTed to the ingest handler is served, with its full body, by the
+// full list and by region queries
+func TestIngestAndQueryEndToEnd(t *testing.T) {
+	testService(t, Config{})
+
+	w := testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.12, "cpm": 40, "temperature": 21.5, "voltage": 3.9}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("can't ingest reading: got %d", w.Code)
+	}
+
+	w = testGet("/radiation")
+	if w.Code != http.StatusOK {
+		t.Fatalf("full list: got %d, want %d", w.Code, http.StatusOK)
+	}
+	listing := map[string]RadnoteEvent{}
+	err := json.Unmarshal(w.Body.Bytes(), &listing)
+	if err != nil {
+		t.Fatalf("full list doesn't parse: %s", err)
+	}
+	e := listing["dev:1"]
+	if e.Body.Usv != 0.12 || e.Body.Cpm != 40 || e.Body.TemperatureC != 21.5 || e.Body.Voltage != 3.9 {
+		t.Errorf("full list: got body %+v", e.Body)
+	}
+
+	o := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if o["count"] != float64(1) || o["usv_avg"] != 0.12 {
+		t.Errorf("region: got count %v usv_avg %v, want 1 and 0.12", o["count"], o["usv_avg"])
+	}
+}
+
+// A body that can't be read is answered with a 500 status, and one that can't be
+// parsed, whether a single event or a batch, with a 400, rather than with an
+// error message under a 200
+func TestIngestErrorStatus(t *testing.T) {
+	testService(t, Config{})
+
+	r := httptest.NewRequest(http.MethodPost, "/radnote", iotest.ErrReader(errors.New("connection reset")))
+	w := testServe(r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unreadable body: got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	for _, body := range []string{`{"device":`, `[{"device":`} {
+		r = httptest.NewRequest(http.MethodPost, "/radnote", strings.NewReader(body))
+		w = testServe(r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unparseable body %s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+		if w.Body.Len() == 0 {
+			t.Errorf("unparseable body %s: no error message", body)
+		}
+	}
+}
+
+// Return region samples with the specified values
+func testSamples(values ...float64) (samples []regionSample) {
+	for _, value := range values {
+		samples = append(samples, regionSample{Value: value, Weight: 1})
+	}
+	return
+}
+
+// The min and max of a region are seeded from its first value, so that zero and
+// negative values are handled
+func TestAggregateRegionMinMax(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		min, max float64
+		avg      float64
+	}{
+		{"single", []float64{0.15}, 0.15, 0.15, 0.15},
+		{"all equal", []float64{0.2, 0.2, 0.2}, 0.2, 0.2, 0.2},
+		{"including zero", []float64{0.3, 0.0, 0.6}, 0.0, 0.6, 0.3},
+		{"all above zero", []float64{0.5, 0.25, 0.75}, 0.25, 0.75, 0.5},
+		{"negative", []float64{-0.5, -1.5}, -1.5, -0.5, -1},
+	}
+	for _, test := range tests {
+		a := aggregateRegion(testSamples(test.values...), "", 0, 0)
+		if a.Count != len(test.values) || a.Min != test.min || a.Max != test.max || !testNear(a.Avg, test.avg) {
+			t.Errorf("%s: got count %d min %g max %g avg %g, want %d, %g, %g, %g", test.name, a.Count, a.Min, a.Max, a.Avg, len(test.values), test.min, test.max, test.avg)
+		}
+	}
+
+	a := aggregateRegion(nil, "", 0, 0)
+	if a.Count != 0 || a.Min != 0 || a.Max != 0 {
+		t.Errorf("empty: got count %d min %g max %g, want all 0", a.Count, a.Min, a.Max)
+	}
+}
+
+// Return a region sample of a value read at a time
+func testSampleAt(value float64, when int64) regionSample {
+	s := regionSample{Value: value, Weight: 1}
+	s.Event.Event.When = when
+	return s
+}
+
+// With a decay half-life the average is weighted by recency, so that recent
+// readings dominate; without one it is the simple mean
+func TestAggregateRegionDecay(t *testing.T) {
+	now := int64(1700000000)
+	day := int64(24 * 60 * 60)
+	samples := []regionSample{testSampleAt(1, now), testSampleAt(10, now-3*day)}
+	tests := []struct {
+		name         string
+		samples      []regionSample
+		halfLifeSecs float64
+		avg          float64
+	}{
+		{"no decay", samples, 0, 5.5},
+		{"half-life of the older reading's age", samples, float64(3 * day), (1 + 10*0.5) / 1.5},
+		{"hour half-life", samples, 3600, 1},
+		{"future reading counts as now", []regionSample{testSampleAt(1, now), testSampleAt(3, now+3600)}, 3600, 2},
+		{"all old", []regionSample{testSampleAt(2, now-30*day), testSampleAt(4, now-30*day)}, 3600, 3},
+	}
+	for _, test := range tests {
+		a := aggregateRegion(test.samples, "", test.halfLifeSecs, now)
+		if !testNear(a.Avg, test.avg) {
+			t.Errorf("%s: got avg %g, want %g", test.name, a.Avg, test.avg)
+		}
+		if a.Min != math.Min(test.samples[0].Value, test.samples[1].Value) || a.Count != 2 {
+			t.Errorf("%s: decay changed count %d or min %g", test.name, a.Count, a.Min)
+		}
+	}
+
+	testService(t, Config{})
+	current := time.Now().UTC().Unix()
+	testPostReading(t, "dev:recent", current-60, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:old", current-3*day, 42.101, -71.1, map[string]interface{}{"usv": 1.0})
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if !testNear(content["usv_avg"].(float64), 0.55) || content["decay_half_life_secs"] != nil {
+		t.Errorf("without decay: got avg %v half-life %v, want 0.55 and none", content["usv_avg"], content["decay_half_life_secs"])
+	}
+	content = testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&decay=3600"))
+	if avg := content["usv_avg"].(float64); avg < 0.1 || avg > 0.1001 || content["decay_half_life_secs"] != float64(3600) {
+		t.Errorf("with decay: got avg %v half-life %v, want about 0.1 and 3600", content["usv_avg"], content["decay_half_life_secs"])
+	}
+	for _, decay := range []string{"0", "-60", "soon", "NaN"} {
+		if w := testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&decay=" + decay); w.Code != http.StatusBadRequest {
+			t.Errorf("decay=%s: got %d, want %d", decay, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// The temperature and voltage of a region are aggregated over only the devices
+// reporting them, a reading of 0 counts, and uSv remains the default metric
+func TestRegionMetrics(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:usv-only", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:warm", 1700000000, 42.101, -71.1, map[string]interface{}{"usv": 0.2, "temperature": 20.0, "voltage": 3.6})
+	testPostReading(t, "dev:freezing", 1700000000, 42.1, -71.101, map[string]interface{}{"usv": 0.3, "temperature": 0.0})
+	testPostReading(t, "dev:cold", 1700000000, 42.099, -71.1, map[string]interface{}{"usv": 0.6, "temperature": -5.0, "voltage": 4.2})
+
+	tests := []struct {
+		metric        string
+		count         float64
+		min, max, avg float64
+	}{
+		{"", 4, 0.1, 0.6, 0.3},
+		{"usv", 4, 0.1, 0.6, 0.3},
+		{"temperature", 3, -5, 20, 5},
+		{"voltage", 2, 3.6, 4.2, 3.9},
+	}
+	for _, test := range tests {
+		content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&metric="+test.metric))
+		label := test.metric
+		if label == "" {
+			label = defaultMetric
+		}
+		if content["metric"] != label || content["count"] != test.count {
+			t.Errorf("metric %q: got metric %v count %v, want %s and %g", test.metric, content["metric"], content["count"], label, test.count)
+			continue
+		}
+		min, _ := content[label+"_min"].(float64)
+		max, _ := content[label+"_max"].(float64)
+		avg, _ := content[label+"_avg"].(float64)
+		if !testNear(min, test.min) || !testNear(max, test.max) || !testNear(avg, test.avg) {
+			t.Errorf("metric %q: got min %g max %g avg %g, want %g, %g, %g", test.metric, min, max, avg, test.min, test.max, test.avg)
+		}
+	}
+
+	// A region in which no device reports the metric is empty
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=10&metric=voltage"))
+	if content["count"] != float64(0) {
+		t.Errorf("voltage near dev:usv-only: got count %v, want 0", content["count"])
+	}
+}
+
+// Events stored before metrics were retained report a temperature or voltage
+// only if it is nonzero, since a missing one can't be told apart from 0
+func TestLegacyMetricValue(t *testing.T) {
+	e := RadnoteEvent{}
+	e.Body.Usv = 0.1
+	e.Body.TemperatureC = 21.5
+	tests := []struct {
+		metric  string
+		value   float64
+		present bool
+	}{
+		{defaultMetric, 0.1, true},
+		{temperatureMetric, 21.5, true},
+		{voltageMetric, 0, false},
+		{cpmMetric, 0, false},
+		{"humidity", 0, false},
+	}
+	for _, test := range tests {
+		value, present := e.metricValue(test.metric)
+		if value != test.value || present != test.present {
+			t.Errorf("%s: got %g present %t, want %g present %t", test.metric, value, present, test.value, test.present)
+		}
+	}
+}
+
+// Without a radius, every device is listed nearest to the point first, with its
+// distance, followed by the devices without a location; devices at the same
+// distance are ordered by device UID
+func TestDistanceList(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:far", 1700000000, 42.5, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:unlocated", 1700000000, 0, 0, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:b-mid", 1700000000, 42.2, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:near", 1700000000, 42.101, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:a-mid", 1700000000, 42.2, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:opposite", 1700000000, 42.05, -71.1, map[string]interface{}{"usv": 0.1})
+
+	w := testGet("/radiation?lat=42.1&lon=-71.1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	entries := []struct {
+		Event struct {
+			DeviceUID string  `json:"device"`
+			BestLat   float64 `json:"best_lat"`
+			BestLon   float64 `json:"best_lon"`
+		} `json:"event"`
+		DistanceMeters *float64 `json:"distance_meters"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("list isn't a JSON array: %s", w.Body.String())
+	}
+	order := []string{"dev:near", "dev:opposite", "dev:a-mid", "dev:b-mid", "dev:far", "dev:unlocated"}
+	if len(entries) != len(order) {
+		t.Fatalf("got %d devices, want %d", len(entries), len(order))
+	}
+	for i, deviceUID := range order {
+		entry := entries[i]
+		if entry.Event.DeviceUID != deviceUID {
+			t.Errorf("device %d: got %s, want %s", i, entry.Event.DeviceUID, deviceUID)
+			continue
+		}
+		if deviceUID == "dev:unlocated" {
+			if entry.DistanceMeters != nil {
+				t.Errorf("%s: got distance %g, want none", deviceUID, *entry.DistanceMeters)
+			}
+			continue
+		}
+		want := metersApart(entry.Event.BestLat, entry.Event.BestLon, 42.1, -71.1)
+		if entry.DistanceMeters == nil || !testNear(*entry.DistanceMeters, want) {
+			t.Errorf("%s: got distance %v, want %g", deviceUID, entry.DistanceMeters, want)
+		}
+	}
+
+	// Without coordinates the full list is a map keyed by device UID
+	listing := map[string]interface{}{}
+	err = json.Unmarshal(testGet("/radiation").Body.Bytes(), &listing)
+	if err != nil || len(listing) != len(order) {
+		t.Errorf("full list: got %d devices, want a map of %d: %v", len(listing), len(order), err)
+	}
+}
+
+// Distances between cities agree with their published great-circle distances
+func TestMetersApartCities(t *testing.T) {
+	testService(t, Config{})
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		km                     float64
+	}{
+		{"New York to Los Angeles", 40.7128, -74.0060, 34.0522, -118.2437, 3936},
+		{"London to Paris", 51.5074, -0.1278, 48.8566, 2.3522, 344},
+		{"Sydney to Melbourne", -33.8688, 151.2093, -37.8136, 144.9631, 713},
+		{"London to New York", 51.5074, -0.1278, 40.7128, -74.0060, 5570},
+		{"same point", 42.1, -71.1, 42.1, -71.1, 0},
+	}
+	for _, test := range tests {
+		km := metersApart(test.lat1, test.lon1, test.lat2, test.lon2) / 1000
+		if math.Abs(km-test.km) > 0.002*test.km+0.001 {
+			t.Errorf("%s: got %.1fkm, want %gkm", test.name, km, test.km)
+		}
+	}
+}
+
+// Points scattered over the continental US, from which a region of 50km around
+// Boston selects few
+func testScatteredPoints(n int) (lats []float64, lons []float64) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		lats = append(lats, 25+rng.Float64()*24)
+		lons = append(lons, -125+rng.Float64()*58)
+	}
+	return
+}
+
+// Selecting a region from 10k events, with the bounding box rejecting most
+// before their distance is computed, compared with computing every distance.
+// The distances/op metric reports the number of metersApart calls.
+func BenchmarkRegionBoundingBox(b *testing.B) {
+	configCurrent.Store(&Config{})
+	lats, lons := testScatteredPoints(10000)
+	region := newQueryRegion(42.36, -71.06, 50000)
+
+	// With large_radius_meters at the radius, contains answers from the bounding
+	// box alone, so the points it accepts are exactly those whose distance it
+	// computes otherwise
+	configCurrent.Store(&Config{LargeRadiusMeters: region.radiusMeters})
+	distances := 0
+	for i := range lats {
+		if region.contains(lats[i], lons[i]) {
+			distances++
+		}
+	}
+	configCurrent.Store(&Config{})
+
+	b.Run("box", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j := range lats {
+				region.contains(lats[j], lons[j])
+			}
+		}
+		b.ReportMetric(float64(distances), "distances/op")
+	})
+	b.Run("distance", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j := range lats {
+				_ = metersApart(lats[j], lons[j], region.lat, region.lon) <= region.radiusMeters
+			}
+		}
+		b.ReportMetric(float64(len(lats)), "distances/op")
+	})
+}
+
+// The bounding box rejects only points outside the region, so that selecting
+// with it matches selecting by distance alone
+func TestRegionBoundingBoxMatchesDistance(t *testing.T) {
+	testService(t, Config{})
+	lats, lons := testScatteredPoints(10000)
+	region := newQueryRegion(42.36, -71.06, 500000)
+	for i := range lats {
+		within := metersApart(lats[i], lons[i], region.lat, region.lon) <= region.radiusMeters
+		if region.contains(lats[i], lons[i]) != within {
+			t.Errorf("%f,%f: contains %t, but within radius %t", lats[i], lons[i], !within, within)
+		}
+	}
+}
+
+// A time range selects the readings taken within it, both of its ends included,
+// and a malformed or inverted range is refused
+func TestRegionTimeRange(t *testing.T) {
+	testService(t, Config{})
+	const when = 1700000000
+	for i := int64(0); i < 3; i++ {
+		w := testPost(t, testReading("dev:1", when+60*i, 42.1, -71.1, map[string]interface{}{"usv": 0.1 * float64(i+1)}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("can't ingest reading %d: got %d", i, w.Code)
+		}
+	}
+
+	region := "/radiation?lat=42.1&lon=-71.1&radius_meters=1000"
+	tests := []struct {
+		name  string
+		query string
+		count float64
+	}{
+		{"no range", "", 1},
+		{"both ends inclusive", "&since=1700000060&until=1700000120", 2},
+		{"since just after a reading", "&since=1700000061", 1},
+		{"until just before a reading", "&until=1700000059", 1},
+		{"since alone", "&since=1700000000", 3},
+		{"single instant", "&since=1700000060&until=1700000060", 1},
+		{"RFC3339", "&since=2023-11-14T22:14:20Z&until=2023-11-14T22:15:20Z", 2},
+		{"nothing within", "&since=1800000000", 0},
+	}
+	for _, test := range tests {
+		content := testFeedContent(t, testGet(region+test.query))
+		if content["count"] != test.count {
+			t.Errorf("%s: got count %v, want %v", test.name, content["count"], test.count)
+		}
+	}
+
+	for _, query := range []string{"&since=yesterday", "&until=2023-11-14", "&since=1700000120&until=1700000060"} {
+		w := testGet(region + query)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Many queries may run concurrently with each other and with ingestion.  Run
+// with -race to check that readers hold the data lock wherever they need it.
+func TestConcurrentQueries(t *testing.T) {
+	testService(t, Config{})
+	for i := 0; i < 50; i++ {
+		w := testPost(t, testReading(fmt.Sprintf("dev:%d", i), 1700000000, 42.1+float64(i)/1000, -71.1, map[string]interface{}{"usv": 0.1}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("can't ingest reading %d: got %d", i, w.Code)
+		}
+	}
+
+	targets := []string{
+		"/radiation",
+		"/radiation?lat=42.1&lon=-71.1&radius_meters=5000",
+		"/radiation?lat=42.1&lon=-71.1&radius_meters=5000&items=devices",
+		"/radiation?lat=42.1&lon=-71.1&radius_meters=5000&format=geojson",
+	}
+	var wg sync.WaitGroup
+	for reader := 0; reader < 16; reader++ {
+		wg.Add(1)
+		go func(reader int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				target := targets[(reader+i)%len(targets)]
+				w := testGet(target)
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: got %d", target, w.Code)
+				}
+			}
+		}(reader)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			event := testReading("dev:writer", 1700000001+int64(i), 42.1, -71.1, map[string]interface{}{"usv": 0.2})
+			body, _ := json.Marshal(event)
+			w := testServe(httptest.NewRequest(http.MethodPost, "/radnote", strings.NewReader(string(body))))
+			if w.Code != http.StatusOK {
+				t.Errorf("POST /radnote: got %d", w.Code)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// The devices of a region are listed nearest first, each within the radius and
+// with its own reading and distance
+func TestRegionDeviceDistances(t *testing.T) {
+	testService(t, Config{})
+	const lat, lon, radius = 42.1, -71.1, 2000.0
+	within := map[string]float64{}
+	for i := 0; i < 20; i++ {
+		deviceUID := fmt.Sprintf("dev:%d", i)
+		deviceLat := lat + float64(i%5-2)*0.01
+		deviceLon := lon + float64(i/5-2)*0.012
+		usv := 0.01 * float64(i+1)
+		w := testPost(t, testReading(deviceUID, 1700000000, deviceLat, deviceLon, map[string]interface{}{"usv": usv}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("can't ingest reading of %s: got %d", deviceUID, w.Code)
+		}
+		if metersApart(deviceLat, deviceLon, lat, lon) <= radius {
+			within[deviceUID] = usv
+		}
+	}
+	if len(within) == 0 || len(within) == 20 {
+		t.Fatalf("%d of the devices are within the radius, want some but not all", len(within))
+	}
+
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=2000"))
+	devices, _ := content["devices"].([]interface{})
+	if len(devices) != len(within) {
+		t.Fatalf("got %d devices, want %d", len(devices), len(within))
+	}
+	previous := -1.0
+	for _, entry := range devices {
+		device, _ := entry.(map[string]interface{})
+		deviceUID, _ := device["device_uid"].(string)
+		distance, ok := device["distance_meters"].(float64)
+		if !ok {
+			t.Fatalf("%s has no distance: %v", deviceUID, device)
+		}
+		usv, isWithin := within[deviceUID]
+		if !isWithin {
+			t.Errorf("%s is listed but isn't within the radius", deviceUID)
+		}
+		if device[defaultMetric] != usv {
+			t.Errorf("%s: got %v uSv, want %v", deviceUID, device[defaultMetric], usv)
+		}
+		if distance < 0 || distance > radius {
+			t.Errorf("%s: distance %f is outside the radius", deviceUID, distance)
+		}
+		if distance < previous {
+			t.Errorf("%s: distance %f is nearer than the previous device's %f", deviceUID, distance, previous)
+		}
+		previous = distance
+	}
+}
+
+// The median of a region interpolates between the middle values of an even
+// count, and its standard deviation is that of the population
+func TestAggregateRegionMedianStddev(t *testing.T) {
+	tests := []struct {
+		name           string
+		values         []float64
+		median, stddev float64
+	}{
+		{"single", []float64{0.3}, 0.3, 0},
+		{"odd count, unsorted", []float64{1, 3, 2}, 2, math.Sqrt(2.0 / 3)},
+		{"even count", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 4.5, 2},
+		{"one hot sensor", []float64{0.1, 0.1, 0.1, 10}, 0.1, math.Sqrt(18.376875)},
+	}
+	for _, test := range tests {
+		a := aggregateRegion(testSamples(test.values...), "", 0, 0)
+		if !testNear(a.Median, test.median) || !testNear(a.Stddev, test.stddev) {
+			t.Errorf("%s: got median %g stddev %g, want %g, %g", test.name, a.Median, a.Stddev, test.median, test.stddev)
+		}
+	}
+
+	// An empty region reports zeros
+	testService(t, Config{})
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if content["usv_median"] != float64(0) || content["usv_stddev"] != float64(0) {
+		t.Errorf("empty region: got median %v stddev %v, want 0", content["usv_median"], content["usv_stddev"])
+	}
+}
+
+// A nearest query lists every located device when it asks for more than there
+// are, takes precedence over a radius, and orders devices at the same distance
+// most recent first and then by device UID
+func TestNearestDevices(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:near", 1700000000, 42.101, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:tie-old", 1700000000, 42.11, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:tie-new", 1700000060, 42.11, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:tie-b", 1700000000, 41.99, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:tie-a", 1700000000, 41.99, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:far", 1700000000, 43.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:unlocated", 1700000000, 0, 0, map[string]interface{}{"usv": 0.1})
+
+	all := "nearest,dev:near,dev:tie-new,dev:tie-old,dev:tie-a,dev:tie-b,dev:far"
+	tests := []struct {
+		name  string
+		query string
+		ids   string
+	}{
+		{"more than there are", "&nearest=100", all},
+		{"exactly as many", "&nearest=6", all},
+		{"fewer, split between ties", "&nearest=2", "nearest,dev:near,dev:tie-new"},
+		{"radius ignored", "&nearest=1&radius_meters=1", "nearest,dev:near"},
+	}
+	for _, test := range tests {
+		ids := testFeedItemIDs(t, testGet("/radiation?lat=42.1&lon=-71.1"+test.query))
+		if strings.Join(ids, ",") != test.ids {
+			t.Errorf("%s: got %v, want %s", test.name, ids, test.ids)
+		}
+	}
+
+	w := testGet("/radiation?lat=42.1&lon=-71.1&nearest=0")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("nearest=0: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Readings whose measurements aren't finite are refused, and any that were stored
+// anyway are skipped and counted rather than poisoning a region's statistics
+func TestNonFiniteReadings(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:2", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.3})
+
+	for _, body := range []string{`{"usv":1e400}`, `{"usv":-1e400}`, `{"cpm":1e999}`} {
+		event := `{"device":"dev:bad","file":"_air.qo","when":1700000000,"best_lat":42.1,"best_lon":-71.1,"body":` + body + `}`
+		w := testServe(httptest.NewRequest(http.MethodPost, "/radnote", strings.NewReader(event)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if _, exists := testStored("dev:bad"); exists {
+		t.Errorf("a reading that isn't finite was stored")
+	}
+
+	// Readings stored before they were validated
+	radLock.Lock()
+	for i, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		deviceUID := fmt.Sprintf("dev:poison%d", i)
+		event := testReading(deviceUID, 1700000000, 42.1, -71.1, nil)
+		radnoteEvents[deviceUID] = RadnoteEvent{Event: event, Metrics: map[string]float64{defaultMetric: value}}
+	}
+	geohashIndexTenant("")
+	radLock.Unlock()
+
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	if content["count"] != float64(2) || content["skipped_count"] != float64(3) {
+		t.Errorf("got count %v skipped %v, want 2 and 3", content["count"], content["skipped_count"])
+	}
+	for _, stat := range []string{"usv_min", "usv_max", "usv_avg", "usv_median", "usv_stddev"} {
+		value, ok := content[stat].(float64)
+		if !ok || !finite(value) {
+			t.Errorf("%s: got %v", stat, content[stat])
+		}
+	}
+	if !testNear(content["usv_avg"].(float64), 0.2) {
+		t.Errorf("usv_avg: got %v, want 0.2", content["usv_avg"])
+	}
+}
+
+// Coordinates at the limits of their ranges are queried, those beyond them are
+// refused, as is a radius that is negative or not finite, and 0,0 lists every
+// device rather than querying a region there
+func TestQueryCoordinateRanges(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+
+	tests := []struct {
+		lat, lon string
+		status   int
+	}{
+		{"90", "0.5", http.StatusOK},
+		{"-90", "0.5", http.StatusOK},
+		{"0.5", "180", http.StatusOK},
+		{"0.5", "-180", http.StatusOK},
+		{"90.0001", "0.5", http.StatusBadRequest},
+		{"-90.0001", "0.5", http.StatusBadRequest},
+		{"95", "0.5", http.StatusBadRequest},
+		{"0.5", "180.0001", http.StatusBadRequest},
+		{"0.5", "-180.0001", http.StatusBadRequest},
+		{"0.5", "400", http.StatusBadRequest},
+		{"NaN", "0.5", http.StatusBadRequest},
+		{"0.5", "NaN", http.StatusBadRequest},
+		{"Inf", "0.5", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := testGet("/radiation?radius_meters=1000&lat=" + test.lat + "&lon=" + test.lon)
+		if w.Code != test.status {
+			t.Errorf("lat %s lon %s: got %d, want %d", test.lat, test.lon, w.Code, test.status)
+		}
+	}
+
+	radii := []struct {
+		radius string
+		status int
+	}{
+		{"1000", http.StatusOK},
+		{"0", http.StatusOK},
+		{"-5", http.StatusBadRequest},
+		{"NaN", http.StatusBadRequest},
+		{"Inf", http.StatusBadRequest},
+		{"-Inf", http.StatusBadRequest},
+	}
+	for _, test := range radii {
+		w := testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=" + test.radius)
+		if w.Code != test.status {
+			t.Errorf("radius %s: got %d, want %d", test.radius, w.Code, test.status)
+		}
+		if test.status == http.StatusBadRequest && !strings.Contains(w.Body.String(), "radius_meters") {
+			t.Errorf("radius %s: got %q, want an explanation", test.radius, w.Body.String())
+		}
+	}
+
+	w := testGet("/radiation?radius_meters=1000&lat=0&lon=0")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "dev:1") {
+		t.Errorf("0,0: got %d, want the list of every device: %s", w.Code, w.Body.String())
+	}
+}
+
+// Points either side of the antimeridian are the short arc apart, and a region
+// spanning it includes devices on both sides and excludes those far away
+func TestAntimeridian(t *testing.T) {
+	testService(t, Config{})
+	km := metersApart(0, 179.9, 0, -179.9) / 1000
+	if math.Abs(km-22.2) > 0.1 {
+		t.Errorf("0,179.9 to 0,-179.9: got %.1fkm, want about 22.2km", km)
+	}
+
+	minLat, maxLat, minLon, maxLon := boundingBox(0, 179.9, 30000)
+	if minLon <= maxLon || minLon > 179.9 || maxLon < -180 || maxLon > -179.5 {
+		t.Errorf("box doesn't wrap around the antimeridian: lon %f to %f", minLon, maxLon)
+	}
+	if minLat >= 0 || maxLat <= 0 {
+		t.Errorf("box doesn't span the point: lat %f to %f", minLat, maxLat)
+	}
+
+	testPostReading(t, "dev:east", 1700000000, 0, 179.9, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:west", 1700000000, 0.01, -179.9, map[string]interface{}{"usv": 0.2})
+	testPostReading(t, "dev:far", 1700000000, 0, 179.0, map[string]interface{}{"usv": 0.3})
+	testPostReading(t, "dev:opposite", 1700000000, 0, 0.5, map[string]interface{}{"usv": 0.4})
+	for _, lon := range []string{"179.9", "-179.9", "180"} {
+		content := testFeedContent(t, testGet("/radiation?lat=0.005&radius_meters=30000&lon="+lon))
+		devices, _ := content["devices"].([]interface{})
+		uids := []string{}
+		for _, entry := range devices {
+			device, _ := entry.(map[string]interface{})
+			uids = append(uids, device["device_uid"].(string))
+		}
+		sort.Strings(uids)
+		if strings.Join(uids, ",") != "dev:east,dev:west" {
+			t.Errorf("lon %s: got devices %v, want dev:east and dev:west", lon, uids)
+		}
+	}
+}
+
+// A batch is ingested as if each of its events had been POSTed on its own, with
+// only the data readings stored, and the stored readings written once at the end
+func TestIngestMixedBatch(t *testing.T) {
+	testService(t, Config{})
+	session := testReading("dev:3", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.3})
+	session.NotefileID = "_session.qo"
+	other := testReading("dev:4", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.4})
+	other.NotefileID = "readings.qo"
+	batch := []note.Event{
+		testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}),
+		session,
+		testReading("dev:2", 1700000000, 42.2, -71.2, map[string]interface{}{"usv": 0.2}),
+		other,
+	}
+
+	w := testPost(t, batch)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	summary := map[string]int{}
+	err := json.Unmarshal(w.Body.Bytes(), &summary)
+	if err != nil {
+		t.Fatalf("summary isn't JSON: %s", w.Body.String())
+	}
+	if summary["accepted"] != 2 || summary["skipped"] != 2 {
+		t.Errorf("got %v, want 2 accepted and 2 skipped", summary)
+	}
+	for deviceUID, want := range map[string]bool{"dev:1": true, "dev:2": true, "dev:3": false, "dev:4": false} {
+		if _, exists := testStored(deviceUID); exists != want {
+			t.Errorf("%s: stored %t, want %t", deviceUID, exists, want)
+		}
+	}
+	events, err := loadEvents(radnoteFile, "")
+	if err != nil || len(events) != 2 {
+		t.Errorf("got %d events written, want 2: %v", len(events), err)
+	}
+}
+
+// The uSv reading of a sensor reporting only CPM is derived with its configured
+// factor, or the default factor if it is unknown, while a reported uSv is kept
+func TestSensorFactors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		body   map[string]interface{}
+		usv    float64
+	}{
+		{"known sensor", Config{SensorFactors: map[string]float64{"lnd7128ec": 1.0 / 108}}, map[string]interface{}{"cpm": 216, "sensor": "lnd7128ec"}, 2},
+		{"unknown sensor", Config{SensorFactors: map[string]float64{"lnd7128ec": 1.0 / 108}}, map[string]interface{}{"cpm": 334, "sensor": "geiger-x"}, 1},
+		{"no sensor", Config{SensorFactors: map[string]float64{"lnd7128ec": 1.0 / 108}}, map[string]interface{}{"cpm": 668}, 2},
+		{"configured default", Config{SensorDefaultFactor: 0.01}, map[string]interface{}{"cpm": 100, "sensor": "geiger-x"}, 1},
+		{"uSv reported", Config{SensorFactors: map[string]float64{"lnd7128ec": 1.0 / 108}}, map[string]interface{}{"cpm": 216, "usv": 0.5, "sensor": "lnd7128ec"}, 0.5},
+	}
+	for _, test := range tests {
+		testService(t, test.config)
+		testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, test.body)
+		e, _ := testStored("dev:1")
+		usv, present := e.metricValue(defaultMetric)
+		if !present || !testNear(usv, test.usv) || !testNear(e.Body.Usv, test.usv) {
+			t.Errorf("%s: got %g uSv, want %g", test.name, usv, test.usv)
+		}
+	}
+}
+
+// A context that is canceled after its Err has been checked a number of times,
+// as if the client went away partway through a query
+type testCountdownContext struct {
+	context.Context
+	checks int
+}
+
+// Report the context canceled once its checks are used up
+func (c *testCountdownContext) Err() error {
+	c.checks--
+	if c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// A query whose request is canceled stops scanning partway through, and is
+// answered as abandoned
+func TestQueryCanceled(t *testing.T) {
+	testService(t, Config{})
+	testScatterDevices(rand.New(rand.NewSource(1)), 1000, 42, 42.01, -71.01, -71)
+
+	samples, _, _ := scanRegion(context.Background(), "", 42.005, -71.005, 10000, defaultMetric, 0, 0, "")
+	if len(samples) != 1000 {
+		t.Fatalf("uncanceled scan: got %d samples, want 1000", len(samples))
+	}
+	ctx := &testCountdownContext{Context: context.Background(), checks: 100}
+	samples, _, _ = scanRegion(ctx, "", 42.005, -71.005, 10000, defaultMetric, 0, 0, "")
+	if len(samples) != 100 {
+		t.Errorf("scan canceled after 100 devices: got %d samples", len(samples))
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, target := range []string{"/radiation?lat=42.005&lon=-71.005&radius_meters=10000", "/radiation"} {
+		w := testServe(httptest.NewRequest(http.MethodGet, target, nil).WithContext(canceled))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "query abandoned") {
+			t.Errorf("%s: got %d %s, want the query abandoned", target, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Return a page of the full list, with the device UIDs it lists
+func testListingPage(t *testing.T, query string) (total int, deviceUIDs []string) {
+	t.Helper()
+	w := testGet("/radiation?" + query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d, want %d", query, w.Code, http.StatusOK)
+	}
+	page := struct {
+		Total   int `json:"total"`
+		Devices []struct {
+			Event struct {
+				DeviceUID string `json:"device"`
+			} `json:"event"`
+		} `json:"devices"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatalf("%s: page isn't JSON: %s", query, w.Body.String())
+	}
+	deviceUIDs = []string{}
+	for _, device := range page.Devices {
+		deviceUIDs = append(deviceUIDs, device.Event.DeviceUID)
+	}
+	return page.Total, deviceUIDs
+}
+
+// The full list is paged in order of device UID, with the total number of
+// devices, and an offset beyond the last device yields an empty page
+func TestListingPages(t *testing.T) {
+	testService(t, Config{})
+	for _, deviceUID := range []string{"dev:e", "dev:b", "dev:d", "dev:a", "dev:c"} {
+		testPostReading(t, deviceUID, 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	}
+
+	tests := []struct {
+		query      string
+		deviceUIDs []string
+	}{
+		{"limit=2", []string{"dev:a", "dev:b"}},
+		{"limit=2&offset=2", []string{"dev:c", "dev:d"}},
+		{"limit=2&offset=4", []string{"dev:e"}},
+		{"offset=3", []string{"dev:d", "dev:e"}},
+		{"limit=2&offset=5", []string{}},
+		{"limit=2&offset=1000", []string{}},
+	}
+	for _, test := range tests {
+		total, deviceUIDs := testListingPage(t, test.query)
+		if total != 5 || strings.Join(deviceUIDs, ",") != strings.Join(test.deviceUIDs, ",") {
+			t.Errorf("%s: got total %d devices %v, want 5 and %v", test.query, total, deviceUIDs, test.deviceUIDs)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", "limit=1001", "limit=some", "offset=-1", "offset=first"} {
+		if w := testGet("/radiation?" + query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// The bearing from a point is 0 due north and increases clockwise, is normalized
+// to [0,360), and takes the short way across the antimeridian
+func TestBearing(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		degrees                float64
+	}{
+		{"north", 42.1, -71.1, 42.2, -71.1, 0},
+		{"east", 0, 10, 0, 11, 90},
+		{"south", 42.1, -71.1, 42.0, -71.1, 180},
+		{"west", 0, 10, 0, 9, 270},
+		{"east across the antimeridian", 0, 179.5, 0, -179.5, 90},
+		{"west across the antimeridian", 0, -179.5, 0, 179.5, 270},
+		{"same point", 42.1, -71.1, 42.1, -71.1, 0},
+		{"just west of north", 0, 0, 1, -1e-9, 360 - 1e-9},
+	}
+	for _, test := range tests {
+		degrees := bearing(test.lat1, test.lon1, test.lat2, test.lon2)
+		if degrees < 0 || degrees >= 360 || math.Abs(degrees-test.degrees) > 1e-6 {
+			t.Errorf("%s: got %g, want %g", test.name, degrees, test.degrees)
+		}
+	}
+
+	// Each device in a region's feed has its bearing from the query point
+	testService(t, Config{})
+	cardinal := map[string]float64{"dev:n": 0, "dev:e": 90, "dev:s": 180, "dev:w": 270}
+	testPostReading(t, "dev:n", 1700000000, 42.105, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:e", 1700000000, 42.1, -71.095, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:s", 1700000000, 42.095, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:w", 1700000000, 42.1, -71.105, map[string]interface{}{"usv": 0.1})
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000"))
+	devices, _ := content["devices"].([]interface{})
+	if len(devices) != len(cardinal) {
+		t.Fatalf("got %d devices, want %d", len(devices), len(cardinal))
+	}
+	for _, entry := range devices {
+		device, _ := entry.(map[string]interface{})
+		deviceUID, _ := device["device_uid"].(string)
+		degrees, ok := device["bearing_degrees"].(float64)
+		if !ok || math.Abs(degrees-cardinal[deviceUID]) > 0.01 {
+			t.Errorf("%s: got bearing %v, want about %g", deviceUID, device["bearing_degrees"], cardinal[deviceUID])
+		}
+	}
+}
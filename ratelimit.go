@@ -0,0 +1,112 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A client's token bucket, which holds up to a minute's worth of requests and
+// refills continuously
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// A per-client rate limiter allowing a number of requests per minute
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// The number of clients tracked by a limiter beyond which those whose buckets
+// have refilled, and so are no longer being limited, are forgotten
+const rateLimitMaxClients = 10000
+
+// Rate limiters for ingestion and for everything else, which is mostly queries
+var ingestRateLimiter = &rateLimiter{buckets: map[string]*rateBucket{}}
+var queryRateLimiter = &rateLimiter{buckets: map[string]*rateBucket{}}
+
+// Take a token from a client's bucket, which holds perMinute tokens, returning
+// false with the number of seconds until a token will be available if it is empty
+func (l *rateLimiter) allow(client string, perMinute int, now time.Time) (allowed bool, retryAfterSecs int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	capacity := float64(perMinute)
+	perSec := capacity / 60
+	if len(l.buckets) >= rateLimitMaxClients {
+		for key, b := range l.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*perSec >= capacity {
+				delete(l.buckets, key)
+			}
+		}
+	}
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &rateBucket{tokens: capacity, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*perSec)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, int(math.Ceil((1 - b.tokens) / perSec))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Return the IP address of a request's client.  Behind the load balancer this is
+// the last address in X-Forwarded-For, which is the one the load balancer itself
+// appended, since any earlier ones were supplied by the client and can't be
+// trusted.
+func clientIP(r *http.Request) string {
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		addr := strings.TrimSpace(addrs[len(addrs)-1])
+		if addr != "" {
+			return addr
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Wrap a handler so that each client IP is limited to rate_limit_per_minute
+// queries and ingest_rate_limit_per_minute POSTs to /radnote, refusing requests
+// beyond that with a 429.  Health checks and metrics scrapes aren't limited, and a limit of 0
+// disables limiting.
+func rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := queryRateLimiter
+		perMinute := config().RateLimitPerMinute
+		switch r.URL.Path {
+		case "/ping", "/health", "/ready", "/version", "/metrics":
+			perMinute = 0
+		case "/radnote":
+			limiter = ingestRateLimiter
+			perMinute = config().IngestRateLimitPerMinute
+		}
+		if perMinute > 0 {
+			allowed, retryAfterSecs := limiter.allow(clientIP(r), perMinute, time.Now())
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSecs))
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte("too many requests"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Serve a request from a client through the rate limiter
+func testServeLimited(method string, target string, client string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, "+client)
+	w := httptest.NewRecorder()
+	rateLimitHandler(newRouter()).ServeHTTP(w, r)
+	return w
+}
+
+// A client that drains its bucket is refused with a 429 until it refills, while
+// other clients, health checks and ingestion are limited separately
+func TestRateLimit(t *testing.T) {
+	testService(t, Config{RateLimitPerMinute: 3, IngestRateLimitPerMinute: 2})
+
+	for i := 0; i < 3; i++ {
+		w := testServeLimited(http.MethodGet, "/radiation", "198.51.100.1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("query %d: got %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+	w := testServeLimited(http.MethodGet, "/radiation", "198.51.100.1", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("query beyond the limit: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") != "20" {
+		t.Errorf("Retry-After: got %q, want 20", w.Header().Get("Retry-After"))
+	}
+
+	w = testServeLimited(http.MethodGet, "/radiation", "198.51.100.2", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("another client: got %d, want %d", w.Code, http.StatusOK)
+	}
+	w = testServeLimited(http.MethodGet, "/ping", "198.51.100.1", nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("ping from a limited client: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	body, _ := json.Marshal(testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w = testServeLimited(http.MethodPost, "/radnote", "198.51.100.1", body)
+		if w.Code != want {
+			t.Errorf("ingest %d from a client whose queries are limited: got %d, want %d", i, w.Code, want)
+		}
+	}
+
+	// The bucket refills at the rate of the limit
+	now := time.Now()
+	limiter := &rateLimiter{buckets: map[string]*rateBucket{}}
+	for i := 0; i < 3; i++ {
+		limiter.allow("client", 3, now)
+	}
+	if allowed, _ := limiter.allow("client", 3, now.Add(19*time.Second)); allowed {
+		t.Errorf("allowed before a token was refilled")
+	}
+	if allowed, _ := limiter.allow("client", 3, now.Add(20*time.Second)); !allowed {
+		t.Errorf("refused once a token was refilled")
+	}
+}
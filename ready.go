@@ -0,0 +1,180 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Whether or not we are currently able to persist data to the data directory,
+// which is only so while both the disk probe and the writes of the data files
+// are succeeding
+var persistHealthy atomic.Bool
+
+// The sources of the results of writes to the data directory
+const (
+	persistSourceProbe = "probe"
+	persistSourceData  = "data"
+)
+
+// The latest failure of each source whose latest write failed
+var persistLock sync.Mutex
+var persistFailing = map[string]error{}
+
+// The file written and removed by the disk probe
+var diskProbeFile = ".probe"
+
+// Default interval between disk probes
+const diskProbeDefaultIntervalSecs = 60
+
+// When the process started
+var processStarted = time.Now()
+
+// Default number of seconds without a new reading after which ingestion is stale
+const healthDefaultStaleSecs = 3600
+
+// Health statuses
+const (
+	healthStatusOK    = "ok"
+	healthStatusStale = "stale"
+)
+
+// Initialize readiness state
+func init() {
+	persistHealthy.Store(true)
+}
+
+// Record the result of an attempt by a source to write to the data directory,
+// logging its transitions.  A successful probe doesn't hide data files that
+// can't be written, nor the reverse.
+func persistResult(source string, err error) {
+	persistLock.Lock()
+	defer persistLock.Unlock()
+	_, failing := persistFailing[source]
+	if err == nil {
+		delete(persistFailing, source)
+		if failing {
+			slog.Info("data directory is writable again", "source", source)
+		}
+	} else {
+		persistFailing[source] = err
+		if !failing {
+			slog.Error("data directory is not writable", "source", source, "error", err)
+		}
+	}
+	persistHealthy.Store(len(persistFailing) == 0)
+}
+
+// Readiness handler, which fails if we can't currently persist data
+func httpReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if !persistHealthy.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("not ready: data directory is not writable"))
+		return
+	}
+	_, _ = w.Write([]byte("ready"))
+}
+
+// A snapshot of the devices of every tenant and of the alerts active for them.
+// OldestWhen and NewestWhen are the When of the least and most recent latest
+// reading of any device, or 0 if there are none.
+type serviceStats struct {
+	Devices        int
+	LocatedDevices int
+	OldestWhen     int64
+	NewestWhen     int64
+	ActiveAlerts   int
+}
+
+// Gather a snapshot of the service's devices and alerts
+func gatherServiceStats() (s serviceStats) {
+	radLock.RLock()
+	for _, tenant := range append([]string{""}, configTenants()...) {
+		for _, e := range tenantEvents(tenant) {
+			s.Devices++
+			if !(e.Event.BestLat == 0 && e.Event.BestLon == 0) {
+				s.LocatedDevices++
+			}
+			if s.OldestWhen == 0 || e.Event.When < s.OldestWhen {
+				s.OldestWhen = e.Event.When
+			}
+			if e.Event.When > s.NewestWhen {
+				s.NewestWhen = e.Event.When
+			}
+		}
+	}
+	radLock.RUnlock()
+	alertLock.Lock()
+	alertExpire(time.Now().UTC().Unix())
+	s.ActiveAlerts = len(alertActive)
+	alertLock.Unlock()
+	return
+}
+
+// Health handler, reporting whether data is still arriving rather than merely
+// whether the process is up.  The status degrades to stale if the most recent
+// reading of any device of any tenant is older than health_stale_secs, but the
+// response is still a 200 so that a quiet network doesn't get instances replaced.
+func httpHealthHandler(w http.ResponseWriter, r *http.Request) {
+
+	staleSecs := int64(config().HealthStaleSecs)
+	if staleSecs == 0 {
+		staleSecs = healthDefaultStaleSecs
+	}
+
+	now := time.Now().UTC().Unix()
+	stats := gatherServiceStats()
+
+	o := map[string]interface{}{}
+	o["uptime_secs"] = int64(time.Since(processStarted).Seconds())
+	o["device_count"] = stats.Devices
+	o["located_device_count"] = stats.LocatedDevices
+	o["active_alerts"] = stats.ActiveAlerts
+	o["status"] = healthStatusStale
+	if stats.NewestWhen != 0 {
+		age := now - stats.NewestWhen
+		o["last_event_age_secs"] = age
+		if age <= staleSecs {
+			o["status"] = healthStatusOK
+		}
+	}
+	o["stale_secs"] = staleSecs
+
+	healthJSON, err := json.MarshalIndent(o, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(healthJSON)
+
+}
+
+// Periodically verify that the data directory is writable, so that readiness flips
+// before a data-losing write happens rather than after
+func diskProbe() {
+
+	interval := time.Duration(config().DiskProbeIntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = diskProbeDefaultIntervalSecs * time.Second
+	}
+
+	for {
+		probePath := configDataDirectory + diskProbeFile
+		err := os.WriteFile(probePath, []byte(time.Now().UTC().Format(time.RFC3339)), 0644)
+		if err == nil {
+			err = os.Remove(probePath)
+		}
+		persistResult(persistSourceProbe, err)
+		time.Sleep(interval)
+	}
+
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Return the health check response
+func testHealth(t *testing.T) map[string]interface{} {
+	t.Helper()
+	w := testGet("/health")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /health: got %d, want %d", w.Code, http.StatusOK)
+	}
+	health := map[string]interface{}{}
+	err := json.Unmarshal(w.Body.Bytes(), &health)
+	if err != nil {
+		t.Fatalf("health isn't JSON: %s", w.Body.String())
+	}
+	return health
+}
+
+// Health is ok while the most recent reading is within health_stale_secs, and
+// stale without any readings or once the most recent is older
+func TestHealthFreshness(t *testing.T) {
+	testService(t, Config{HealthStaleSecs: 300})
+	health := testHealth(t)
+	if health["status"] != healthStatusStale || health["device_count"] != float64(0) {
+		t.Errorf("without readings: got %v", health)
+	}
+	if _, exists := health["last_event_age_secs"]; exists {
+		t.Errorf("without readings: got last_event_age_secs %v", health["last_event_age_secs"])
+	}
+
+	now := time.Now().UTC().Unix()
+	testPostReading(t, "dev:old", now-3600, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	health = testHealth(t)
+	if health["status"] != healthStatusStale {
+		t.Errorf("with an hour-old reading: got status %v, want %s", health["status"], healthStatusStale)
+	}
+	age, _ := health["last_event_age_secs"].(float64)
+	if age < 3600 || age > 3660 {
+		t.Errorf("with an hour-old reading: got last_event_age_secs %v", health["last_event_age_secs"])
+	}
+
+	testPostReading(t, "dev:new", now-60, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	health = testHealth(t)
+	if health["status"] != healthStatusOK || health["device_count"] != float64(2) {
+		t.Errorf("with a minute-old reading: got %v", health)
+	}
+	age, _ = health["last_event_age_secs"].(float64)
+	if age < 60 || age > 120 {
+		t.Errorf("with a minute-old reading: got last_event_age_secs %v", health["last_event_age_secs"])
+	}
+	if health["stale_secs"] != float64(300) {
+		t.Errorf("stale_secs: got %v, want 300", health["stale_secs"])
+	}
+}
+
+// The service isn't ready while the data files can't be written, even though the
+// disk probe succeeds, and is ready again once they can be
+func TestReadyTracksDataWrites(t *testing.T) {
+	testService(t, Config{})
+	if w := testGet("/ready"); w.Code != http.StatusOK {
+		t.Fatalf("fresh service: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// A directory in the way of the data file makes its write fail
+	path := configDataDirectory + radnoteFile
+	err := os.MkdirAll(filepath.Join(path, "in-the-way"), 0755)
+	if err != nil {
+		t.Fatalf("can't create directory: %s", err)
+	}
+	testPost(t, testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+	persistResult(persistSourceProbe, nil)
+	if w := testGet("/ready"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("data file unwritable after a successful probe: got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		t.Fatalf("can't remove directory: %s", err)
+	}
+	testPostReading(t, "dev:1", 1700000060, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	if w := testGet("/ready"); w.Code != http.StatusOK {
+		t.Errorf("data file writable again: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Nor is it ready while the probe is failing, however the data files fare
+	persistResult(persistSourceProbe, errors.New("disk full"))
+	if w := testGet("/ready"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("probe failing: got %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Default interval between retention sweeps
+const retentionDefaultSweepMins = 60
+
+// Forget the devices of a tenant whose latest reading was taken before the
+// cutoff, along with their history, returning how many were forgotten.  The
+// caller must hold radLock.
+func retentionPrune(tenant string, cutoff int64) (pruned int) {
+	events := tenantEvents(tenant)
+	for deviceUID, e := range events {
+		if e.Event.When < cutoff {
+			delete(events, deviceUID)
+			delete(radHistory[tenant], deviceUID)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		historyRewrite(tenant)
+		geohashIndexTenant(tenant)
+		radGeneration.Add(1)
+	}
+	return
+}
+
+// Forget the devices of every tenant that haven't reported within retention_days,
+// persisting each tenant whose devices were pruned
+func retentionSweep(now time.Time) {
+	cutoff := now.Add(-time.Duration(config().RetentionDays) * 24 * time.Hour).Unix()
+	for _, tenant := range append([]string{""}, configTenants()...) {
+		radLock.Lock()
+		pruned := 0
+		if tenantEvents(tenant) != nil {
+			pruned = retentionPrune(tenant, cutoff)
+		}
+		radLock.Unlock()
+		if pruned == 0 {
+			continue
+		}
+		slog.Info("devices pruned", "tenant", tenant, "count", pruned, "retention_days", config().RetentionDays)
+		err := radPersist(tenant)
+		if err != nil {
+			slog.Error("can't store data", "file", tenantFile(tenant), "error", err)
+		}
+	}
+}
+
+// Periodically forget devices that have stopped reporting
+func retentionSweeper() {
+	for {
+		interval := time.Duration(config().RetentionSweepMins) * time.Minute
+		if interval <= 0 {
+			interval = retentionDefaultSweepMins * time.Minute
+		}
+		time.Sleep(interval)
+		if config().RetentionDays > 0 {
+			retentionSweep(time.Now().UTC())
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// A sweep forgets the devices whose latest reading is older than the retention
+// period, keeping and persisting those that are fresh
+func TestRetentionSweep(t *testing.T) {
+	testService(t, Config{RetentionDays: 7})
+	now := time.Now().UTC()
+	day := int64(24 * 60 * 60)
+	readings := []struct {
+		deviceUID string
+		ageDays   int64
+		kept      bool
+	}{
+		{"dev:fresh", 0, true},
+		{"dev:week-old", 6, true},
+		{"dev:expired", 8, false},
+		{"dev:ancient", 400, false},
+	}
+	for i, r := range readings {
+		testPostReading(t, r.deviceUID, now.Unix()-r.ageDays*day, 42.1, -71.1+float64(i)/1000, map[string]interface{}{"usv": 0.1})
+	}
+	// An expired device that has since reported again is kept
+	testPostReading(t, "dev:revived", now.Unix()-30*day, 42.2, -71.1, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:revived", now.Unix()-day, 42.2, -71.1, map[string]interface{}{"usv": 0.2})
+
+	retentionSweep(now)
+
+	for _, r := range readings {
+		if _, exists := testStored(r.deviceUID); exists != r.kept {
+			t.Errorf("%s: got kept %t, want %t", r.deviceUID, exists, r.kept)
+		}
+	}
+	if _, exists := testStored("dev:revived"); !exists {
+		t.Errorf("device that reported again was pruned")
+	}
+	contents, err := os.ReadFile(configDataDirectory + radnoteFile)
+	if err != nil {
+		t.Fatalf("can't read data file: %s", err)
+	}
+	persisted, err := unmarshalDataFile(contents)
+	if err != nil {
+		t.Fatalf("can't load data file: %s", err)
+	}
+	if len(persisted) != 3 {
+		t.Errorf("persisted %d devices, want 3", len(persisted))
+	}
+	for _, r := range readings {
+		if _, exists := persisted[r.deviceUID]; exists != r.kept {
+			t.Errorf("%s: got persisted %t, want %t", r.deviceUID, exists, r.kept)
+		}
+	}
+}
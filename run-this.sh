@@ -11,6 +11,6 @@ git reset --hard
 git pull
 # go get -u
 go get
-go build
+go build -ldflags "-X main.Version=$(git describe --tags --always --dirty) -X main.Commit=$(git rev-parse HEAD) -X main.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 
 sudo ./geofeeds
@@ -0,0 +1,74 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// Names of the snapshot files written to the snapshot directory
+var snapshotJSONFile = "radnote.json"
+var snapshotGeoJSONFile = "radnote.geojson"
+
+// Write pre-rendered JSON and GeoJSON snapshots of the entire current dataset to
+// the configured snapshot directory, so that a CDN can serve them directly.  Only
+// the default tenant is published, because the snapshots are public.
+func writeSnapshot() (count int, err error) {
+
+	if config().SnapshotDirectory == "" {
+		return 0, fmt.Errorf("no snapshot_directory is configured")
+	}
+	err = ensureLoaded()
+	if err != nil {
+		return 0, err
+	}
+
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	radLock.RLock()
+	eventJSON, err := json.Marshal(radnoteEvents)
+	for _, e := range radnoteEvents {
+		if e.Event.BestLat != 0 || e.Event.BestLon != 0 {
+			fc.Features = append(fc.Features, geojsonDeviceFeature(e))
+		}
+	}
+	count = len(radnoteEvents)
+	radLock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	geojsonJSON, err := json.Marshal(fc)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeFileAtomic(filepath.Join(config().SnapshotDirectory, snapshotJSONFile), eventJSON, 0644)
+	if err != nil {
+		return 0, err
+	}
+	err = writeFileAtomic(filepath.Join(config().SnapshotDirectory, snapshotGeoJSONFile), geojsonJSON, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+
+}
+
+// Periodically regenerate the snapshot.  The interval is resolved once, at
+// startup, so that a reload can't set it to 0 and leave the writer spinning.
+func snapshotWriter() {
+	interval := time.Duration(config().SnapshotIntervalSecs) * time.Second
+	for {
+		time.Sleep(interval)
+		_, err := writeSnapshot()
+		if err != nil {
+			slog.Error("can't write snapshot", "error", err)
+		}
+	}
+}
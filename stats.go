@@ -0,0 +1,252 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Determine whether a value is a finite number, rather than NaN or infinite,
+// either of which would poison any aggregate it contributed to
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// The number of buckets used when histogram edges are computed automatically
+const histogramAutoBuckets = 10
+
+// A histogram bucket counting values in [Lower, Upper).  A missing bound means
+// the bucket is unbounded in that direction.
+type histogramBucket struct {
+	Lower *float64 `json:"lower,omitempty"`
+	Upper *float64 `json:"upper,omitempty"`
+	Count int      `json:"count"`
+}
+
+// Compute evenly spaced bucket edges spanning the values
+func histogramAutoEdges(values []float64) (edges []float64) {
+	if len(values) == 0 {
+		return nil
+	}
+	min := values[0]
+	max := values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if min == max {
+		return []float64{min, max}
+	}
+	width := (max - min) / histogramAutoBuckets
+	for i := 0; i < histogramAutoBuckets; i++ {
+		edges = append(edges, min+float64(i)*width)
+	}
+	edges = append(edges, max)
+	return
+}
+
+// Count the values falling into the buckets delimited by the sorted edges.  When
+// openEnded, values below the first edge or at or above the last edge are counted
+// in unbounded buckets at either end.  Otherwise the last bucket also includes
+// values equal to its upper edge, and values outside the edges aren't counted.
+func histogram(values []float64, edges []float64, openEnded bool) (buckets []histogramBucket) {
+	if len(edges) == 0 {
+		return nil
+	}
+	if openEnded {
+		buckets = append(buckets, histogramBucket{Upper: &edges[0]})
+	}
+	for i := 0; i+1 < len(edges); i++ {
+		buckets = append(buckets, histogramBucket{Lower: &edges[i], Upper: &edges[i+1]})
+	}
+	if openEnded {
+		buckets = append(buckets, histogramBucket{Lower: &edges[len(edges)-1]})
+	}
+	for _, v := range values {
+		// The index of the first edge greater than the value
+		i := sort.SearchFloat64s(edges, v)
+		if i < len(edges) && edges[i] == v {
+			i++
+		}
+		if openEnded {
+			buckets[i].Count++
+			continue
+		}
+		if i == 0 || (i == len(edges) && v > edges[len(edges)-1]) {
+			continue
+		}
+		if i == len(edges) {
+			i--
+		}
+		buckets[i-1].Count++
+	}
+	return
+}
+
+// The default inverse-distance weighting exponent, and the range of exponents
+// that may be requested
+const (
+	idwDefaultPower = 2.0
+	idwMinPower     = 0.1
+	idwMaxPower     = 10.0
+)
+
+// Parse a requested inverse-distance weighting exponent, using the configured
+// idw_power, or else the default, if none was specified
+func idwPower(powerStr string) (power float64, err error) {
+	if powerStr == "" && config().IdwPower != 0 {
+		return config().IdwPower, nil
+	}
+	if powerStr == "" {
+		return idwDefaultPower, nil
+	}
+	power, err = strconv.ParseFloat(powerStr, 64)
+	if err != nil || math.IsNaN(power) || power < idwMinPower || power > idwMaxPower {
+		return 0, fmt.Errorf("power must be between %g and %g", idwMinPower, idwMaxPower)
+	}
+	return power, nil
+}
+
+// Estimate the value at a point by inverse-distance weighting the values of the
+// surrounding samples, each weighted by 1/distance^power.  A higher power gives
+// nearby samples more influence, preserving local detail, while a lower power
+// smooths the estimate toward the mean of all samples.  If a sample sits exactly
+// at the point its value is returned, averaged with any others also there.
+func idwEstimate(values []float64, distances []float64, power float64) float64 {
+	exactSum := 0.0
+	exactCount := 0
+	weightedSum := 0.0
+	weightSum := 0.0
+	for i, v := range values {
+		if distances[i] == 0 {
+			exactSum += v
+			exactCount++
+			continue
+		}
+		weight := 1 / math.Pow(distances[i], power)
+		weightedSum += weight * v
+		weightSum += weight
+	}
+	if exactCount > 0 {
+		return exactSum / float64(exactCount)
+	}
+	if weightSum == 0 {
+		return 0
+	}
+	return weightedSum / weightSum
+}
+
+// The aggregation functions that may be requested via the agg parameter
+var aggregationNames = []string{"min", "max", "mean", "median", "sum", "count", "p90", "p95", "p99", "stddev"}
+
+// Parse a comma-separated list of aggregation functions
+func parseAggregations(aggStr string) (aggs []string, err error) {
+	for _, agg := range strings.Split(aggStr, ",") {
+		agg = strings.TrimSpace(agg)
+		if agg == "" {
+			continue
+		}
+		known := false
+		for _, name := range aggregationNames {
+			known = known || agg == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown aggregation %s: must be one of %s", agg, strings.Join(aggregationNames, ","))
+		}
+		aggs = append(aggs, agg)
+	}
+	return
+}
+
+// Return the p'th percentile (0-100) of sorted values, linearly interpolating
+// between the closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := (p / 100) * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// Return the population standard deviation of values, treating the readings in
+// a region as the entire population being described rather than as a sample
+func stddev(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	squares := 0.0
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(squares / float64(len(values)))
+}
+
+// Compute only the requested aggregations over values.  With no values, count
+// and sum are zero while the others are nil, which marshals as null.  The
+// values are sorted only if an order statistic was requested.
+func computeAggregations(values []float64, aggs []string) map[string]interface{} {
+	stats := map[string]interface{}{}
+	var sorted []float64
+	for _, agg := range aggs {
+		switch agg {
+		case "count":
+			stats[agg] = len(values)
+			continue
+		case "sum":
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			stats[agg] = sum
+			continue
+		}
+		if len(values) == 0 {
+			stats[agg] = nil
+			continue
+		}
+		switch agg {
+		case "mean":
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			stats[agg] = sum / float64(len(values))
+		case "stddev":
+			stats[agg] = stddev(values)
+		default:
+			if sorted == nil {
+				sorted = append([]float64{}, values...)
+				sort.Float64s(sorted)
+			}
+			switch agg {
+			case "min":
+				stats[agg] = sorted[0]
+			case "max":
+				stats[agg] = sorted[len(sorted)-1]
+			case "median":
+				stats[agg] = percentile(sorted, 50)
+			case "p90":
+				stats[agg] = percentile(sorted, 90)
+			case "p95":
+				stats[agg] = percentile(sorted, 95)
+			case "p99":
+				stats[agg] = percentile(sorted, 99)
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Inverse-distance weighted estimates match those computed by hand, and a sample
+// exactly at the point is taken as the estimate
+func TestIdwEstimate(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    []float64
+		distances []float64
+		power     float64
+		estimate  float64
+	}{
+		// (1/100^2 + 3/200^2) / (1/100^2 + 1/200^2) = 1.75e-4 / 1.25e-4
+		{"squared", []float64{1, 3}, []float64{100, 200}, 2, 1.4},
+		// (1/100 + 3/200) / (1/100 + 1/200) = 0.025 / 0.015
+		{"linear", []float64{1, 3}, []float64{100, 200}, 1, 5.0 / 3},
+		// (2/10^3 + 4/20^3 + 8/40^3) / (1/10^3 + 1/20^3 + 1/40^3) = 2.625e-3 / 1.140625e-3
+		{"cubed", []float64{2, 4, 8}, []float64{10, 20, 40}, 3, 2.625 / 1.140625},
+		{"equidistant", []float64{1, 2, 3}, []float64{50, 50, 50}, 2, 2},
+		{"exactly at the point", []float64{5, 1}, []float64{0, 100}, 2, 5},
+		{"several exactly at the point", []float64{4, 6, 100}, []float64{0, 0, 10}, 2, 5},
+		{"no samples", nil, nil, 2, 0},
+	}
+	for _, test := range tests {
+		estimate := idwEstimate(test.values, test.distances, test.power)
+		if !testNear(estimate, test.estimate) {
+			t.Errorf("%s: got %g, want %g", test.name, estimate, test.estimate)
+		}
+	}
+}
+
+// A region query with interpolate=idw estimates the value at the query point from
+// the devices' distances from it
+func TestRegionIdwEstimate(t *testing.T) {
+	testService(t, Config{})
+	const lat, lon = 42.1, -71.1
+	testPostReading(t, "dev:1", 1700000000, 42.101, lon, map[string]interface{}{"usv": 0.1})
+	testPostReading(t, "dev:2", 1700000000, 42.103, lon, map[string]interface{}{"usv": 0.4})
+	d1 := metersApart(42.101, lon, lat, lon)
+	d2 := metersApart(42.103, lon, lat, lon)
+	want := (0.1/d1 + 0.4/d2) / (1/d1 + 1/d2)
+
+	content := testFeedContent(t, testGet("/radiation?lat=42.1&lon=-71.1&radius_meters=1000&interpolate=idw&p=1"))
+	estimate, _ := content["estimate"].(map[string]interface{})
+	usv, _ := estimate[defaultMetric].(float64)
+	if estimate["power"] != float64(1) || math.Abs(usv-want) > 1e-9 {
+		t.Errorf("got %v, want %g with power 1", estimate, want)
+	}
+	// With the distances in a ratio of 1:3, that is 0.175
+	if math.Abs(usv-0.175) > 1e-3 {
+		t.Errorf("got %g, want about 0.175", usv)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often a comment is sent on an idle stream, so that proxies keep it open
+// and a client that has gone away is noticed
+const streamKeepaliveInterval = 30 * time.Second
+
+// A client streaming the aggregate of a region, which is notified whenever a
+// reading within the region is stored, and whose closed channel is closed when
+// the server is shutting down
+type streamSubscriber struct {
+	tenant string
+	region queryRegion
+	notify chan struct{}
+	closed chan struct{}
+}
+
+// The clients currently streaming, and whether the server is shutting down
+var streamLock sync.Mutex
+var streamSubscribers = map[*streamSubscriber]bool{}
+var streamClosing bool
+
+// Begin notifying a client of readings within a region of a tenant.  A client
+// subscribing once the server is shutting down is closed at once.
+func streamSubscribe(tenant string, region queryRegion) *streamSubscriber {
+	s := &streamSubscriber{tenant: tenant, region: region, notify: make(chan struct{}, 1), closed: make(chan struct{})}
+	streamLock.Lock()
+	streamSubscribers[s] = true
+	if streamClosing {
+		close(s.closed)
+	}
+	streamLock.Unlock()
+	return s
+}
+
+// Close every stream, so that a graceful shutdown isn't held up waiting for
+// clients that would otherwise stream forever
+func streamShutdown() {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	if streamClosing {
+		return
+	}
+	streamClosing = true
+	for s := range streamSubscribers {
+		close(s.closed)
+	}
+}
+
+// Stop notifying a client
+func streamUnsubscribe(s *streamSubscriber) {
+	streamLock.Lock()
+	delete(streamSubscribers, s)
+	streamLock.Unlock()
+}
+
+// Notify the clients streaming regions containing a newly stored reading.  A
+// client that hasn't yet caught up with an earlier notification isn't notified
+// again, because it will send the latest aggregate anyway, so ingestion never
+// waits on a slow client.
+func streamPublish(tenant string, e RadnoteEvent) {
+	if e.Event.BestLat == 0 && e.Event.BestLon == 0 {
+		return
+	}
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	for s := range streamSubscribers {
+		if s.tenant != tenant || !s.region.contains(e.Event.BestLat, e.Event.BestLon) {
+			continue
+		}
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Compute the aggregate of a region, as streamed to clients
+func streamAggregate(ctx context.Context, tenant string, lat float64, lon float64, radiusMeters float64, metric string) map[string]interface{} {
+	samples, skipped, noLocation := scanRegion(ctx, tenant, lat, lon, radiusMeters, metric, 0, 0, config().LocationAccuracyPolicy)
+	agg := aggregateRegion(samples, config().LocationAccuracyPolicy, 0, 0)
+	o := map[string]interface{}{}
+	o["lat"] = lat
+	o["lon"] = lon
+	o["radius_meters"] = radiusMeters
+	o["count"] = agg.Count
+	if skipped > 0 {
+		o["skipped_count"] = skipped
+	}
+	o["no_location_count"] = noLocation
+	o["metric"] = metric
+	o[metric+"_min"] = agg.Min
+	o[metric+"_max"] = agg.Max
+	o[metric+"_avg"] = agg.Avg
+	o[metric+"_median"] = agg.Median
+	o[metric+"_stddev"] = agg.Stddev
+	o["captured"] = time.Now().UTC().Unix()
+	return o
+}
+
+// Stream handler, sending the aggregate of a region as a server-sent event when
+// the client connects and again whenever a reading within the region is stored,
+// until the client disconnects or the server shuts down
+func httpRadnoteStreamHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Make sure the data is available
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	if !ensureQueryable(w) {
+		return
+	}
+
+	// Validate the region
+	query := r.URL.Query()
+	lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, lonErr := strconv.ParseFloat(query.Get("lon"), 64)
+	if latErr != nil || lonErr != nil || math.IsNaN(lat) || lat < -90 || lat > 90 || math.IsNaN(lon) || lon < -180 || lon > 180 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("lat must be between -90 and 90, and lon between -180 and 180"))
+		return
+	}
+	radiusMeters := float64(10)
+	radiusMetersStr := query.Get("radius_meters")
+	if radiusMetersStr != "" {
+		var err error
+		radiusMeters, err = strconv.ParseFloat(radiusMetersStr, 64)
+		if err != nil || !(radiusMeters > 0) || math.IsInf(radiusMeters, 0) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("radius_meters must be a positive number"))
+			return
+		}
+	}
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = primaryMetric()
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	s := streamSubscribe(tenant, newQueryRegion(lat, lon, radiusMeters))
+	defer streamUnsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+	send := true
+	for {
+		var err error
+		if send {
+			var aggregateJSON []byte
+			aggregateJSON, err = json.Marshal(streamAggregate(r.Context(), tenant, lat, lon, radiusMeters, metric))
+			if err == nil {
+				_, err = fmt.Fprintf(w, "event: aggregate\ndata: %s\n\n", aggregateJSON)
+			}
+			send = false
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		case <-s.notify:
+			send = true
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		}
+	}
+
+}
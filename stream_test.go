@@ -0,0 +1,127 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read the next aggregate frame from a stream, skipping keepalives
+func testStreamFrame(t *testing.T, stream *bufio.Reader) map[string]interface{} {
+	t.Helper()
+	event := ""
+	data := ""
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before a frame: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			if event != "aggregate" {
+				t.Fatalf("got %q event, want aggregate", event)
+			}
+			aggregate := map[string]interface{}{}
+			err = json.Unmarshal([]byte(data), &aggregate)
+			if err != nil {
+				t.Fatalf("frame isn't JSON: %s", data)
+			}
+			return aggregate
+		}
+	}
+}
+
+// A client streaming a region is sent its aggregate on connecting and again when
+// a reading within it is posted, and is unsubscribed when it disconnects
+func TestStreamRegion(t *testing.T) {
+	testService(t, Config{})
+	testPostReading(t, "dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1})
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/radnote/stream?lat=42.1&lon=-71.1&radius_meters=1000", nil)
+	if err != nil {
+		t.Fatalf("can't make request: %s", err)
+	}
+	rsp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("can't connect: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d with %s, want 200 with text/event-stream", rsp.StatusCode, rsp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(rsp.Body)
+
+	aggregate := testStreamFrame(t, stream)
+	if aggregate["count"] != float64(1) || aggregate["usv_avg"] != 0.1 {
+		t.Errorf("on connecting: got count %v avg %v, want 1 and 0.1", aggregate["count"], aggregate["usv_avg"])
+	}
+
+	testPostReading(t, "dev:2", 1700000060, 42.101, -71.1, map[string]interface{}{"usv": 0.3})
+	aggregate = testStreamFrame(t, stream)
+	if aggregate["count"] != float64(2) || !testNear(aggregate["usv_avg"].(float64), 0.2) {
+		t.Errorf("after posting: got count %v avg %v, want 2 and 0.2", aggregate["count"], aggregate["usv_avg"])
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		streamLock.Lock()
+		subscribers := len(streamSubscribers)
+		streamLock.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers remain after disconnecting", subscribers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Only the subscribers whose tenant and region contain a reading are notified of
+// it, and a reading without a location notifies none
+func TestStreamPublish(t *testing.T) {
+	region := newQueryRegion(42.1, -71.1, 1000)
+	near := streamSubscribe("", region)
+	defer streamUnsubscribe(near)
+	otherTenant := streamSubscribe("acme", region)
+	defer streamUnsubscribe(otherTenant)
+	far := streamSubscribe("", newQueryRegion(48.8, 2.3, 1000))
+	defer streamUnsubscribe(far)
+
+	unlocated := RadnoteEvent{Event: testReading("dev:unlocated", 1700000000, 0, 0, nil)}
+	streamPublish("", unlocated)
+	e := RadnoteEvent{Event: testReading("dev:1", 1700000000, 42.1005, -71.1, nil)}
+	streamPublish("", e)
+	streamPublish("", e)
+
+	notified := map[string]*streamSubscriber{"near": near, "other tenant": otherTenant, "far": far}
+	for name, s := range notified {
+		count := len(s.notify)
+		want := 0
+		if s == near {
+			want = 1
+		}
+		if count != want {
+			t.Errorf("%s: got %d notifications, want %d", name, count, want)
+		}
+	}
+}
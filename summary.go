@@ -0,0 +1,125 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Ingestion counters, maintained atomically so that the hot ingest path never
+// contends on a lock.  These are in-memory only and reset when the service restarts.
+var (
+	statReceived             atomic.Int64
+	statStored               atomic.Int64
+	statSkippedNotData       atomic.Int64
+	statSkippedOlder         atomic.Int64
+	statSkippedDuplicate     atomic.Int64
+	statRejectedInvalid      atomic.Int64
+	statSkippedNoBody        atomic.Int64
+	statSkippedEmptyBody     atomic.Int64
+	statNoMeasurement        atomic.Int64
+	statRejectedBackpressure atomic.Int64
+)
+
+// The time at which counters were last reset, which is when we started
+var statSince = time.Now().UTC()
+
+// The boundaries of the freshness buckets, in seconds before now, each of which
+// counts the devices that last reported within it but not the previous bucket
+var freshnessBuckets = []struct {
+	name string
+	secs int64
+}{
+	{"hour", 60 * 60},
+	{"day", 24 * 60 * 60},
+	{"week", 7 * 24 * 60 * 60},
+}
+
+// Count devices by how recently they last reported, as of now.  Devices that last
+// reported more than a week ago are counted as "older".  The caller must hold
+// radLock.
+func freshnessDistribution(events map[string]RadnoteEvent, now int64) map[string]interface{} {
+	counts := map[string]int{"older": 0}
+	boundaries := map[string]int64{}
+	for _, bucket := range freshnessBuckets {
+		counts[bucket.name] = 0
+		boundaries[bucket.name] = bucket.secs
+	}
+	for _, e := range events {
+		bucketName := "older"
+		for _, bucket := range freshnessBuckets {
+			if now-e.Event.When <= bucket.secs {
+				bucketName = bucket.name
+				break
+			}
+		}
+		counts[bucketName]++
+	}
+	return map[string]interface{}{"devices": counts, "boundary_secs": boundaries}
+}
+
+// Summary handler, describing the stored data and how ingestion is going
+func httpRadnoteSummaryHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Make sure the data is available
+	tenant, ok := requestTenant(w, r)
+	if !ok {
+		return
+	}
+	if !ensureQueryable(w) {
+		return
+	}
+
+	now := time.Now().UTC().Unix()
+	radLock.RLock()
+	deviceCount := len(tenantEvents(tenant))
+	metric := primaryMetric()
+	metricCount := 0
+	metricSum := float64(0)
+	for _, e := range tenantEvents(tenant) {
+		value, present := e.metricValue(metric)
+		if present {
+			metricCount++
+			metricSum += value
+		}
+	}
+	freshness := freshnessDistribution(tenantEvents(tenant), now)
+	radLock.RUnlock()
+
+	o := map[string]interface{}{}
+	o["devices"] = deviceCount
+	o["metric"] = metric
+	o[metric+"_devices"] = metricCount
+	if metricCount > 0 {
+		o[metric+"_avg"] = metricSum / float64(metricCount)
+	}
+	o["stale"] = !persistHealthy.Load()
+	o["freshness"] = freshness
+	ingest := map[string]interface{}{}
+	ingest["since"] = statSince.Unix()
+	ingest["received"] = statReceived.Load()
+	ingest["stored"] = statStored.Load()
+	ingest["skipped_not_data_reading"] = statSkippedNotData.Load()
+	ingest["skipped_older"] = statSkippedOlder.Load()
+	ingest["skipped_duplicate"] = statSkippedDuplicate.Load()
+	ingest["rejected_invalid"] = statRejectedInvalid.Load()
+	ingest["skipped_no_body"] = statSkippedNoBody.Load()
+	ingest["skipped_empty_body"] = statSkippedEmptyBody.Load()
+	ingest["no_measurement"] = statNoMeasurement.Load()
+	ingest["rejected_backpressure"] = statRejectedBackpressure.Load()
+	ingest["write_queue_depth"] = writeQueueDepth()
+	o["ingest"] = ingest
+
+	summaryJSON, err := json.MarshalIndent(o, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(summaryJSON)
+
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The request header carrying the account key that identifies a request's tenant
+const accountKeyHeader = "X-Account-Key"
+
+// Loaded radnote data of each named tenant, protected by radLock.  The default
+// tenant, which is the only tenant unless account keys are configured, is held
+// in radnoteEvents.
+var radTenantEvents = map[string]map[string]RadnoteEvent{}
+
+// Whether the service is hosting multiple tenants
+func multiTenant() bool {
+	return len(config().AccountKeys) > 0
+}
+
+// Return the configured tenant names, sorted
+func configTenants() (tenants []string) {
+	seen := map[string]bool{}
+	for _, tenant := range config().AccountKeys {
+		if !seen[tenant] {
+			seen[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return
+}
+
+// Return whether a tenant name is safe to use within a data file name
+func validTenantName(tenant string) bool {
+	if tenant == "" {
+		return false
+	}
+	for _, c := range tenant {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Determine the tenant of a request from its account key, which may be supplied
+// in the X-Account-Key header or as a bearer token.  When hosting a single tenant
+// this is always the default tenant.  Otherwise a request without a known key is
+// refused with a 401, and false is returned.
+func requestTenant(w http.ResponseWriter, r *http.Request) (tenant string, ok bool) {
+	if !multiTenant() {
+		return "", true
+	}
+	key := r.Header.Get(accountKeyHeader)
+	if key == "" {
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if found {
+			key = bearer
+		}
+	}
+	tenant, ok = config().AccountKeys[key]
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("a valid account key is required"))
+		return "", false
+	}
+	return tenant, true
+}
+
+// The request header carrying the key that authorizes ingestion
+const ingestAPIKeyHeader = "X-API-Key"
+
+// Determine whether a request may ingest readings, which requires the configured
+// ingest key, if any, in the X-API-Key header or as a bearer token.  The keys
+// are compared in constant time so that the key can't be discovered by timing
+// responses.  If the request isn't authorized it is refused with a 401, and false
+// is returned.
+func ingestAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if config().IngestAPIKey == "" {
+		return true
+	}
+	key := r.Header.Get(ingestAPIKeyHeader)
+	if key == "" {
+		bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if found {
+			key = bearer
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(config().IngestAPIKey)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte("a valid ingest key is required"))
+	return false
+}
+
+// Return the key identifying a device of a tenant
+func tenantDevice(tenant string, deviceUID string) string {
+	return tenant + "/" + deviceUID
+}
+
+// Return the stored events of a tenant.  The caller must hold radLock.
+func tenantEvents(tenant string) map[string]RadnoteEvent {
+	if tenant == "" {
+		return radnoteEvents
+	}
+	return radTenantEvents[tenant]
+}
+
+// Return the name of the data file of a tenant, within the data directory
+func tenantFile(tenant string) string {
+	if tenant == "" {
+		return radnoteFile
+	}
+	return strings.TrimSuffix(radnoteFile, ".json") + "." + tenant + ".json"
+}
+
+// Return the name of the data file of a tenant in the legacy format
+func tenantLegacyFile(tenant string) string {
+	if tenant == "" {
+		return radFile
+	}
+	return strings.TrimSuffix(radFile, ".json") + "." + tenant + ".json"
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Ingestion requires the configured key, in either X-API-Key or a bearer token,
+// while queries remain public
+func TestIngestAPIKey(t *testing.T) {
+	testService(t, Config{IngestAPIKey: "s3cret"})
+	body, _ := json.Marshal(testReading("dev:1", 1700000000, 42.1, -71.1, map[string]interface{}{"usv": 0.1}))
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong key", ingestAPIKeyHeader, "guess", http.StatusUnauthorized},
+		{"key prefix", ingestAPIKeyHeader, "s3cre", http.StatusUnauthorized},
+		{"wrong bearer", "Authorization", "Bearer guess", http.StatusUnauthorized},
+		{"key without bearer scheme", "Authorization", "s3cret", http.StatusUnauthorized},
+		{"correct key", ingestAPIKeyHeader, "s3cret", http.StatusOK},
+		{"correct bearer", "Authorization", "Bearer s3cret", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/radnote", bytes.NewReader(body))
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := testServe(r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: got WWW-Authenticate %q, want Bearer", test.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	w := testGet("/radiation")
+	if w.Code != http.StatusOK {
+		t.Errorf("query without a key: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Per-request timing, broken down into named phases
+type serverTiming struct {
+	started time.Time
+	last    time.Time
+	phases  []timingPhase
+}
+
+// A single timed phase of a request
+type timingPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// Begin timing a request
+func newServerTiming() *serverTiming {
+	now := time.Now()
+	return &serverTiming{started: now, last: now}
+}
+
+// Record that the named phase has just completed
+func (t *serverTiming) mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, timingPhase{name: name, duration: now.Sub(t.last)})
+	t.last = now
+}
+
+// Total time elapsed since the request began
+func (t *serverTiming) total() time.Duration {
+	return time.Since(t.started)
+}
+
+// Add a Server-Timing header describing the phases, which must be done before
+// the response status or body are written
+func (t *serverTiming) writeHeader(w http.ResponseWriter) {
+	if t == nil || len(t.phases) == 0 {
+		return
+	}
+	metrics := []string{}
+	for _, p := range t.phases {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", p.name, float64(p.duration.Microseconds())/1000))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", float64(t.total().Microseconds())/1000))
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
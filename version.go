@@ -0,0 +1,73 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// Build information, set at build time with, for example,
+// -ldflags "-X main.Version=v1.2.3 -X main.Commit=abc1234 -X main.BuildTime=2024-01-02T03:04:05Z"
+var (
+	Version   string
+	Commit    string
+	BuildTime string
+)
+
+// Build information used when none was set at build time
+const (
+	versionDefault = "dev"
+	versionUnknown = "unknown"
+)
+
+// Fill in any build information that wasn't set at build time, from what the go
+// tool recorded about the source's version control state if it can, or else with
+// placeholders
+func init() {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		settings := map[string]string{}
+		for _, setting := range info.Settings {
+			settings[setting.Key] = setting.Value
+		}
+		if Commit == "" && settings["vcs.revision"] != "" {
+			Commit = settings["vcs.revision"]
+			if settings["vcs.modified"] == "true" {
+				Commit += "-dirty"
+			}
+		}
+		if BuildTime == "" {
+			BuildTime = settings["vcs.time"]
+		}
+	}
+	if Version == "" {
+		Version = versionDefault
+	}
+	if Commit == "" {
+		Commit = versionUnknown
+	}
+	if BuildTime == "" {
+		BuildTime = versionUnknown
+	}
+}
+
+// Version handler, identifying the running build
+func httpVersionHandler(w http.ResponseWriter, r *http.Request) {
+
+	o := map[string]interface{}{}
+	o["version"] = Version
+	o["commit"] = Commit
+	o["build_time"] = BuildTime
+
+	versionJSON, err := json.MarshalIndent(o, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(versionJSON)
+
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Return the build information served by the version endpoint
+func testVersion(t *testing.T) map[string]string {
+	t.Helper()
+	w := testGet("/version")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /version: got %d, want %d", w.Code, http.StatusOK)
+	}
+	version := map[string]string{}
+	err := json.Unmarshal(w.Body.Bytes(), &version)
+	if err != nil {
+		t.Fatalf("version isn't JSON: %s", w.Body.String())
+	}
+	return version
+}
+
+// The version endpoint serves the build information set at build time, which
+// /ping also reports, and placeholders for any that wasn't
+func TestVersion(t *testing.T) {
+	testService(t, Config{})
+
+	// This test binary is built without -ldflags, so the version is the default,
+	// and the commit and build time are those recorded by the go tool if any
+	version := testVersion(t)
+	if version["version"] != versionDefault {
+		t.Errorf("version: got %q, want %q", version["version"], versionDefault)
+	}
+	for _, field := range []string{"commit", "build_time"} {
+		if version[field] == "" {
+			t.Errorf("%s is empty", field)
+		}
+	}
+
+	// As if set with -ldflags
+	saved := []string{Version, Commit, BuildTime}
+	defer func() { Version, Commit, BuildTime = saved[0], saved[1], saved[2] }()
+	Version, Commit, BuildTime = "v1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+	version = testVersion(t)
+	if version["version"] != "v1.2.3" || version["commit"] != "abc1234" || version["build_time"] != "2024-01-02T03:04:05Z" {
+		t.Errorf("got %v, want the build information set", version)
+	}
+	w := testGet("/ping")
+	if !strings.HasSuffix(w.Body.String(), " v1.2.3") {
+		t.Errorf("ping doesn't report the version: %s", w.Body.String())
+	}
+}